@@ -1,15 +1,46 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"expvar"
 	"flag"
+	"fmt"
+	"html"
+	"maps"
+	"math/rand/v2"
+	"net"
 	"net/http"
+	"net/http/pprof"
+	"net/url"
 	"os"
 	"os/signal"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"syscall"
+	"time"
 
+	"github.com/gjtempleton/spot-termination-exporter/pkg/collector"
+	"github.com/gjtempleton/spot-termination-exporter/pkg/imds"
+	"github.com/gjtempleton/spot-termination-exporter/pkg/kube"
+	"github.com/gjtempleton/spot-termination-exporter/pkg/notify"
+	"github.com/gjtempleton/spot-termination-exporter/pkg/provider"
+	"github.com/gjtempleton/spot-termination-exporter/pkg/relabel"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	log "github.com/sirupsen/logrus"
+	"golang.org/x/time/rate"
+	corev1 "k8s.io/api/core/v1"
+	policyv1 "k8s.io/api/policy/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
 )
 
 func init() {
@@ -23,55 +54,1934 @@ func init() {
 }
 
 var logLevel = log.InfoLevel
+var mode = flag.String("mode", "node", "node to export metrics from the local metadata service, events to consume EventBridge events for the whole fleet from SQS, fleet to poll the EC2 API for the whole fleet")
 var bindAddr = flag.String("bind-addr", ":9189", "bind address for the metrics server")
 var metricsPath = flag.String("metrics-path", "/metrics", "path to metrics endpoint")
+var externalURL = flag.String("web.external-url", "", "URL under which the exporter is reachable, e.g. behind a reverse proxy, used for links on the landing page and to derive the route prefix")
+var routePrefixFlag = flag.String("web.route-prefix", "", "prefix of the paths of all endpoints, defaults to the path of --web.external-url")
+var corsAllowedOrigins = flag.String("web.cors-allowed-origins", "", "comma-separated origins allowed to read the JSON endpoints from the browser, * for any")
+var rateLimit = flag.Float64("web.rate-limit", 0, "requests per second each client IP may make to the JSON and admin endpoints, 0 for no limit")
+var rateLimitBurst = flag.Int("web.rate-limit-burst", 10, "requests a client IP may make at once before --web.rate-limit applies")
+var adminAddr = flag.String("admin-addr", "", "separate bind address, e.g. localhost:9190, for /healthz, /startupz, /-/refresh, pprof and expvar, which are otherwise served on --bind-addr without pprof and expvar")
+var kubeAuth = flag.Bool("kube-auth", false, "require scrapes to present a ServiceAccount token allowed to get the requested path, checked with TokenReview and SubjectAccessReview")
+var kubeAuthCacheTTL = flag.Duration("kube-auth-cache-ttl", time.Minute, "how long to cache the result of reviewing a token")
+var adminTokenFile = flag.String("admin-token-file", "", "file holding the bearer token required by the POST /-/refresh endpoint, which is disabled if unset")
+var relabelConfig = flag.String("relabel-config", "", "YAML file with metric_relabel_configs applied to the exported metrics")
+var metricAliases = flag.String("metric-aliases", "", "comma-separated old=new metric names to export under both names during a deprecation window, e.g. aws_instance_termination_in=aws_instance_termination_in_seconds")
+var healthUnhealthyAfter = flag.Duration("health-unhealthy-after", 5*time.Minute, "time without a successful poll of the metadata service after which /healthz reports unhealthy")
+var disableLandingPage = flag.Bool("web.disable-landing-page", false, "don't serve the landing page at /, answering 404 instead")
+var landingPageTitle = flag.String("web.landing-page-title", "Spot Termination Exporter", "title of the landing page")
+var landingPageLinks = flag.String("web.landing-page-links", "", "comma-separated name=url links to add to the landing page, e.g. Health=/healthz")
 var rawLevel = flag.String("log-level", "info", "log level")
-var metadataEndpoint = flag.String("metadata-endpoint", "http://169.254.169.254/latest/meta-data/", "metadata endpoint to query")
-var tokenEndpoint = flag.String("token-endpoint", "http://169.254.169.254/latest/api/token", "token endpoint to query")
-var useIMDSv2 = flag.Bool("use-imdsv2", false, "token endpoint to query")
+var providerName = flag.String("provider", "auto", "metadata provider to query, auto to detect it from the available metadata services")
+var metadataEndpoint = flag.String("metadata-endpoint", "", "comma-separated metadata endpoints to query, later ones are tried in order when earlier ones can't be reached (defaults to the provider's endpoint)")
+var probeTargetAllowlist = flag.String("probe-target-allowlist", "", "regex matching the host, or host:port, of the metadata endpoints /probe may scrape, /probe is disabled if empty")
+var tokenEndpoint = flag.String("token-endpoint", "", "token endpoint to query (defaults to the provider's endpoint)")
+var metadataCACert = flag.String("metadata-ca-cert", "", "path to a PEM file with the CA certificates to trust for https metadata and token endpoints")
+var metadataInsecureSkipVerify = flag.Bool("metadata-insecure-skip-verify", false, "don't verify the certificates of https metadata and token endpoints")
+var imdsNoProxy = flag.Bool("imds-no-proxy", true, "ignore the HTTP_PROXY and HTTPS_PROXY environment variables for requests to the metadata service")
+var imdsDump = flag.Bool("imds-dump", false, "log every request to the metadata service and its response at debug level for troubleshooting, with tokens and credentials redacted")
+var imdsTimeout = flag.Duration("imds-timeout", time.Second, "timeout of metadata requests with the aws provider")
+var imdsTokenTimeout = flag.Duration("imds-token-timeout", time.Second, "timeout of IMDSv2 token requests with the aws provider, which often need longer than metadata requests")
+var imdsv2TokenTTL = flag.Duration("imdsv2-token-ttl", imds.TokenTTL, "lifetime requested for IMDSv2 session tokens, between 1s and 6h")
+var stateFile = flag.String("state-file", "", "file to persist interruption tracking state to across restarts, e.g. on a hostPath volume")
+var eventHistorySize = flag.Int("event-history-size", 100, "number of interruption events kept for /api/v1/history, 0 to disable it")
+var eventHistoryFile = flag.String("event-history-file", "", "file to persist the event history to across restarts, e.g. on a hostPath volume")
+var eventHistoryRetention = flag.Duration("event-history-retention", 30*24*time.Hour, "how long to keep events in the event history, 0 to keep the last --event-history-size events regardless of their age")
+var notifyPID = flag.Int("notify-pid", 0, "PID of a co-located process to signal when a termination notice is first observed")
+var notifyPIDFile = flag.String("notify-pidfile", "", "file holding the PID of a co-located process to signal when a termination notice is first observed, read when the notice is observed")
+var notifySignal = flag.String("notify-signal", "SIGTERM", "signal sent to the process given by --notify-pid or --notify-pidfile")
+var execChild = flag.Bool("exec", false, "run the command given after -- as a child process, signalled with --exec-signal on a termination notice and killed after --exec-grace-period, and exit with its exit code")
+var execSignal = flag.String("exec-signal", "SIGTERM", "signal sent to the child process of --exec on a termination notice")
+var execGracePeriod = flag.Duration("exec-grace-period", 90*time.Second, "time the child process of --exec is given to exit after being signalled before it is killed")
+var drainSafetyMargin = flag.Duration("drain-safety-margin", 15*time.Second, "time before the termination time by which the termination notice hooks should have completed, subtracted from aws_instance_drain_deadline_seconds")
+var route53ZoneID = flag.String("route53-zone-id", "", "hosted zone of the --route53-records to take the instance out of on a termination notice")
+var route53Records = flag.String("route53-records", "", "comma-separated names of Route53 records to take the instance out of on a termination notice, requires permission to list and change the record sets of --route53-zone-id")
+var route53Action = flag.String("route53-action", notify.Route53Delete, "delete to remove the addresses of the instance from the --route53-records, downweight to set the weight of its weighted records to 0")
+var drainNode = flag.Bool("drain-node", false, "cordon the node and evict its pods on a termination notice, requires permission to patch nodes, list pods and create pods/eviction")
+var drainEvictionOrder = flag.String("drain-eviction-order", "", "comma-separated rules selecting the pods evicted first by --drain-node, in order, e.g. namespace=databases,priority-class=latency-critical,annotation=example.com/evict-first=true, pods matching none are evicted last")
+var drainIgnorePDBAfter = flag.Duration("drain-ignore-pdb-after", 0, "time after which --drain-node deletes the pods whose eviction is still refused by a PodDisruptionBudget, 0 to always respect the budgets")
+var drainTimeout = flag.Duration("drain-timeout", kube.DefaultDrainTimeout, "time after which --drain-node gives up on the pods not evicted yet")
+var drainGracePeriod = flag.Duration("drain-grace-period", -1, "termination grace period given to the pods evicted by --drain-node, negative to keep the grace period of each pod")
+var drainForce = flag.Bool("drain-force", false, "make --drain-node evict the pods without controller too, which aren't recreated elsewhere")
+var drainIgnoreDaemonSets = flag.Bool("drain-ignore-daemonsets", true, "make --drain-node ignore DaemonSet pods, which it otherwise refuses to drain, like kubectl drain --ignore-daemonsets")
+var drainIgnoreMirrorPods = flag.Bool("drain-ignore-mirror-pods", true, "make --drain-node ignore static pods, which it otherwise refuses to drain")
+var acknowledgeNotices = flag.Bool("acknowledge-notices", false, "acknowledge termination notices once the other hooks completed, so the platform interrupts the instance without waiting for the deadline, only supported by the azure provider")
+var notificationConfig = flag.String("notification-config", "", "YAML or JSON file configuring webhooks, Slack incoming webhooks and Alertmanagers to send the termination notices and rebalance recommendations to")
+var notificationTimeout = flag.Duration("notification-timeout", 10*time.Second, "timeout of the requests sending a notification")
+var notificationRetryDeadline = flag.Duration("notification-retry-deadline", time.Hour, "how long after an event was observed to keep sending it again to the sinks which failed to get it, with a backoff from 5 seconds up to 5 minutes, 0 not to retry")
+var notificationQueueFile = flag.String("notification-queue-file", "", "file to persist the notifications waiting to be sent again to across restarts, e.g. on a hostPath volume")
+var notificationBatchWindow = flag.Duration("notification-batch-window", 0, "in events mode, send the events a sink gets within this time after the first of them as a single notification summarizing them per availability zone and instance type, 0 to send each event on its own")
+var traceNotifications = flag.Bool("trace-notifications", false, "send a W3C traceparent header with the notifications, continuing a trace derived from the event id so an event can be followed across the systems it reaches")
+var dryRun = flag.Bool("dry-run", false, "only log and record in the event history what the termination notice hooks would do, e.g. which pods --drain-node would evict, without doing it")
+var shutdownDeadline = flag.Duration("shutdown-deadline", 90*time.Second, "how long to delay exiting on SIGTERM while processes are still acting on a termination notice")
+var noticePollIntervalAfterRebalance = flag.Duration("notice-poll-interval-after-rebalance", time.Second, "how often to read the termination notice between scrapes for --rebalance-poll-window after a rebalance recommendation, as a termination is then likely to follow, 0 to keep --notice-poll-interval")
+var rebalancePollWindow = flag.Duration("rebalance-poll-window", 30*time.Minute, "how long --notice-poll-interval-after-rebalance applies after a rebalance recommendation not followed by a termination notice")
+var startupJitter = flag.Duration("startup-jitter", 0, "delay the background polling of the metadata service and the Kubernetes API by a random time up to this, so the pods of a DaemonSet rolled out together don't all start polling at the same instant")
+var pollJitter = flag.Float64("poll-jitter", 0, "randomize the intervals of the background polling and the retries by up to this fraction of them, e.g. 0.1, so the exporters don't keep polling in phase")
+var waitForChange = flag.Bool("wait-for-change", true, "instead of reading the termination notice every --notice-poll-interval, wait for the metadata server to report a change where supported, i.e. by the gce provider")
+var noticePollInterval = flag.Duration("notice-poll-interval", 5*time.Second, "how often to read the termination notice between scrapes while a process is to be notified or the child of --exec runs, 0 to only read it on scrapes")
+var imdsBreakerThreshold = flag.Int("imds-breaker-threshold", 0, "consecutive failed scrapes of the metadata service after which it is skipped for the cooldown, 0 to never skip it")
+var imdsBreakerCooldown = flag.Duration("imds-breaker-cooldown", time.Minute, "how long to skip the metadata service after repeated failures")
+var maxConsecutiveFailures = flag.Int("max-consecutive-failures", 0, "consecutive failed scrapes of the metadata service after which the exporter exits non-zero to be restarted, 0 to never exit")
+var identityCacheTTL = flag.Duration("identity-cache-ttl", 0, "how long to cache the instance identity, 0 to read it on every scrape, negative to cache it forever")
+var noticeCacheTTL = flag.Duration("notice-cache-ttl", 0, "how long to cache termination notices, rebalance recommendations and the lifecycle state, 0 to read them on every scrape")
+var maintenanceCacheTTL = flag.Duration("maintenance-cache-ttl", 0, "how long to cache scheduled and past maintenance events, 0 to read them on every scrape")
+var requireIMDS = flag.Bool("require-imds", false, "exit at startup if the metadata service, and the token endpoint with IMDSv2, can't be reached")
+var imdsv2Mode = flag.String("imdsv2", "off", "required to always use IMDSv2 session tokens, preferred to fall back to IMDSv1 when no token can be obtained, off to use IMDSv1")
+var useIMDSv2 = flag.Bool("use-imdsv2", false, "deprecated, same as --imdsv2=required")
 var attachNodeLabels = flag.Bool("attach-node-labels", false, "attach labels from node")
+var nodeLabelAllowlist = flag.String("node-label-allowlist", "", "regex matching the node label keys to attach, all labels are attached if empty")
+var nodeLabelDenylist = flag.String("node-label-denylist", "", "regex matching the node label keys not to attach")
+var nodeLabelStripPrefixes = flag.String("node-label-strip-prefixes", "", "comma-separated prefixes to strip from node label keys, e.g. node.kubernetes.io/")
+var nodeLabelRename = flag.String("node-label-rename", "", "comma-separated key=name node label keys to export under another label name, e.g. topology.kubernetes.io/zone=zone")
+var attachNodeAnnotations = flag.String("attach-node-annotations", "", "regex matching the node annotation keys to attach as labels")
+var exportNodeTaints = flag.Bool("export-node-taints", false, "export the taints of the node")
+var exportAffectedPods = flag.Bool("export-affected-pods", false, "export the number of pods on the node per namespace while a termination notice is pending, requires permission to list pods")
+var affectedPodsByOwnerKind = flag.Bool("affected-pods-by-owner-kind", false, "additionally count the affected pods per kind of their controlling owner")
+var exportPDBBlocked = flag.Bool("export-pdb-blocked", false, "export how many pods on the node each PodDisruptionBudget would prevent from being evicted while a termination notice is pending, requires permission to list pods and poddisruptionbudgets")
+var skipOnDemandNodes = flag.Bool("skip-on-demand-nodes", true, "once the node is read, skip termination notices, rebalance recommendations, savings, affected pods and PodDisruptionBudgets on nodes whose karpenter.sh/capacity-type or eks.amazonaws.com/capacityType label isn't spot")
+var watchNodeLabels = flag.Bool("watch-node-labels", false, "watch the node and update the attached labels, annotations and exported taints when they change, requires permission to list and watch nodes")
+var nodeNameFallback = flag.String("node-name-fallback", "local-hostname,hostname", "comma-separated metadata hostnames to use in order of preference as node name when NODE_NAME is unset")
+var nodeFromProviderID = flag.Bool("node-from-provider-id", false, "find the node by matching its spec.providerID against the instance id instead of using NODE_NAME, requires permission to list nodes")
 var kubeconfig = flag.String("kubeconfig", "", "path to kubeconfig file")
+var kubeContext = flag.String("kube-context", "", "kubeconfig context to use instead of the current one")
+var kubeAPITimeout = flag.Duration("kube-api-timeout", kube.DefaultTimeout, "timeout of Kubernetes API requests")
+var kubeAPIQPS = flag.Float64("kube-api-qps", 0, "maximum queries per second to the Kubernetes API, 0 for the client-go default")
+var kubeAPIBurst = flag.Int("kube-api-burst", 0, "maximum burst of queries to the Kubernetes API, 0 for the client-go default")
+var exportSavings = flag.Bool("export-savings", false, "export on-demand and spot prices, the spot savings ratio and the estimated savings")
+var pricingRegion = flag.String("pricing-region", "us-east-1", "region of the AWS Pricing API endpoint")
+var onDemandPriceCacheTTL = flag.Duration("on-demand-price-cache-ttl", 24*time.Hour, "how long to cache on-demand prices")
+var spotPriceCacheTTL = flag.Duration("spot-price-cache-ttl", time.Hour, "how long to cache spot prices")
+var exportMaintenanceHistory = flag.Bool("export-maintenance-history", false, "export the number of completed and canceled maintenance events of the instance")
+var exportInstanceInfo = flag.Bool("export-instance-info", false, "export details of the instance read from the EC2 API, such as the capacity reservation it runs in")
+var exportNetworkInfo = flag.Bool("export-network-info", false, "export the network interfaces attached to the instance, with their addresses, subnet and VPC")
+var networkInfoCacheTTL = flag.Duration("network-info-cache-ttl", time.Minute, "how long to cache the network interfaces of the instance")
+var instanceInfoCacheTTL = flag.Duration("instance-info-cache-ttl", 10*time.Minute, "how long to cache the details of the instance")
+var resolveNodegroup = flag.Bool("resolve-nodegroup", false, "attach the EKS managed node group from the eks:nodegroup-name tag of the instance as nodegroup label to the termination and rebalance metrics, read from the instance tags in the metadata service or with ec2:DescribeTags")
+var customMetricsConfig = flag.String("custom-metrics-config", "", "YAML file mapping metadata paths to custom metrics")
+var fleetTagFilters = flag.String("fleet-tag-filters", "", "comma-separated key=value tags selecting the instances to export in fleet mode")
+var fleetPollInterval = flag.Duration("fleet-poll-interval", time.Minute, "how often to poll the EC2 API in fleet mode")
+var fleetRateWindow = flag.Duration("fleet-rate-window", collector.DefaultRateWindow, "window the interruption rates of the fleet are computed over")
+var clusterSummary = flag.Bool("cluster-summary", false, "in node mode, let the replica elected leader export fleet-wide interruption counts of the instances selected by --fleet-tag-filters")
+var clusterSummaryLease = flag.String("cluster-summary-lease", "spot-termination-exporter", "name of the Lease in the POD_NAMESPACE namespace used to elect the replica exporting the cluster summary")
+var placementScoreInstanceTypes = flag.String("placement-score-instance-types", "", "comma-separated instance types to export spot placement scores for")
+var placementScoreRegions = flag.String("placement-score-regions", "", "comma-separated regions to export spot placement scores for")
+var placementScoreTargetCapacity = flag.Int("placement-score-target-capacity", 1, "target capacity in instances used for spot placement scores")
+var placementScoreSingleAZ = flag.Bool("placement-score-single-az", true, "export spot placement scores per availability zone rather than per region")
+var placementScoreCacheTTL = flag.Duration("placement-score-cache-ttl", 10*time.Minute, "how long to cache spot placement scores")
+var sqsQueueURL = flag.String("sqs-queue-url", "", "URL of the SQS queue receiving EventBridge spot events in events mode")
+var eventRetention = flag.Duration("event-retention", 10*time.Minute, "how long to export an event received in events mode")
 
 func main() {
 	log.SetLevel(logLevel)
 	log.Info("Starting spot-termination-exporter")
 
-	log.Debug("registering term exporter")
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
 
-	var nodeLabels prometheus.Labels
-	if *attachNodeLabels {
-		labels, err := getNodeLabels(*kubeconfig)
-		if err != nil {
-			log.WithError(err).Error("Failed to get node labels")
-			os.Exit(1)
+	startTime := prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "spot_exporter_start_time_seconds",
+		Help: "Start time of the exporter since unix epoch in seconds",
+	})
+	startTime.SetToCurrentTime()
+	prometheus.MustRegister(startTime)
+
+	switch *imdsv2Mode {
+	case "off", "preferred", "required":
+	default:
+		log.Fatalf("unknown --imdsv2 mode %q", *imdsv2Mode)
+	}
+	if *useIMDSv2 && *imdsv2Mode == "off" {
+		*imdsv2Mode = "required"
+	}
+
+	transport, err := newMetadataTransport()
+	if err != nil {
+		log.Fatal(err)
+	}
+	metadataTransport = transport
+	if *imdsDump {
+		if logLevel < log.DebugLevel {
+			log.Warn("--imds-dump only logs at --log-level=debug")
 		}
-		nodeLabels = labels
+		metadataTransport = imds.NewDumpTransport(transport)
 	}
 
-	prometheus.MustRegister(NewTerminationCollector(*metadataEndpoint, *tokenEndpoint, *useIMDSv2, nodeLabels))
+	switch *mode {
+	case "node":
+		registerNodeCollectors(ctx)
+		if *clusterSummary {
+			registerClusterSummary(ctx)
+		}
+	case "events":
+		if *sqsQueueURL == "" {
+			log.Fatal("--sqs-queue-url is required in events mode")
+		}
+		log.Debug("registering event exporter")
+		events := collector.NewEventCollector(*sqsQueueURL, *eventRetention)
+		if *notificationConfig != "" {
+			_, handler := newNotifications(ctx, *notificationBatchWindow)
+			events.SetEventHandler(handler)
+		}
+		prometheus.MustRegister(events)
+		go func() {
+			if err := events.Run(ctx); err != nil {
+				log.WithError(err).Fatal("Failed to consume events")
+			}
+		}()
+	case "fleet":
+		tagFilters, err := parseKeyValues(*fleetTagFilters, "tag filter")
+		if err != nil {
+			log.Fatal(err)
+		}
+		log.Debug("registering fleet exporter")
+		fleet := collector.NewFleetCollector(tagFilters, *fleetPollInterval)
+		fleet.SetRateWindow(*fleetRateWindow)
+		prometheus.MustRegister(fleet)
+		go func() {
+			if err := fleet.Run(ctx); err != nil {
+				log.WithError(err).Fatal("Failed to poll fleet")
+			}
+		}()
+	default:
+		log.Fatalf("unknown mode %q", *mode)
+	}
+	if *placementScoreInstanceTypes != "" {
+		log.Debug("registering placement score exporter")
+		prometheus.MustRegister(collector.NewPlacementScoreCollector(splitList(*placementScoreInstanceTypes), splitList(*placementScoreRegions), int32(*placementScoreTargetCapacity), *placementScoreSingleAZ, *placementScoreCacheTTL))
+	}
 
 	go serveMetrics()
 
 	exitChannel := make(chan os.Signal, 1)
 	signal.Notify(exitChannel, syscall.SIGINT, syscall.SIGTERM, syscall.SIGQUIT)
+	if child != nil {
+		superviseChild(exitChannel)
+	}
 	exitSignal := <-exitChannel
 	log.WithFields(log.Fields{"signal": exitSignal}).Infof("Caught %s signal, exiting", exitSignal)
+	waitShutdown()
+}
+
+// registerClusterSummary lets the replica elected leader export the
+// aggregated metrics of the fleet, so the replicas of a DaemonSet don't all
+// poll the EC2 API.
+func registerClusterSummary(ctx context.Context) {
+	namespace := os.Getenv("POD_NAMESPACE")
+	if namespace == "" {
+		log.Fatal("--cluster-summary requires POD_NAMESPACE to be set, usually through the downward API")
+	}
+	identity, err := os.Hostname()
+	if err != nil {
+		log.Fatal(err)
+	}
+	tagFilters, err := parseKeyValues(*fleetTagFilters, "tag filter")
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	log.Debug("registering cluster summary exporter")
+	fleet := collector.NewFleetCollector(tagFilters, *fleetPollInterval)
+	fleet.SetSummaryOnly(true)
+	fleet.SetRateWindow(*fleetRateWindow)
+	prometheus.MustRegister(fleet)
+	go func() {
+		err := kube.RunLeaderElection(ctx, kubeConfig(), namespace, *clusterSummaryLease, identity, func(ctx context.Context) {
+			if err := fleet.Run(ctx); err != nil {
+				log.WithError(err).Error("Failed to poll fleet")
+			}
+		})
+		if err != nil {
+			log.WithError(err).Error("Failed to run leader election for the cluster summary")
+		}
+	}()
+}
+
+// child is the process run with --exec, if any.
+var child *notify.Child
+
+// superviseChild forwards the signals asking the exporter to stop to the
+// child of --exec, and exits with its exit code once it exited and the
+// termination notice hooks still running completed.
+func superviseChild(exitChannel <-chan os.Signal) {
+	for {
+		select {
+		case exitSignal := <-exitChannel:
+			// the child was already signalled and is shutting down, which
+			// another signal could cut short
+			if noticeHooks.running() {
+				log.WithFields(log.Fields{"signal": exitSignal}).Infof("Caught %s signal while the child process handles a termination notice, waiting for it", exitSignal)
+				go func() {
+					noticeHooks.wait(*shutdownDeadline)
+					child.Signal(syscall.SIGKILL)
+				}()
+				continue
+			}
+			log.WithFields(log.Fields{"signal": exitSignal}).Infof("Caught %s signal, forwarding it to the child process", exitSignal)
+			if err := child.Signal(exitSignal); err != nil {
+				log.WithError(err).Error("Failed to forward signal to the child process")
+			}
+		case <-child.Done():
+			code := child.ExitCode()
+			log.Infof("Child process exited with code %d, exiting", code)
+			// the child exiting on a termination notice lets the hooks
+			// after it run, e.g. --acknowledge-notices
+			waitShutdown()
+			os.Exit(code)
+		}
+	}
+}
+
+// notificationsSending counts the notifications being sent.
+var notificationsSending sync.WaitGroup
+
+// waitShutdown waits at most --shutdown-deadline until the termination
+// notice hooks completed and the notifications being sent were sent.
+func waitShutdown() {
+	start := time.Now()
+	noticeHooks.wait(*shutdownDeadline)
+	done := make(chan struct{})
+	go func() {
+		notificationsSending.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(*shutdownDeadline - time.Since(start)):
+		log.Warn("Notifications still being sent, exiting anyway")
+	}
+}
+
+// hookPipeline counts the notice hooks in progress, so exiting can be
+// delayed until they completed, and exports the time left to complete them
+// and the time each one took so far.
+type hookPipeline struct {
+	wg      sync.WaitGroup
+	pending atomic.Int32
+
+	mu       sync.Mutex
+	deadline time.Time
+	hooks    []hookRun
+}
+
+// hookRun is a hook run for the last termination notice.
+type hookRun struct {
+	name     string
+	started  time.Time
+	finished time.Time
+}
+
+var (
+	drainDeadlineDesc = prometheus.NewDesc(
+		"aws_instance_drain_deadline_seconds",
+		"Time left until the termination time minus --drain-safety-margin while the termination notice hooks run",
+		nil, nil,
+	)
+	drainHookElapsedDesc = prometheus.NewDesc(
+		"aws_instance_drain_hook_elapsed_seconds",
+		"Time each hook run for the last termination notice took so far",
+		[]string{"hook"}, nil,
+	)
+)
+
+// noticeHooks are the hooks run on a termination notice.
+var noticeHooks hookPipeline
+
+// start records that the hooks for event are starting.
+func (p *hookPipeline) start(event collector.InterruptionEvent) {
+	p.wg.Add(1)
+	p.pending.Add(1)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.deadline = time.Time{}
+	if !event.Time.IsZero() {
+		p.deadline = event.Time.Add(-*drainSafetyMargin)
+	}
+	p.hooks = nil
+}
+
+// startHook records that the hook with the given name started, returning
+// the index to pass to finishHook.
+func (p *hookPipeline) startHook(name string) int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.hooks = append(p.hooks, hookRun{name: name, started: time.Now()})
+	return len(p.hooks) - 1
+}
+
+func (p *hookPipeline) finishHook(i int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.hooks[i].finished = time.Now()
+}
+
+func (p *hookPipeline) done() {
+	p.pending.Add(-1)
+	p.wg.Done()
+}
+
+// running reports whether hooks are in progress.
+func (p *hookPipeline) running() bool {
+	return p.pending.Load() > 0
+}
+
+func (p *hookPipeline) Describe(ch chan<- *prometheus.Desc) {
+	ch <- drainDeadlineDesc
+	ch <- drainHookElapsedDesc
+}
+
+func (p *hookPipeline) Collect(ch chan<- prometheus.Metric) {
+	running := p.running()
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if running && !p.deadline.IsZero() {
+		ch <- prometheus.MustNewConstMetric(drainDeadlineDesc, prometheus.GaugeValue, time.Until(p.deadline).Seconds())
+	}
+	for _, hook := range p.hooks {
+		end := hook.finished
+		if end.IsZero() {
+			end = time.Now()
+		}
+		ch <- prometheus.MustNewConstMetric(drainHookElapsedDesc, prometheus.GaugeValue, end.Sub(hook.started).Seconds(), hook.name)
+	}
+}
+
+// wait waits until no hooks are in progress, or at most deadline.
+func (p *hookPipeline) wait(deadline time.Duration) {
+	if !p.running() {
+		return
+	}
+	log.Infof("Waiting up to %s for the termination notice hooks to complete", deadline)
+	done := make(chan struct{})
+	go func() {
+		p.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		log.Info("Termination notice hooks completed")
+	case <-time.After(deadline):
+		log.Warnf("Termination notice hooks still running after %s, exiting anyway", deadline)
+	}
+}
+
+// notifyOnNotice makes tracker run the hooks of notifiers in order when a
+// termination notice is first observed, recording the outcome in the event
+// history. With --dry-run the hooks only tell what they would do.
+func notifyOnNotice(tracker *collector.InterruptionTracker, notifiers []notify.Notifier) {
+	notifications := prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "spot_exporter_notice_hooks_total",
+		Help: "Times a hook was run on a termination notice, by hook and result",
+	}, []string{"hook", "result"})
+	for _, notifier := range notifiers {
+		notifications.WithLabelValues(hookName(notifier), "success")
+		notifications.WithLabelValues(hookName(notifier), "error")
+		if *dryRun {
+			notifications.WithLabelValues(hookName(notifier), "dry_run")
+		}
+	}
+	prometheus.MustRegister(notifications)
+	prometheus.MustRegister(&noticeHooks)
+
+	tracker.SetNoticeHandler(func(event collector.InterruptionEvent) {
+		noticeHooks.start(event)
+		defer noticeHooks.done()
+		logger := log.WithField("event_id", event.ID)
+		for _, notifier := range notifiers {
+			hook := noticeHooks.startHook(hookName(notifier))
+			action, err := runHook(notifier)
+			result := "success"
+			switch {
+			case errors.Is(err, notify.ErrAlreadyNotified):
+				// a repeated notice is no fresh action of the hook
+				logger.Debugf("Not running the %s hook again: %s", hookName(notifier), err)
+				noticeHooks.finishHook(hook)
+				continue
+			case err != nil:
+				logger.WithError(err).Errorf("Failed to run the %s hook on the termination notice", hookName(notifier))
+				result = "error"
+				action = fmt.Sprintf("%s hook failed: %s", hookName(notifier), err)
+			case *dryRun:
+				logger.Infof("Termination notice observed, dry run: %s", action)
+				result = "dry_run"
+				action = "dry run: " + action
+			default:
+				logger.Infof("Termination notice observed, %s", action)
+			}
+			notifications.WithLabelValues(hookName(notifier), result).Inc()
+			if eventLog != nil {
+				eventLog.AddAction(event.ID, action)
+			}
+			if finisher, ok := notifier.(notify.Finisher); ok && result == "success" {
+				<-finisher.Done()
+				logger.Info("Signalled process exited")
+			}
+			noticeHooks.finishHook(hook)
+		}
+	})
+}
+
+// newNotifications loads --notification-config, returning the router of
+// the sinks it configures and the handler sending interruption events to
+// them. With a positive batchWindow the events a sink gets within the window
+// are sent together as a summary.
+func newNotifications(ctx context.Context, batchWindow time.Duration) (*notify.Router, func(event collector.InterruptionEvent)) {
+	cfg, err := notify.LoadSinksConfig(*notificationConfig)
+	if err != nil {
+		log.Fatal(err)
+	}
+	router := notify.NewRouter(cfg, *notificationTimeout)
+	for _, sink := range router.Sinks() {
+		sink.SetTracing(*traceNotifications)
+	}
+	queue := notify.NewRetryQueue()
+	if *notificationQueueFile != "" {
+		queue, err = notify.OpenRetryQueue(*notificationQueueFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	return router, sendNotifications(ctx, router, notify.NewCooldown(time.Duration(cfg.Cooldown)), queue, batchWindow)
+}
+
+// sendNotifications returns a handler sending interruption events to the
+// sinks router picks, unless cooldown holds them back or a sink got the same
+// kind of event already, batching them within batchWindow if it is positive.
+// Failed notifications are queued to be sent again until
+// --notification-retry-deadline.
+func sendNotifications(ctx context.Context, router *notify.Router, cooldown *notify.Cooldown, queue *notify.RetryQueue, batchWindow time.Duration) func(event collector.InterruptionEvent) {
+	notifications := prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "spot_exporter_notifications_total",
+		Help: "Notifications of interruption events sent to a sink, by sink and result",
+	}, []string{"sink", "result"})
+	for _, sink := range router.Sinks() {
+		notifications.WithLabelValues(sink.Name(), "success")
+		notifications.WithLabelValues(sink.Name(), "error")
+		notifications.WithLabelValues(sink.Name(), "suppressed")
+		notifications.WithLabelValues(sink.Name(), "expired")
+	}
+	prometheus.MustRegister(notifications)
+	prometheus.MustRegister(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "spot_exporter_notification_queue_depth",
+		Help: "Notifications waiting to be sent again after failing",
+	}, func() float64 {
+		return float64(queue.Len())
+	}))
+
+	// send sends the event or batch of retry to sink, queueing it again if
+	// it fails
+	send := func(sink *notify.Sink, retry notify.Retry) {
+		event := retry.Event
+		logger := log.WithField("event_id", event.ID)
+		if *traceNotifications {
+			logger = logger.WithField("trace_id", notify.TraceID(event.ID))
+		}
+		what := fmt.Sprintf("the %s event", event.Type)
+		ctx, cancel := context.WithTimeout(ctx, *notificationTimeout)
+		var err error
+		if len(retry.Batch) > 0 {
+			what = fmt.Sprintf("the batch of %d events", len(retry.Batch))
+			err = sink.SendBatch(ctx, notify.NewBatch(retry.Batch))
+		} else {
+			err = sink.Send(ctx, event, router.NodeLabels())
+		}
+		cancel()
+		if err == nil {
+			logger.Infof("Sent %s to %s", what, sink.Name())
+			notifications.WithLabelValues(sink.Name(), "success").Inc()
+			return
+		}
+		notifications.WithLabelValues(sink.Name(), "error").Inc()
+		retry.Attempts++
+		retry.Next = time.Now().Add(collector.Jitter(notify.RetryBackoff(retry.Attempts), *pollJitter))
+		if retry.Next.After(retry.Deadline) {
+			logger.WithError(err).Errorf("Failed to send %s to %s, giving up after %d attempts", what, sink.Name(), retry.Attempts)
+			notifications.WithLabelValues(sink.Name(), "expired").Inc()
+			sink.Release(event)
+			for _, event := range retry.Batch {
+				sink.Release(event)
+			}
+			return
+		}
+		logger.WithError(err).Errorf("Failed to send %s to %s, retrying in %s", what, sink.Name(), time.Until(retry.Next).Round(time.Second))
+		queue.Add(retry)
+	}
+
+	var batcher *notify.Batcher
+	if batchWindow > 0 {
+		batcher = notify.NewBatcher(batchWindow, func(sink *notify.Sink, events []collector.InterruptionEvent) {
+			retry := notify.Retry{Sink: sink.Name(), Event: events[0], Deadline: events[0].Observed.Add(*notificationRetryDeadline)}
+			if len(events) > 1 {
+				retry.Batch = events
+			}
+			send(sink, retry)
+		})
+	}
+
+	go func() {
+		ticker := time.NewTicker(time.Second)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case now := <-ticker.C:
+				for _, retry := range queue.Due(now) {
+					sink := router.Sink(retry.Sink)
+					if sink == nil {
+						log.WithField("event_id", retry.Event.ID).Warnf("Dropping the queued %s event of the removed sink %s", retry.Event.Type, retry.Sink)
+						continue
+					}
+					send(sink, retry)
+				}
+			}
+		}
+	}()
+
+	return func(event collector.InterruptionEvent) {
+		notificationsSending.Add(1)
+		defer notificationsSending.Done()
+		sinks := router.Route(event)
+		if len(sinks) == 0 {
+			log.WithField("event_id", event.ID).Debugf("No route matches the %s event", event.Type)
+			return
+		}
+		if !cooldown.Allow(event) {
+			log.WithField("event_id", event.ID).Infof("Not sending the %s event during the notification cooldown", event.Type)
+			for _, sink := range sinks {
+				notifications.WithLabelValues(sink.Name(), "suppressed").Inc()
+			}
+			return
+		}
+		for _, sink := range sinks {
+			// claiming the event before batching it keeps a batch from
+			// holding duplicates
+			if !sink.Claim(event) {
+				log.WithField("event_id", event.ID).Infof("Not sending the %s event to %s, which got one for the instance recently", event.Type, sink.Name())
+				notifications.WithLabelValues(sink.Name(), "suppressed").Inc()
+				continue
+			}
+			if batcher != nil {
+				batcher.Add(sink, event)
+				continue
+			}
+			send(sink, notify.Retry{Sink: sink.Name(), Event: event, Deadline: event.Observed.Add(*notificationRetryDeadline)})
+		}
+	}
+}
+
+// runHook runs the hook of notifier, or tells what it would do with
+// --dry-run.
+func runHook(notifier notify.Notifier) (string, error) {
+	if !*dryRun {
+		return notifier.Notify()
+	}
+	if dryRunner, ok := notifier.(notify.DryRunner); ok {
+		return dryRunner.DryRun()
+	}
+	return fmt.Sprintf("would run the %s hook", hookName(notifier)), nil
+}
+
+// hookName returns the name notifier is exported under as hook.
+func hookName(notifier notify.Notifier) string {
+	switch notifier.(type) {
+	case *notify.Child:
+		return "exec"
+	case *notify.Route53Records:
+		return "route53"
+	case *kube.Drainer:
+		return "drain"
+	case *notify.Acknowledgement:
+		return "acknowledge"
+	default:
+		return "notify"
+	}
+}
+
+// nodeLabelSetter is implemented by the collectors attaching node labels to
+// their metrics.
+type nodeLabelSetter interface {
+	prometheus.Collector
+	SetNodeLabels(nodeLabels prometheus.Labels)
+}
+
+// spotOnlyCollector wraps a collector exporting nothing but spot specific
+// metrics, so it can be skipped on nodes which aren't spot.
+type spotOnlyCollector struct {
+	nodeLabelSetter
+	skipped atomic.Bool
+}
+
+func (c *spotOnlyCollector) Collect(ch chan<- prometheus.Metric) {
+	if !c.skipped.Load() {
+		c.nodeLabelSetter.Collect(ch)
+	}
+}
+
+func registerNodeCollectors(ctx context.Context) {
+	log.Debug("registering term exporter")
+	if *pollJitter < 0 || *pollJitter >= 1 {
+		log.Fatalf("--poll-jitter must be at least 0 and below 1, got %g", *pollJitter)
+	}
+
+	cfg := provider.Config{
+		TokenEndpoint:  mustParseEndpoint("token-endpoint", *tokenEndpoint, false),
+		UseIMDSv2:      *imdsv2Mode != "off",
+		IMDSv1Fallback: *imdsv2Mode == "preferred",
+		TokenTTL:       *imdsv2TokenTTL,
+		RequestTimeout: *imdsTimeout,
+		TokenTimeout:   *imdsTokenTimeout,
+		Transport:      metadataTransport,
+		CacheTTLs: provider.CacheTTLs{
+			Identity:    *identityCacheTTL,
+			Notice:      *noticeCacheTTL,
+			Maintenance: *maintenanceCacheTTL,
+		},
+	}
+	for i, endpoint := range splitList(*metadataEndpoint) {
+		endpoint = mustParseEndpoint("metadata-endpoint", endpoint, true)
+		if i == 0 {
+			cfg.MetadataEndpoint = endpoint
+			continue
+		}
+		// the token endpoint sits next to the meta-data tree, as for /probe
+		tokenURL, _ := url.Parse(endpoint)
+		cfg.FallbackEndpoints = append(cfg.FallbackEndpoints, provider.Endpoint{
+			MetadataEndpoint: endpoint,
+			TokenEndpoint:    tokenURL.ResolveReference(&url.URL{Path: "../api/token"}).String(),
+		})
+	}
+	if *providerName == "auto" {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		detected, err := provider.Detect(ctx, cfg)
+		cancel()
+		switch {
+		case err != nil && *requireIMDS:
+			log.Fatalf("Failed to detect provider, set --provider explicitly: %s", err)
+		case err != nil:
+			// the metadata service may only be briefly unreachable, keep
+			// running and export it as unavailable meanwhile
+			log.Warnf("Failed to detect provider, falling back to aws: %s", err)
+			detected = "aws"
+		default:
+			log.Infof("Detected %s metadata service", detected)
+		}
+		// the probe handler creates providers of the same kind
+		*providerName = detected
+	}
+	metadataProvider, err := provider.New(*providerName, cfg)
+	if err != nil {
+		log.Fatal(err)
+	}
+	imds.RegisterMetrics(prometheus.DefaultRegisterer)
+	discovery = &serviceDiscovery{provider: metadataProvider}
+	if *adminTokenFile != "" {
+		token, err := os.ReadFile(*adminTokenFile)
+		if err != nil {
+			log.Fatalf("couldn't read --admin-token-file: %s", err)
+		}
+		if len(bytes.TrimSpace(token)) == 0 {
+			log.Fatal("--admin-token-file is empty")
+		}
+		refresh = &refreshHandler{provider: metadataProvider, token: bytes.TrimSpace(token)}
+	}
+	if *requireIMDS {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		identity, err := metadataProvider.GetInstanceIdentity(ctx)
+		cancel()
+		if err != nil {
+			log.Fatalf("Metadata service unreachable and --require-imds is set: %s", err)
+		}
+		log.Infof("Metadata service reachable, running on instance %s", identity.InstanceID)
+	}
+
+	// node labels and annotations must not be attached under the names of
+	// the labels of the metrics, the custom metrics add theirs below
+	reservedLabels := maps.Clone(collector.ReservedLabelNames)
+	var labelFilter, annotationFilter *kube.LabelFilter
+	if *attachNodeLabels {
+		rename, err := parseKeyValues(*nodeLabelRename, "node label rename")
+		if err != nil {
+			log.Fatal(err)
+		}
+		for key, name := range rename {
+			if name := kube.SanitizeLabelName(name); reservedLabels[name] || strings.HasPrefix(name, "__") {
+				log.Fatalf("invalid node label rename %s=%s: %s is a reserved label name", key, name, name)
+			}
+		}
+		labelFilter = &kube.LabelFilter{
+			Allow:         mustCompileAnchored(*nodeLabelAllowlist),
+			Deny:          mustCompileAnchored(*nodeLabelDenylist),
+			Rename:        rename,
+			StripPrefixes: splitList(*nodeLabelStripPrefixes),
+			Reserved:      reservedLabels,
+		}
+	}
+	if *attachNodeAnnotations != "" {
+		annotationFilter = &kube.LabelFilter{Allow: mustCompileAnchored(*attachNodeAnnotations), Reserved: reservedLabels}
+	}
+
+	termination := collector.NewTerminationCollector(metadataProvider, nil)
+	termination.SetCircuitBreaker(*imdsBreakerThreshold, *imdsBreakerCooldown)
+	tracker, err := collector.NewInterruptionTracker(*stateFile)
+	if err != nil {
+		log.Fatal(err)
+	}
+	termination.SetTracker(tracker)
+	prometheus.MustRegister(tracker)
+	if *eventHistorySize > 0 {
+		if *eventHistoryFile != "" {
+			eventLog, err = collector.OpenEventLog(*eventHistoryFile, *eventHistorySize, *eventHistoryRetention)
+			if err != nil {
+				log.Fatal(err)
+			}
+		} else {
+			eventLog = collector.NewEventLog(*eventHistorySize, *eventHistoryRetention)
+		}
+		tracker.SetEventLog(eventLog)
+	}
+	var router *notify.Router
+	if *notificationConfig != "" {
+		var handler func(event collector.InterruptionEvent)
+		router, handler = newNotifications(ctx, 0)
+		tracker.SetEventHandler(handler)
+	}
+	var notifiers []notify.Notifier
+	if *notifyPID != 0 || *notifyPIDFile != "" {
+		if *notifyPID != 0 && *notifyPIDFile != "" {
+			log.Fatal("--notify-pid and --notify-pidfile are mutually exclusive")
+		}
+		sig, err := notify.ParseSignal(*notifySignal)
+		if err != nil {
+			log.Fatalf("invalid --notify-signal: %s", err)
+		}
+		notifiers = append(notifiers, &notify.Process{PID: *notifyPID, PIDFile: *notifyPIDFile, Signal: sig})
+	}
+	if *route53Records != "" {
+		if *route53ZoneID == "" {
+			log.Fatal("--route53-records requires --route53-zone-id")
+		}
+		records, err := notify.NewRoute53Records(ctx, metadataProvider, *route53ZoneID, splitList(*route53Records), *route53Action)
+		if err != nil {
+			log.Fatal(err)
+		}
+		notifiers = append(notifiers, records)
+	}
+	if *drainNode {
+		order, err := kube.ParseEvictionOrder(*drainEvictionOrder)
+		if err != nil {
+			log.Fatalf("invalid --drain-eviction-order: %s", err)
+		}
+		drainer := kube.NewDrainer(kubeConfig(), func() (string, error) {
+			return resolveNodeName(metadataProvider)
+		}, order)
+		drainer.SetIgnorePDBAfter(*drainIgnorePDBAfter)
+		drainer.SetTimeout(*drainTimeout)
+		drainer.SetGracePeriod(*drainGracePeriod)
+		drainer.SetForce(*drainForce)
+		drainer.SetIgnore(*drainIgnoreDaemonSets, *drainIgnoreMirrorPods)
+		notifiers = append(notifiers, drainer)
+	}
+	if *execChild {
+		if flag.NArg() == 0 {
+			log.Fatal("--exec requires a command after --")
+		}
+		sig, err := notify.ParseSignal(*execSignal)
+		if err != nil {
+			log.Fatalf("invalid --exec-signal: %s", err)
+		}
+		child, err = notify.StartChild(flag.Args(), sig, *execGracePeriod)
+		if err != nil {
+			log.Fatalf("couldn't start the child process: %s", err)
+		}
+		log.Infof("Started child process %s", flag.Arg(0))
+		notifiers = append(notifiers, child)
+	}
+	if *acknowledgeNotices {
+		acknowledgement, err := notify.NewAcknowledgement(metadataProvider)
+		if err != nil {
+			log.Fatalf("--acknowledge-notices isn't supported by the %s provider", *providerName)
+		}
+		notifiers = append(notifiers, acknowledgement)
+	}
+	if len(notifiers) > 0 {
+		notifyOnNotice(tracker, notifiers)
+	}
+	if len(notifiers) > 0 || *notificationConfig != "" {
+		termination.SetWatchChanges(*waitForChange)
+		termination.SetRebalanceInterval(*noticePollIntervalAfterRebalance, *rebalancePollWindow)
+		termination.SetPollJitter(*pollJitter)
+		if *noticePollInterval > 0 {
+			go func() {
+				if waitStartupJitter(ctx) {
+					termination.WatchNotices(ctx, *noticePollInterval)
+				}
+			}()
+		}
+	}
+	health = &healthHandler{provider: metadataProvider, termination: termination, started: time.Now(), unhealthyAfter: *healthUnhealthyAfter}
+	termination.SetWatchdog(*maxConsecutiveFailures, func(failures int, lastSuccess time.Time, lastErr error) {
+		since := "since the exporter started"
+		if !lastSuccess.IsZero() {
+			since = fmt.Sprintf("since %s (%s ago)", lastSuccess.Format(time.RFC3339), time.Since(lastSuccess).Round(time.Second))
+		}
+		tracker.RecordWatchdogRestart()
+		log.Fatalf("Metadata service failed %d scrapes in a row, no successful scrape %s, last error: %s. Exiting to be restarted", failures, since, lastErr)
+	})
+	if *resolveNodegroup {
+		go func() {
+			if waitStartupJitter(ctx) {
+				loadNodegroup(ctx, metadataProvider, termination)
+			}
+		}()
+	}
+	collectors := []nodeLabelSetter{termination}
+	if eventLog != nil {
+		collectors = append(collectors, collector.NewEventInfoCollector(eventLog, nil))
+	}
+	var spotOnly []*spotOnlyCollector
+	addSpotOnly := func(c nodeLabelSetter) {
+		wrapped := &spotOnlyCollector{nodeLabelSetter: c}
+		spotOnly = append(spotOnly, wrapped)
+		collectors = append(collectors, wrapped)
+	}
+	if *exportSavings {
+		log.Debug("registering savings exporter")
+		savings, err := collector.NewSavingsCollector(metadataProvider, *pricingRegion, *onDemandPriceCacheTTL, *spotPriceCacheTTL, nil)
+		if err != nil {
+			log.Fatalf("couldn't load the AWS configuration for --export-savings: %s", err)
+		}
+		addSpotOnly(savings)
+	}
+	if *exportMaintenanceHistory {
+		history, ok := metadataProvider.(provider.MaintenanceHistoryProvider)
+		if !ok {
+			log.Fatalf("the %s provider doesn't support --export-maintenance-history", *providerName)
+		}
+		log.Debug("registering maintenance history exporter")
+		collectors = append(collectors, collector.NewMaintenanceHistoryCollector(metadataProvider, history, nil))
+	}
+	if *exportInstanceInfo {
+		log.Debug("registering instance info exporter")
+		collectors = append(collectors, collector.NewInstanceInfoCollector(metadataProvider, *instanceInfoCacheTTL, nil))
+	}
+	if *exportNetworkInfo {
+		interfaces, ok := metadataProvider.(provider.NetworkInterfacesProvider)
+		if !ok {
+			log.Fatalf("the %s provider doesn't support --export-network-info", *providerName)
+		}
+		log.Debug("registering network info exporter")
+		collectors = append(collectors, collector.NewNetworkInfoCollector(metadataProvider, interfaces, *networkInfoCacheTTL, nil))
+	}
+	if *customMetricsConfig != "" {
+		getter, ok := metadataProvider.(provider.MetadataGetter)
+		if !ok {
+			log.Fatalf("the %s provider doesn't support --custom-metrics-config", *providerName)
+		}
+		cfg, err := collector.LoadCustomMetricsConfig(*customMetricsConfig)
+		if err != nil {
+			log.Fatalf("couldn't load custom metrics: %s", err)
+		}
+		for _, m := range cfg.Metrics {
+			for _, label := range m.Labels {
+				reservedLabels[label] = true
+			}
+		}
+		log.Debug("registering custom metrics exporter")
+		collectors = append(collectors, collector.NewCustomMetricsCollector(metadataProvider, getter, cfg, nil))
+	}
+	var taints *collector.TaintCollector
+	if *exportNodeTaints {
+		log.Debug("registering taint exporter")
+		taints = collector.NewTaintCollector(nil, nil)
+		collectors = append(collectors, taints)
+	}
+	var affectedPods *collector.AffectedPodsCollector
+	if *exportAffectedPods {
+		log.Debug("registering affected pods exporter")
+		affectedPods = collector.NewAffectedPodsCollector(metadataProvider, func(ctx context.Context, nodeName string) ([]corev1.Pod, error) {
+			return kube.ListNodePods(ctx, kubeConfig(), nodeName)
+		}, *affectedPodsByOwnerKind, nil)
+		addSpotOnly(affectedPods)
+	}
+	var pdbBlocked *collector.PDBCollector
+	if *exportPDBBlocked {
+		log.Debug("registering PodDisruptionBudget exporter")
+		pdbBlocked = collector.NewPDBCollector(metadataProvider, func(ctx context.Context, nodeName string) ([]corev1.Pod, error) {
+			return kube.ListNodePods(ctx, kubeConfig(), nodeName)
+		}, func(ctx context.Context) ([]policyv1.PodDisruptionBudget, error) {
+			return kube.ListPodDisruptionBudgets(ctx, kubeConfig())
+		}, nil)
+		addSpotOnly(pdbBlocked)
+	}
+	for _, c := range collectors {
+		prometheus.MustRegister(collector.SingleFlight(c))
+	}
+	if labelFilter == nil && annotationFilter == nil && !*exportNodeTaints && affectedPods == nil && pdbBlocked == nil {
+		return
+	}
+
+	// the node is read in the background, so the exporter keeps serving
+	// metrics without node labels while the API server is unavailable
+	nodeLabelsAvailable := prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "spot_exporter_node_labels_available",
+		Help: "Whether the Kubernetes node has been read and its labels attached",
+	})
+	prometheus.MustRegister(nodeLabelsAvailable)
+	health.labelsPending.Store(true)
+	spotMetricsSkipped := prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "spot_exporter_spot_metrics_skipped",
+		Help: "Whether spot specific metrics are skipped as the capacity type of the node isn't spot",
+	})
+	prometheus.MustRegister(spotMetricsSkipped)
+	// nodes without a capacity type label keep all metrics, as they may well
+	// be spot
+	skipping := false
+	setCapacityType := func(node *corev1.Node) {
+		capacityType := kube.CapacityType(node)
+		skip := *skipOnDemandNodes && capacityType != "" && capacityType != kube.CapacityTypeSpot
+		if skip != skipping {
+			if skip {
+				log.Infof("Node has capacity type %s, skipping spot specific metrics", capacityType)
+			} else {
+				log.Infof("Node has capacity type %s, exporting spot specific metrics", capacityType)
+			}
+		}
+		skipping = skip
+		termination.SetOnDemand(skip)
+		for _, c := range spotOnly {
+			c.skipped.Store(skip)
+		}
+		if skip {
+			spotMetricsSkipped.Set(1)
+		} else {
+			spotMetricsSkipped.Set(0)
+		}
+	}
+	kube.RegisterClientMetrics(prometheus.DefaultRegisterer)
+	go func() {
+		if !waitStartupJitter(ctx) {
+			return
+		}
+		nodeName, node := loadNode(ctx, metadataProvider)
+		if node == nil {
+			return
+		}
+		setCapacityType(node)
+		if taints != nil {
+			taints.SetNode(node)
+		}
+		if affectedPods != nil {
+			affectedPods.SetNodeName(nodeName)
+		}
+		if pdbBlocked != nil {
+			pdbBlocked.SetNodeName(nodeName)
+		}
+		nodeLabels := kube.MetricLabels(node, labelFilter, annotationFilter)
+		for _, c := range collectors {
+			c.SetNodeLabels(nodeLabels)
+		}
+		discovery.SetNodeLabels(nodeLabels)
+		if router != nil {
+			router.SetNodeLabels(nodeLabels)
+		}
+		nodeLabelsAvailable.Set(1)
+		health.labelsPending.Store(false)
+		log.Infof("Attached labels of node %s", nodeName)
+
+		if !*watchNodeLabels {
+			return
+		}
+		err := kube.WatchNode(ctx, kubeConfig(), nodeName, func(node *corev1.Node) {
+			setCapacityType(node)
+			if taints != nil {
+				taints.SetNode(node)
+			}
+			labels := kube.MetricLabels(node, labelFilter, annotationFilter)
+			if maps.Equal(nodeLabels, labels) {
+				return
+			}
+			log.Info("Node labels changed, updating metric labels")
+			nodeLabels = labels
+			for _, c := range collectors {
+				c.SetNodeLabels(nodeLabels)
+			}
+			discovery.SetNodeLabels(nodeLabels)
+			if router != nil {
+				router.SetNodeLabels(nodeLabels)
+			}
+		})
+		if err != nil {
+			log.WithError(err).Error("Failed to watch node labels")
+		}
+	}()
+}
+
+// loadNode resolves and reads the node the exporter runs on, retrying with
+// exponential backoff up to a minute between attempts. It returns a nil node
+// once ctx is cancelled.
+func loadNode(ctx context.Context, metadataProvider provider.Provider) (string, *corev1.Node) {
+	backoff := time.Second
+	forbidden := false
+	for {
+		nodeName, err := resolveNodeName(metadataProvider)
+		if err == nil {
+			var node *corev1.Node
+			node, err = kube.GetNode(kubeConfig(), nodeName)
+			if err == nil {
+				return nodeName, node
+			}
+		}
+		// a missing permission is only fixed by an admin, so explain it once
+		// and keep retrying quietly in case RBAC is fixed later
+		switch {
+		case apierrors.IsForbidden(err) && !forbidden:
+			forbidden = true
+			log.WithError(err).Warn("Not allowed to read the node, exporting metrics without node labels. " +
+				"Grant the exporter's ServiceAccount get on nodes (and list with --node-from-provider-id) to attach them")
+		case apierrors.IsForbidden(err):
+			log.WithError(err).Debugf("Still not allowed to read the node, retrying in %s", backoff)
+		default:
+			log.WithError(err).Warnf("Failed to get node, retrying in %s", backoff)
+		}
+		// the exporter is started without labels rather than waiting for them
+		health.labelsDeferred.Store(true)
+		select {
+		case <-ctx.Done():
+			return "", nil
+		case <-time.After(collector.Jitter(backoff, *pollJitter)):
+		}
+		backoff = min(2*backoff, time.Minute)
+	}
+}
+
+// startupDelay is the random delay of the background polling, drawn once so
+// all of it starts at the same offset.
+var startupDelay = sync.OnceValue(func() time.Duration {
+	if *startupJitter <= 0 {
+		return 0
+	}
+	delay := rand.N(*startupJitter)
+	log.Infof("Delaying background polling by %s", delay.Round(time.Millisecond))
+	return delay
+})
+
+// waitStartupJitter waits for the random delay of --startup-jitter, and
+// returns false if ctx was cancelled in the meantime.
+func waitStartupJitter(ctx context.Context) bool {
+	delay := startupDelay()
+	if delay == 0 {
+		return true
+	}
+	select {
+	case <-ctx.Done():
+		return false
+	case <-time.After(delay):
+		return true
+	}
+}
+
+// loadNodegroup resolves the EKS managed node group of the instance and
+// attaches it to the termination metrics, retrying with exponential backoff up
+// to a minute between attempts until it succeeds or ctx is cancelled.
+func loadNodegroup(ctx context.Context, metadataProvider provider.Provider, termination *collector.TerminationCollector) {
+	backoff := time.Second
+	for {
+		resolveCtx, cancel := context.WithTimeout(ctx, 10*time.Second)
+		nodegroup, err := collector.ResolveNodegroup(resolveCtx, metadataProvider)
+		cancel()
+		if err == nil {
+			if nodegroup == "" {
+				log.Warnf("Instance has no %s tag, not attaching a node group", collector.NodegroupTag)
+				return
+			}
+			termination.SetNodegroup(nodegroup)
+			log.Infof("Attached node group %s", nodegroup)
+			return
+		}
+		log.WithError(err).Warnf("Failed to resolve node group, retrying in %s", backoff)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(collector.Jitter(backoff, *pollJitter)):
+		}
+		backoff = min(2*backoff, time.Minute)
+	}
+}
+
+// resolveNodeName returns the name of the Kubernetes node the exporter runs
+// on, either from NODE_NAME, falling back to the hostnames from the metadata
+// service, or by matching the instance id against the providerID of the
+// nodes.
+func resolveNodeName(metadataProvider provider.Provider) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	if !*nodeFromProviderID {
+		nodeName, err := kube.NodeName()
+		if err == nil {
+			return nodeName, nil
+		}
+		hostnamer, ok := metadataProvider.(provider.Hostnamer)
+		if !ok {
+			return "", err
+		}
+		for _, kind := range splitList(*nodeNameFallback) {
+			hostname, hostnameErr := hostnamer.GetHostname(ctx, kind)
+			if hostnameErr != nil {
+				log.WithError(hostnameErr).Warnf("couldn't read %s from metadata", kind)
+				continue
+			}
+			log.Infof("NODE_NAME not set, using %s %s as node name", kind, hostname)
+			return hostname, nil
+		}
+		return "", err
+	}
+	identity, err := metadataProvider.GetInstanceIdentity(ctx)
+	if err != nil {
+		return "", err
+	}
+	nodeName, err := kube.FindNodeName(kubeConfig(), identity.InstanceID)
+	if err != nil {
+		return "", err
+	}
+	log.Infof("Found node %s for instance %s", nodeName, identity.InstanceID)
+	return nodeName, nil
+}
+
+// metadataTransport is the transport shared by all requests to the metadata
+// service, including those of the probe handler.
+var metadataTransport http.RoundTripper
+
+// newMetadataTransport returns the transport for requests to the metadata
+// service configured by the TLS and proxy flags.
+func newMetadataTransport() (*http.Transport, error) {
+	var tlsConfig *tls.Config
+	if *metadataCACert != "" || *metadataInsecureSkipVerify {
+		tlsConfig = &tls.Config{InsecureSkipVerify: *metadataInsecureSkipVerify}
+	}
+	if *metadataCACert != "" {
+		pem, err := os.ReadFile(*metadataCACert)
+		if err != nil {
+			return nil, fmt.Errorf("read metadata CA certificates: %w", err)
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", *metadataCACert)
+		}
+	}
+	return imds.NewTransport(tlsConfig, *imdsNoProxy), nil
+}
+
+// mustParseEndpoint checks that an endpoint flag is empty or an http or https
+// URL, adding the trailing slash paths are appended to when dir is set.
+func mustParseEndpoint(name, value string, dir bool) string {
+	if value == "" {
+		return ""
+	}
+	endpoint, err := url.Parse(value)
+	if err != nil || (endpoint.Scheme != "http" && endpoint.Scheme != "https") || endpoint.Host == "" {
+		log.Fatalf("invalid --%s %q, must be an http or https URL", name, value)
+	}
+	if dir && !strings.HasSuffix(endpoint.Path, "/") {
+		endpoint.Path += "/"
+	}
+	return endpoint.String()
+}
+
+// kubeConfig returns the Kubernetes client configuration set by the flags.
+func kubeConfig() kube.Config {
+	return kube.Config{
+		Kubeconfig: *kubeconfig,
+		Context:    *kubeContext,
+		Timeout:    *kubeAPITimeout,
+		QPS:        float32(*kubeAPIQPS),
+		Burst:      *kubeAPIBurst,
+	}
+}
+
+// mustCompileAnchored compiles a regex flag value, anchoring it to match the
+// whole string like Prometheus relabeling does. An empty value returns nil.
+func mustCompileAnchored(expr string) *regexp.Regexp {
+	if expr == "" {
+		return nil
+	}
+	re, err := regexp.Compile("^(?:" + expr + ")$")
+	if err != nil {
+		log.Fatalf("invalid regular expression %q: %s", expr, err)
+	}
+	return re
+}
+
+// splitList splits a comma-separated flag value, dropping empty entries.
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
 }
 
 func serveMetrics() {
 	log.Infof("Starting metric http endpoint on %s", *bindAddr)
-	http.Handle(*metricsPath, promhttp.Handler())
-	http.HandleFunc("/", rootHandler)
-	log.Fatal(http.ListenAndServe(*bindAddr, nil))
+	protect := func(h http.Handler) http.Handler { return h }
+	if *kubeAuth {
+		protect = kube.NewRequestAuthorizer(kubeConfig(), *kubeAuthCacheTTL).Wrap
+	}
+	var gatherer prometheus.Gatherer = prometheus.DefaultGatherer
+	if *relabelConfig != "" {
+		cfg, err := relabel.LoadConfig(*relabelConfig)
+		if err != nil {
+			log.Fatalf("couldn't load relabel config: %s", err)
+		}
+		gatherer = relabel.NewGatherer(gatherer, cfg.MetricRelabelConfigs)
+	}
+	if *metricAliases != "" {
+		aliases, err := parseKeyValues(*metricAliases, "metric alias")
+		if err != nil {
+			log.Fatal(err)
+		}
+		if err := relabel.ValidateAliases(aliases); err != nil {
+			log.Fatalf("invalid --metric-aliases: %s", err)
+		}
+		gatherer = relabel.NewAliasGatherer(gatherer, aliases)
+	}
+	externalPath, err := resolveRoutePrefix()
+	if err != nil {
+		log.Fatal(err)
+	}
+	mux := http.NewServeMux()
+	handle := func(path string, h http.Handler) {
+		mux.Handle(routePrefix+path, h)
+	}
+	// a separate admin listener serves health and debug endpoints at the
+	// root, as it isn't meant to be reached through a proxy
+	handleAdmin := handle
+	var adminMux *http.ServeMux
+	if *adminAddr != "" {
+		adminMux = http.NewServeMux()
+		handleAdmin = func(path string, h http.Handler) {
+			adminMux.Handle(path, h)
+		}
+	}
+	// limiting clients protects the metadata service from local consumers
+	// polling in a tight loop
+	limit := func(h http.Handler) http.Handler { return h }
+	if *rateLimit > 0 {
+		limit = newRateLimiter(rate.Limit(*rateLimit), *rateLimitBurst).Wrap
+	}
+	// the JSON endpoints may be read by dashboards from the browser
+	origins := splitList(*corsAllowedOrigins)
+	handleJSON := func(path string, h http.Handler) {
+		handle(path, allowCORS(origins, limit(h)))
+	}
+	handle(*metricsPath, protect(promhttp.InstrumentMetricHandler(prometheus.DefaultRegisterer, promhttp.HandlerFor(gatherer, promhttp.HandlerOpts{}))))
+	if *probeTargetAllowlist != "" {
+		probeTargets = mustCompileAnchored(*probeTargetAllowlist)
+		handle("/probe", protect(http.HandlerFunc(probeHandler)))
+	}
+	if discovery != nil {
+		handleJSON("/sd", protect(discovery))
+	}
+	if eventLog != nil {
+		handleJSON("/api/v1/history", protect(http.HandlerFunc(historyHandler)))
+	}
+	if refresh != nil {
+		handleAdmin("/-/refresh", limit(refresh))
+	}
+	if health != nil {
+		if adminMux != nil {
+			handleAdmin("/healthz", health)
+			handleAdmin("/startupz", http.HandlerFunc(health.serveStartup))
+		} else {
+			// kubelet probes must never be rate limited, or a healthy pod
+			// could be restarted during a burst of requests
+			handle("/healthz", allowCORS(origins, health))
+			handle("/startupz", allowCORS(origins, http.HandlerFunc(health.serveStartup)))
+		}
+	}
+	if !*disableLandingPage {
+		links, err := parseLinks(*landingPageLinks)
+		if err != nil {
+			log.Fatal(err)
+		}
+		handle("/", landingPage(*landingPageTitle, externalPath, links))
+	}
+	if routePrefix != "" {
+		mux.Handle("/{$}", http.RedirectHandler(routePrefix+"/", http.StatusFound))
+	}
+	if adminMux != nil {
+		adminMux.HandleFunc("/debug/pprof/", pprof.Index)
+		adminMux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+		adminMux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+		adminMux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+		adminMux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+		adminMux.Handle("/debug/vars", expvar.Handler())
+		go func() {
+			log.Infof("Starting admin http endpoint on %s", *adminAddr)
+			log.Fatal(http.ListenAndServe(*adminAddr, adminMux))
+		}()
+	}
+	log.Fatal(http.ListenAndServe(*bindAddr, mux))
+}
+
+// rateLimiter limits the rate of requests per client IP with a token bucket
+// each.
+type rateLimiter struct {
+	limit rate.Limit
+	burst int
+
+	mu        sync.Mutex
+	clients   map[string]*rateLimitedClient
+	lastSweep time.Time
+}
+
+type rateLimitedClient struct {
+	limiter  *rate.Limiter
+	lastSeen time.Time
+}
+
+func newRateLimiter(limit rate.Limit, burst int) *rateLimiter {
+	return &rateLimiter{limit: limit, burst: burst, clients: map[string]*rateLimitedClient{}, lastSweep: time.Now()}
+}
+
+// Wrap returns a handler answering 429 to clients exceeding the rate, and
+// serving the other requests with next.
+func (l *rateLimiter) Wrap(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !l.allow(r) {
+			w.Header().Set("Retry-After", "1")
+			http.Error(w, "too many requests", http.StatusTooManyRequests)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (l *rateLimiter) allow(r *http.Request) bool {
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		ip = r.RemoteAddr
+	}
+	now := time.Now()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	// forget clients idle for long enough that their buckets are full again
+	refill := max(time.Minute, time.Duration(float64(l.burst)/float64(l.limit)*float64(time.Second)))
+	if now.Sub(l.lastSweep) > time.Minute {
+		for key, client := range l.clients {
+			if now.Sub(client.lastSeen) > refill {
+				delete(l.clients, key)
+			}
+		}
+		l.lastSweep = now
+	}
+	client, ok := l.clients[ip]
+	if !ok {
+		client = &rateLimitedClient{limiter: rate.NewLimiter(l.limit, l.burst)}
+		l.clients[ip] = client
+	}
+	client.lastSeen = now
+	if !client.limiter.AllowN(now, 1) {
+		log.Debugf("rate limiting %s requesting %s", ip, r.URL.Path)
+		return false
+	}
+	return true
+}
+
+// allowCORS lets pages from the given origins read the responses of next,
+// answering preflight requests itself so they don't need to be
+// authenticated. It returns next unchanged when no origins are allowed.
+func allowCORS(origins []string, next http.Handler) http.Handler {
+	if len(origins) == 0 {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		w.Header().Add("Vary", "Origin")
+		if origin != "" && (slices.Contains(origins, "*") || slices.Contains(origins, origin)) {
+			w.Header().Set("Access-Control-Allow-Origin", origin)
+			if r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != "" {
+				w.Header().Set("Access-Control-Allow-Methods", "GET")
+				w.Header().Set("Access-Control-Allow-Headers", "Authorization")
+				w.Header().Set("Access-Control-Max-Age", "600")
+				w.WriteHeader(http.StatusNoContent)
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
 }
 
-func rootHandler(w http.ResponseWriter, r *http.Request) {
-	w.WriteHeader(http.StatusOK)
-	w.Write([]byte(`<html>
-		<head><title>Spot Termination Exporter</title></head>
+// routePrefix is prepended to the paths of all endpoints, "" to serve them
+// at the root.
+var routePrefix string
+
+// resolveRoutePrefix sets routePrefix from --web.route-prefix, or the path of
+// --web.external-url, and returns the path prefix under which clients reach
+// the endpoints.
+func resolveRoutePrefix() (string, error) {
+	externalPath := ""
+	if *externalURL != "" {
+		u, err := url.Parse(*externalURL)
+		if err != nil || u.Scheme == "" || u.Host == "" {
+			return "", fmt.Errorf("invalid --web.external-url %q, expected an absolute URL", *externalURL)
+		}
+		externalPath = strings.TrimRight(u.Path, "/")
+	}
+	routePrefix = externalPath
+	if *routePrefixFlag != "" {
+		routePrefix = "/" + strings.Trim(*routePrefixFlag, "/")
+		if routePrefix == "/" {
+			routePrefix = ""
+		}
+	}
+	if *externalURL == "" {
+		externalPath = routePrefix
+	}
+	return externalPath, nil
+}
+
+// discovery serves the exporter as a service discovery target in node mode.
+var discovery *serviceDiscovery
+
+// serviceDiscovery describes the exporter in the format of Prometheus HTTP
+// service discovery, so the targets can be labelled with details of the
+// instance and node without relabeling.
+type serviceDiscovery struct {
+	provider provider.Provider
+
+	mu         sync.Mutex
+	nodeLabels prometheus.Labels
+}
+
+// SetNodeLabels sets the node labels added to the target labels.
+func (sd *serviceDiscovery) SetNodeLabels(nodeLabels prometheus.Labels) {
+	sd.mu.Lock()
+	defer sd.mu.Unlock()
+	sd.nodeLabels = nodeLabels
+}
+
+func (sd *serviceDiscovery) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), 10*time.Second)
+	defer cancel()
+
+	identity, err := sd.provider.GetInstanceIdentity(ctx)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("couldn't fetch instance identity: %s", err), http.StatusServiceUnavailable)
+		return
+	}
+
+	// the exporter is reached on the private address of the instance unless
+	// it is bound to a specific one
+	host, port, err := net.SplitHostPort(*bindAddr)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("invalid --bind-addr %q", *bindAddr), http.StatusInternalServerError)
+		return
+	}
+	if host == "" {
+		if getter, ok := sd.provider.(provider.MetadataGetter); ok {
+			if ip, found, err := getter.GetMetadata(ctx, "local-ipv4"); err == nil && found {
+				host = strings.TrimSpace(string(ip))
+			}
+		}
+	}
+	if host == "" {
+		host = r.Host
+		if h, _, err := net.SplitHostPort(r.Host); err == nil {
+			host = h
+		}
+	}
+
+	labels := map[string]string{}
+	sd.mu.Lock()
+	maps.Copy(labels, sd.nodeLabels)
+	sd.mu.Unlock()
+	labels["instance_id"] = identity.InstanceID
+	labels["instance_type"] = identity.InstanceType
+	labels["region"] = identity.Region
+	labels["availability_zone"] = identity.AvailabilityZone
+	if path := routePrefix + *metricsPath; path != "/metrics" {
+		labels["__metrics_path__"] = path
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode([]struct {
+		Targets []string          `json:"targets"`
+		Labels  map[string]string `json:"labels"`
+	}{{
+		Targets: []string{net.JoinHostPort(host, port)},
+		Labels:  labels,
+	}})
+}
+
+// eventLog keeps the interruption events observed in node mode.
+var eventLog *collector.EventLog
+
+// historyHandler serves the interruption events in the event log, oldest
+// first.
+func historyHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		Events []collector.InterruptionEvent `json:"events"`
+	}{eventLog.Events()})
+}
+
+// refresh serves the admin endpoint forcing an immediate poll in node mode
+// when --admin-token-file is set.
+var refresh *refreshHandler
+
+// refreshHandler drops the cached metadata and polls the metadata service
+// right away, returning what it read. Requests must present the admin token
+// as a bearer token.
+type refreshHandler struct {
+	provider provider.Provider
+	token    []byte
+}
+
+// refreshState is the metadata read by a refresh.
+type refreshState struct {
+	InstanceID        string                      `json:"instance_id"`
+	InstanceType      string                      `json:"instance_type"`
+	AvailabilityZone  string                      `json:"availability_zone"`
+	TerminationAction string                      `json:"termination_action,omitempty"`
+	TerminationTime   *time.Time                  `json:"termination_time,omitempty"`
+	RebalanceTime     *time.Time                  `json:"rebalance_time,omitempty"`
+	MaintenanceEvents []provider.MaintenanceEvent `json:"maintenance_events"`
+	Errors            []string                    `json:"errors,omitempty"`
+}
+
+func (h *refreshHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok || subtle.ConstantTimeCompare([]byte(token), h.token) != 1 {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	if clearer, ok := h.provider.(provider.CacheClearer); ok {
+		clearer.ClearCache()
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), 10*time.Second)
+	defer cancel()
+
+	identity, err := h.provider.GetInstanceIdentity(ctx)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("couldn't fetch instance identity: %s", err), http.StatusServiceUnavailable)
+		return
+	}
+	state := refreshState{
+		InstanceID:       identity.InstanceID,
+		InstanceType:     identity.InstanceType,
+		AvailabilityZone: identity.AvailabilityZone,
+	}
+	if notice, err := h.provider.GetTerminationNotice(ctx); err != nil {
+		state.Errors = append(state.Errors, fmt.Sprintf("termination notice: %s", err))
+	} else if notice != nil && !notice.Stale(identity) {
+		state.TerminationAction = notice.Action
+		state.TerminationTime = &notice.Time
+	}
+	if rebalance, err := h.provider.GetRebalance(ctx); err != nil {
+		state.Errors = append(state.Errors, fmt.Sprintf("rebalance recommendation: %s", err))
+	} else if rebalance != nil {
+		state.RebalanceTime = &rebalance.NoticeTime
+	}
+	if state.MaintenanceEvents, err = h.provider.GetMaintenanceEvents(ctx); err != nil {
+		state.Errors = append(state.Errors, fmt.Sprintf("maintenance events: %s", err))
+	}
+	log.Info("Refreshed metadata on request")
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(state)
+}
+
+// health reports the health of the exporter in node mode.
+var health *healthHandler
+
+// Health statuses, from best to worst.
+const (
+	healthy   = "healthy"
+	degraded  = "degraded"
+	unhealthy = "unhealthy"
+)
+
+// healthHandler reports the exporter healthy while the metadata service
+// answers, degraded while its last scrapes failed or the node labels are
+// unavailable, and unhealthy when it wasn't read successfully for
+// unhealthyAfter.
+type healthHandler struct {
+	provider       provider.Provider
+	termination    *collector.TerminationCollector
+	started        time.Time
+	unhealthyAfter time.Duration
+	// labelsPending is set while node labels are to be attached but the node
+	// hasn't been read yet, and labelsDeferred once the first attempt to read
+	// it failed, leaving it to be retried in the background.
+	labelsPending  atomic.Bool
+	labelsDeferred atomic.Bool
+	// polled is set once the metadata service was polled successfully.
+	polled atomic.Bool
+
+	mu       sync.Mutex
+	lastPoll time.Time
+}
+
+// healthReport is the body of a /healthz response.
+type healthReport struct {
+	Status string        `json:"status"`
+	Checks []healthCheck `json:"checks"`
+}
+
+type healthCheck struct {
+	Name    string `json:"name"`
+	Status  string `json:"status"`
+	Message string `json:"message,omitempty"`
+}
+
+func (h *healthHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	report := healthReport{Status: healthy, Checks: []healthCheck{h.checkMetadataService(r.Context())}}
+	if h.labelsPending.Load() {
+		report.Checks = append(report.Checks, healthCheck{Name: "node_labels", Status: degraded, Message: "node hasn't been read yet"})
+	}
+	for _, check := range report.Checks {
+		if check.Status == unhealthy || (check.Status == degraded && report.Status == healthy) {
+			report.Status = check.Status
+		}
+	}
+
+	// degraded is still a success for probes, the body tells it apart
+	code := http.StatusOK
+	if report.Status == unhealthy {
+		code = http.StatusServiceUnavailable
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(report)
+}
+
+// serveStartup answers 200 once the exporter completed its first full
+// successful poll of the metadata service, and the node labels, if they are
+// to be attached, were either loaded or deferred to the background, and 503
+// before.
+func (h *healthHandler) serveStartup(w http.ResponseWriter, r *http.Request) {
+	report := healthReport{Status: "started"}
+	poll := healthCheck{Name: "metadata_service", Status: "ok"}
+	if err := h.pollOnce(r.Context()); err != nil {
+		poll.Status = "pending"
+		poll.Message = err.Error()
+	}
+	report.Checks = append(report.Checks, poll)
+	if h.labelsPending.Load() {
+		labels := healthCheck{Name: "node_labels", Status: "pending", Message: "reading the node"}
+		if h.labelsDeferred.Load() {
+			labels = healthCheck{Name: "node_labels", Status: "ok", Message: "deferred, retrying in the background"}
+		}
+		report.Checks = append(report.Checks, labels)
+	}
+
+	code := http.StatusOK
+	for _, check := range report.Checks {
+		if check.Status == "pending" {
+			report.Status = "starting"
+			code = http.StatusServiceUnavailable
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(report)
+}
+
+// pollOnce polls the instance identity and termination notice, which needs a
+// session token with IMDSv2, unless a scrape or an earlier call already did.
+func (h *healthHandler) pollOnce(ctx context.Context) error {
+	if h.polled.Load() {
+		return nil
+	}
+	if lastSuccess, _ := h.termination.PollStatus(); !lastSuccess.IsZero() {
+		h.polled.Store(true)
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	if _, err := h.provider.GetInstanceIdentity(ctx); err != nil {
+		return fmt.Errorf("couldn't fetch instance identity: %w", err)
+	}
+	if _, err := h.provider.GetTerminationNotice(ctx); err != nil {
+		return fmt.Errorf("couldn't fetch termination notice: %w", err)
+	}
+	h.polled.Store(true)
+	return nil
+}
+
+// checkMetadataService checks the scrapes of the metadata service. When none
+// succeeded recently, e.g. as nothing scrapes the exporter, it polls the
+// metadata service itself.
+func (h *healthHandler) checkMetadataService(ctx context.Context) healthCheck {
+	check := healthCheck{Name: "metadata_service", Status: healthy}
+	lastSuccess, failures := h.termination.PollStatus()
+	h.mu.Lock()
+	if h.lastPoll.After(lastSuccess) {
+		lastSuccess, failures = h.lastPoll, 0
+	}
+	h.mu.Unlock()
+
+	if time.Since(lastSuccess) > h.unhealthyAfter {
+		ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+		defer cancel()
+		_, err := h.provider.GetInstanceIdentity(ctx)
+		if err == nil {
+			h.mu.Lock()
+			h.lastPoll = time.Now()
+			h.mu.Unlock()
+			return check
+		}
+		since := lastSuccess
+		if since.IsZero() {
+			since = h.started
+		}
+		if time.Since(since) > h.unhealthyAfter {
+			check.Status = unhealthy
+			check.Message = fmt.Sprintf("no successful poll for %s: %s", time.Since(since).Round(time.Second), err)
+			return check
+		}
+		failures++
+	}
+	if failures > 0 {
+		check.Status = degraded
+		check.Message = fmt.Sprintf("%d polls in a row failed", failures)
+	}
+	return check
+}
+
+// probeTargets matches the hosts of the metadata endpoints /probe may scrape.
+var probeTargets *regexp.Regexp
+
+// probeHandler implements the multi-target exporter pattern, scraping the
+// metadata endpoint given in the target parameter instead of the local one.
+// Only targets on hosts matching probeTargets are scraped, and their token
+// must come from the same host, so the exporter can't be made to send
+// requests, or IMDSv2 tokens, elsewhere.
+func probeHandler(w http.ResponseWriter, r *http.Request) {
+	target := r.URL.Query().Get("target")
+	if target == "" {
+		http.Error(w, "target parameter is missing", http.StatusBadRequest)
+		return
+	}
+	targetURL, err := url.Parse(target)
+	if err != nil || (targetURL.Scheme != "http" && targetURL.Scheme != "https") || targetURL.Host == "" {
+		http.Error(w, fmt.Sprintf("invalid target %q", target), http.StatusBadRequest)
+		return
+	}
+	if !probeTargets.MatchString(targetURL.Host) {
+		http.Error(w, fmt.Sprintf("target %q isn't allowed", target), http.StatusForbidden)
+		return
+	}
+	if !strings.HasSuffix(targetURL.Path, "/") {
+		targetURL.Path += "/"
+	}
+	// The token endpoint sits next to the meta-data tree, e.g.
+	// /latest/meta-data/ -> /latest/api/token.
+	tokenURL := targetURL.ResolveReference(&url.URL{Path: "../api/token"})
+	if tokenTarget := r.URL.Query().Get("token_target"); tokenTarget != "" {
+		tokenURL, err = url.Parse(tokenTarget)
+		if err != nil || (tokenURL.Scheme != "http" && tokenURL.Scheme != "https") {
+			http.Error(w, fmt.Sprintf("invalid token_target %q", tokenTarget), http.StatusBadRequest)
+			return
+		}
+		if tokenURL.Host != targetURL.Host {
+			http.Error(w, fmt.Sprintf("token_target %q isn't on the host of the target", tokenTarget), http.StatusBadRequest)
+			return
+		}
+	}
+
+	cfg := provider.Config{
+		MetadataEndpoint: targetURL.String(),
+		TokenEndpoint:    tokenURL.String(),
+		UseIMDSv2:        *imdsv2Mode != "off",
+		IMDSv1Fallback:   *imdsv2Mode == "preferred",
+		TokenTTL:         *imdsv2TokenTTL,
+		RequestTimeout:   *imdsTimeout,
+		TokenTimeout:     *imdsTokenTimeout,
+		Transport:        metadataTransport,
+	}
+	// node mode resolves auto at startup, the other modes don't query a
+	// local metadata service, so detect the provider of the target
+	name := *providerName
+	if name == "auto" {
+		name, err = provider.Detect(r.Context(), cfg)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+	}
+	metadataProvider, err := provider.New(name, cfg)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	log.Debugf("probing metadata endpoint %s", targetURL)
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(collector.NewTerminationCollector(metadataProvider, nil))
+	promhttp.HandlerFor(registry, promhttp.HandlerOpts{}).ServeHTTP(w, r)
+}
+
+// link is a link on the landing page.
+type link struct {
+	name string
+	url  string
+}
+
+// landingPage returns the handler of the page served at the route prefix,
+// linking to the metrics below externalPath and to the given links.
+func landingPage(title, externalPath string, links []link) http.Handler {
+	var items strings.Builder
+	for _, l := range append([]link{{name: "Metrics", url: externalPath + *metricsPath}}, links...) {
+		fmt.Fprintf(&items, "\t\t<p><a href=\"%s\">%s</a></p>\n", html.EscapeString(l.url), html.EscapeString(l.name))
+	}
+	page := []byte(`<html>
+		<head><title>` + html.EscapeString(title) + `</title></head>
 		<body>
-		<h1>Spot Termination Exporter</h1>
-		<p><a href="` + *metricsPath + `">Metrics</a></p>
-		</body>
-		</html>`))
+		<h1>` + html.EscapeString(title) + `</h1>
+` + items.String() + `		</body>
+		</html>`)
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		w.Write(page)
+	})
+}
+
+// parseLinks parses a comma-separated list of name=url links.
+func parseLinks(value string) ([]link, error) {
+	var links []link
+	for _, item := range splitList(value) {
+		name, target, ok := strings.Cut(item, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid landing page link %q, expected name=url", item)
+		}
+		links = append(links, link{name: name, url: target})
+	}
+	return links, nil
+}
+
+// parseKeyValues parses a comma-separated list of key=value items, naming
+// kind in errors.
+func parseKeyValues(value, kind string) (map[string]string, error) {
+	items := map[string]string{}
+	for _, item := range splitList(value) {
+		key, val, ok := strings.Cut(item, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid %s %q, expected key=value", kind, item)
+		}
+		items[key] = val
+	}
+	return items, nil
 }
@@ -0,0 +1,272 @@
+package collector
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gjtempleton/spot-termination-exporter/pkg/imds"
+	"github.com/gjtempleton/spot-termination-exporter/pkg/provider"
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+	"sigs.k8s.io/yaml"
+)
+
+// Ways of turning a metadata response into the value of a custom metric.
+const (
+	// ValueExists exports 1 when the path is found and 0 otherwise.
+	ValueExists = "exists"
+	// ValueNumber parses the response as a number.
+	ValueNumber = "number"
+	// ValueJSON reads the number at Field of a JSON response.
+	ValueJSON = "json"
+	// ValueInfo exports 1 with the response in the value label.
+	ValueInfo = "info"
+)
+
+var metricNameRE = regexp.MustCompile(`^[a-zA-Z_:][a-zA-Z0-9_:]*$`)
+
+// CustomMetricsConfig is the file configuring custom metrics.
+type CustomMetricsConfig struct {
+	Metrics []CustomMetric `json:"metrics"`
+}
+
+// CustomMetric maps a path below the metadata endpoint to a gauge. Each "*"
+// segment of the path matches every entry of the listing of that directory,
+// e.g. the MAC addresses in network/interfaces/macs/*/ipv4-associations/*,
+// with the entry exported in the label named by Labels at the same position.
+type CustomMetric struct {
+	Name   string   `json:"name"`
+	Help   string   `json:"help"`
+	Path   string   `json:"path"`
+	Labels []string `json:"labels"`
+	// Value is one of ValueExists, ValueNumber, the default, ValueJSON or
+	// ValueInfo.
+	Value string `json:"value"`
+	// Field is the dot separated path to the number in a JSON response,
+	// e.g. "limits.cpu".
+	Field string `json:"field"`
+}
+
+// LoadCustomMetricsConfig reads and validates a YAML or JSON file configuring
+// custom metrics.
+func LoadCustomMetricsConfig(path string) (*CustomMetricsConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var cfg CustomMetricsConfig
+	if err := yaml.UnmarshalStrict(data, &cfg); err != nil {
+		return nil, fmt.Errorf("parse %s: %w", path, err)
+	}
+	for i := range cfg.Metrics {
+		if err := cfg.Metrics[i].validate(); err != nil {
+			return nil, fmt.Errorf("metric %d in %s: %w", i, path, err)
+		}
+	}
+	return &cfg, nil
+}
+
+func (m *CustomMetric) validate() error {
+	if !metricNameRE.MatchString(m.Name) {
+		return fmt.Errorf("invalid metric name %q", m.Name)
+	}
+	if m.Path == "" {
+		return fmt.Errorf("%s: path is required", m.Name)
+	}
+	if m.Help == "" {
+		m.Help = "Metadata read from " + m.Path
+	}
+	if m.Value == "" {
+		m.Value = ValueNumber
+	}
+	switch m.Value {
+	case ValueExists, ValueNumber, ValueInfo:
+	case ValueJSON:
+		if m.Field == "" {
+			return fmt.Errorf("%s: field is required for json values", m.Name)
+		}
+	default:
+		return fmt.Errorf("%s: unknown value %q", m.Name, m.Value)
+	}
+	if wildcards := strings.Count(m.Path, "*"); wildcards != len(m.Labels) {
+		return fmt.Errorf("%s: path has %d wildcards but %d labels are given", m.Name, wildcards, len(m.Labels))
+	}
+	return nil
+}
+
+// CustomMetricsCollector exports metrics configured by a
+// CustomMetricsConfig, so metadata without a collector of its own can be
+// exported.
+type CustomMetricsCollector struct {
+	provider provider.Provider
+	getter   provider.MetadataGetter
+	metrics  []CustomMetric
+
+	mu    sync.RWMutex
+	descs []*prometheus.Desc
+}
+
+// NewCustomMetricsCollector returns a CustomMetricsCollector reading the
+// identity from p and the configured paths from getter, usually the same
+// provider. nodeLabels are attached to every metric as constant labels.
+func NewCustomMetricsCollector(p provider.Provider, getter provider.MetadataGetter, cfg *CustomMetricsConfig, nodeLabels prometheus.Labels) *CustomMetricsCollector {
+	c := &CustomMetricsCollector{
+		provider: p,
+		getter:   getter,
+		metrics:  cfg.Metrics,
+	}
+	c.SetNodeLabels(nodeLabels)
+	return c
+}
+
+// SetNodeLabels replaces the constant labels attached to every metric, e.g.
+// after the labels of the node changed.
+func (c *CustomMetricsCollector) SetNodeLabels(nodeLabels prometheus.Labels) {
+	descs := make([]*prometheus.Desc, len(c.metrics))
+	for i, m := range c.metrics {
+		labels := append([]string{"instance_id"}, m.Labels...)
+		if m.Value == ValueInfo {
+			labels = append(labels, "value")
+		}
+		descs[i] = prometheus.NewDesc(m.Name, m.Help, labels, nodeLabels)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.descs = descs
+}
+
+// Describe sends no descriptors, making this an unchecked collector, as the
+// node labels attached to the descriptors can change at runtime.
+func (c *CustomMetricsCollector) Describe(ch chan<- *prometheus.Desc) {
+}
+
+func (c *CustomMetricsCollector) Collect(ch chan<- prometheus.Metric) {
+	c.mu.RLock()
+	descs := c.descs
+	c.mu.RUnlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	identity, err := c.provider.GetInstanceIdentity(ctx)
+	if err != nil {
+		imds.WithError(err).Error("couldn't fetch instance identity")
+		return
+	}
+
+	for i, m := range c.metrics {
+		paths, err := c.expand(ctx, m.Path)
+		if err != nil {
+			log.Errorf("couldn't list %s for %s: %s", m.Path, m.Name, err)
+			continue
+		}
+		for _, p := range paths {
+			body, found, err := c.getter.GetMetadata(ctx, p.path)
+			if err != nil {
+				log.Errorf("couldn't read %s for %s: %s", p.path, m.Name, err)
+				continue
+			}
+			labels := append([]string{identity.InstanceID}, p.matches...)
+			value := 1.0
+			switch m.Value {
+			case ValueExists:
+				if !found {
+					value = 0
+				}
+			case ValueNumber:
+				if !found {
+					continue
+				}
+				value, err = strconv.ParseFloat(strings.TrimSpace(string(body)), 64)
+			case ValueJSON:
+				if !found {
+					continue
+				}
+				value, err = jsonField(body, m.Field)
+			case ValueInfo:
+				if !found {
+					continue
+				}
+				labels = append(labels, strings.TrimSpace(string(body)))
+			}
+			if err != nil {
+				log.Errorf("couldn't parse %s for %s: %s", p.path, m.Name, err)
+				continue
+			}
+			ch <- prometheus.MustNewConstMetric(descs[i], prometheus.GaugeValue, value, labels...)
+		}
+	}
+}
+
+// expandedPath is a path without wildcards and the directory entries its
+// wildcards matched.
+type expandedPath struct {
+	path    string
+	matches []string
+}
+
+// expand replaces each "*" segment of path by the entries of the listing of
+// the directory before it.
+func (c *CustomMetricsCollector) expand(ctx context.Context, path string) ([]expandedPath, error) {
+	prefix, rest, wildcard := strings.Cut(path, "*")
+	if !wildcard {
+		return []expandedPath{{path: path}}, nil
+	}
+	body, found, err := c.getter.GetMetadata(ctx, prefix)
+	if err != nil || !found {
+		return nil, err
+	}
+
+	var paths []expandedPath
+	for _, entry := range strings.Split(strings.TrimSpace(string(body)), "\n") {
+		entry = strings.TrimSuffix(strings.TrimSpace(entry), "/")
+		if entry == "" {
+			continue
+		}
+		expanded, err := c.expand(ctx, prefix+entry+rest)
+		if err != nil {
+			return nil, err
+		}
+		for _, e := range expanded {
+			paths = append(paths, expandedPath{path: e.path, matches: append([]string{entry}, e.matches...)})
+		}
+	}
+	return paths, nil
+}
+
+// jsonField returns the number at the dot separated field of a JSON object.
+func jsonField(body []byte, field string) (float64, error) {
+	var value interface{}
+	if err := json.Unmarshal(body, &value); err != nil {
+		return 0, err
+	}
+	for _, key := range strings.Split(field, ".") {
+		object, ok := value.(map[string]interface{})
+		if !ok {
+			return 0, fmt.Errorf("no field %q", field)
+		}
+		if value, ok = object[key]; !ok {
+			return 0, fmt.Errorf("no field %q", field)
+		}
+	}
+	switch v := value.(type) {
+	case float64:
+		return v, nil
+	case bool:
+		if v {
+			return 1, nil
+		}
+		return 0, nil
+	case string:
+		return strconv.ParseFloat(v, 64)
+	}
+	return 0, fmt.Errorf("field %q isn't a number", field)
+}
@@ -0,0 +1,230 @@
+package collector
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+)
+
+// Types of InterruptionEvent.
+const (
+	EventTermination = "termination"
+	EventRebalance   = "rebalance"
+)
+
+// InterruptionEvent is a termination notice or rebalance recommendation as
+// first observed by the exporter.
+type InterruptionEvent struct {
+	// ID identifies the event, derived from the instance, type, action and
+	// time, so it is the same for every exporter observing it and across
+	// restarts.
+	ID         string    `json:"event_id"`
+	Observed   time.Time `json:"observed"`
+	Type       string    `json:"type"`
+	InstanceID string    `json:"instance_id"`
+	// InstanceType, AvailabilityZone and Region are empty if they weren't
+	// known when the event was observed.
+	InstanceType     string `json:"instance_type,omitempty"`
+	AvailabilityZone string `json:"availability_zone,omitempty"`
+	Region           string `json:"region,omitempty"`
+	// Action is the announced action of a termination notice, e.g.
+	// "terminate", "stop" or "hibernate".
+	Action string `json:"action,omitempty"`
+	// Time is when the instance will be interrupted for a termination, or
+	// when the recommendation was issued for a rebalance.
+	Time time.Time `json:"time,omitzero"`
+	// Raw is the metadata the event was read from.
+	Raw string `json:"raw,omitempty"`
+	// Actions describes what the exporter did about the event, e.g. which
+	// process it signalled.
+	Actions []string `json:"actions,omitempty"`
+}
+
+// eventID returns the ID of event.
+func eventID(event InterruptionEvent) string {
+	sum := sha256.Sum256([]byte(strings.Join([]string{event.InstanceID, event.Type, event.Action, event.Time.UTC().Format(time.RFC3339Nano)}, "\x00")))
+	return hex.EncodeToString(sum[:8])
+}
+
+// EventLog keeps the last interruption events in a ring buffer, optionally
+// persisted to a file so the history survives restarts. It is safe for
+// concurrent use.
+type EventLog struct {
+	path      string
+	retention time.Duration
+
+	mu     sync.Mutex
+	events []InterruptionEvent
+	next   int
+	full   bool
+}
+
+// NewEventLog returns an EventLog keeping the last size events in memory.
+// Events older than retention are dropped, unless retention is 0.
+func NewEventLog(size int, retention time.Duration) *EventLog {
+	return &EventLog{events: make([]InterruptionEvent, size), retention: retention}
+}
+
+// OpenEventLog returns an EventLog like NewEventLog, persisted to the file at
+// path and starting with the events already in it.
+func OpenEventLog(path string, size int, retention time.Duration) (*EventLog, error) {
+	l := NewEventLog(size, retention)
+	l.path = path
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return l, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("read event history: %w", err)
+	}
+	var events []InterruptionEvent
+	if err := json.Unmarshal(data, &events); err != nil {
+		log.WithError(err).Warnf("ignoring invalid event history %s", path)
+		return l, nil
+	}
+	for _, event := range events {
+		l.add(event)
+	}
+	return l, nil
+}
+
+// Add appends event, dropping the oldest event once the log is full. An
+// event already logged, e.g. a recommendation observed again after it was
+// followed by a notice, isn't added again. It returns whether event was
+// added.
+func (l *EventLog) Add(event InterruptionEvent) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, logged := range l.events {
+		if logged.ID == event.ID {
+			return false
+		}
+	}
+	l.add(event)
+	l.save()
+	return true
+}
+
+// AddAction records that action was taken about the event with the given
+// ID, if it is still logged.
+func (l *EventLog) AddAction(id, action string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for i := range l.events {
+		if l.events[i].ID == id {
+			l.events[i].Actions = append(l.events[i].Actions, action)
+			l.save()
+			return
+		}
+	}
+}
+
+// add appends event. The caller must hold l.mu unless l isn't shared yet.
+func (l *EventLog) add(event InterruptionEvent) {
+	if len(l.events) == 0 {
+		return
+	}
+	l.events[l.next] = event
+	l.next = (l.next + 1) % len(l.events)
+	if l.next == 0 {
+		l.full = true
+	}
+}
+
+// Events returns the logged events within the retention, oldest first.
+func (l *EventLog) Events() []InterruptionEvent {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.list()
+}
+
+// list returns the events within the retention, oldest first. The caller
+// must hold l.mu.
+func (l *EventLog) list() []InterruptionEvent {
+	events := append([]InterruptionEvent{}, l.events[:l.next]...)
+	if l.full {
+		events = append(append([]InterruptionEvent{}, l.events[l.next:]...), events...)
+	}
+	if l.retention <= 0 {
+		return events
+	}
+	for i, event := range events {
+		if time.Since(event.Observed) < l.retention {
+			return events[i:]
+		}
+	}
+	return nil
+}
+
+// save writes the events within the retention to the file, if any. The
+// caller must hold l.mu.
+func (l *EventLog) save() {
+	if l.path == "" {
+		return
+	}
+	data, err := json.Marshal(l.list())
+	if err != nil {
+		log.WithError(err).Error("Failed to encode event history")
+		return
+	}
+	// write and rename, so a crash mid-write doesn't leave a truncated file
+	tmp := l.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		log.WithError(err).Error("Failed to write event history")
+		return
+	}
+	if err := os.Rename(tmp, l.path); err != nil {
+		log.WithError(err).Error("Failed to write event history")
+	}
+}
+
+// EventInfoCollector exports an info metric for each event in an EventLog,
+// so metrics can be joined with the event history and logs by event_id.
+type EventInfoCollector struct {
+	eventLog *EventLog
+
+	mu   sync.RWMutex
+	info *prometheus.Desc
+}
+
+// NewEventInfoCollector returns an EventInfoCollector exporting the events
+// in eventLog. nodeLabels are attached to every metric as constant labels.
+func NewEventInfoCollector(eventLog *EventLog, nodeLabels prometheus.Labels) *EventInfoCollector {
+	return &EventInfoCollector{eventLog: eventLog, info: newEventInfoDesc(nodeLabels)}
+}
+
+func newEventInfoDesc(nodeLabels prometheus.Labels) *prometheus.Desc {
+	return prometheus.NewDesc("aws_instance_interruption_event_info", "Interruption event observed by the exporter", []string{"event_id", "event_type", "action"}, nodeLabels)
+}
+
+// SetNodeLabels replaces the constant labels attached to every metric, e.g.
+// after the labels of the node changed.
+func (c *EventInfoCollector) SetNodeLabels(nodeLabels prometheus.Labels) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.info = newEventInfoDesc(nodeLabels)
+}
+
+// Describe sends no descriptors, making this an unchecked collector, as the
+// node labels attached to the descriptors can change at runtime.
+func (c *EventInfoCollector) Describe(ch chan<- *prometheus.Desc) {
+}
+
+func (c *EventInfoCollector) Collect(ch chan<- prometheus.Metric) {
+	c.mu.RLock()
+	info := c.info
+	c.mu.RUnlock()
+	for _, event := range c.eventLog.Events() {
+		ch <- prometheus.MustNewConstMetric(info, prometheus.GaugeValue, 1, event.ID, event.Type, event.Action)
+	}
+}
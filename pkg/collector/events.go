@@ -0,0 +1,227 @@
+package collector
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	spotInterruptionWarning = "EC2 Spot Instance Interruption Warning"
+	rebalanceRecommendation = "EC2 Instance Rebalance Recommendation"
+	// interruptionNotice is the time between a spot interruption warning and
+	// the instance being interrupted.
+	interruptionNotice = 2 * time.Minute
+)
+
+// EventCollector consumes spot interruption warnings and rebalance
+// recommendations delivered by EventBridge to an SQS queue, exporting the same
+// metric families as the TerminationCollector for every instance in the fleet.
+type EventCollector struct {
+	queueURL     string
+	retention    time.Duration
+	eventHandler func(event InterruptionEvent)
+
+	mu           sync.Mutex
+	terminations map[string]eventState
+	rebalances   map[string]eventState
+
+	rebalanceIndicator   *prometheus.Desc
+	terminationIndicator *prometheus.Desc
+	terminationTime      *prometheus.Desc
+}
+
+type eventState struct {
+	action   string
+	time     time.Time
+	received time.Time
+}
+
+type eventBridgeEvent struct {
+	DetailType string    `json:"detail-type"`
+	Time       time.Time `json:"time"`
+	Region     string    `json:"region"`
+	Detail     struct {
+		InstanceID     string `json:"instance-id"`
+		InstanceAction string `json:"instance-action"`
+	} `json:"detail"`
+}
+
+// NewEventCollector returns an EventCollector for the given queue. Events are
+// exported for retention after they are received.
+func NewEventCollector(queueURL string, retention time.Duration) *EventCollector {
+	return &EventCollector{
+		queueURL:             queueURL,
+		retention:            retention,
+		terminations:         map[string]eventState{},
+		rebalances:           map[string]eventState{},
+		rebalanceIndicator:   prometheus.NewDesc("aws_instance_rebalance_recommended", "Instance rebalance is recommended", []string{"instance_id", "instance_type"}, nil),
+		terminationIndicator: prometheus.NewDesc("aws_instance_termination_imminent", "Instance is about to be terminated", []string{"instance_action", "instance_id", "instance_type"}, nil),
+		terminationTime:      prometheus.NewDesc("aws_instance_termination_in", "Instance will be terminated in", []string{"instance_id", "instance_type"}, nil),
+	}
+}
+
+// SetEventHandler makes the collector call handler, in a goroutine of its
+// own, with every interruption warning and rebalance recommendation it
+// receives for an instance for the first time, completed with the type and
+// availability zone of the instance if it can describe it.
+func (c *EventCollector) SetEventHandler(handler func(event InterruptionEvent)) {
+	c.eventHandler = handler
+}
+
+func (c *EventCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.rebalanceIndicator
+	ch <- c.terminationIndicator
+	ch <- c.terminationTime
+}
+
+func (c *EventCollector) Collect(ch chan<- prometheus.Metric) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.expire()
+	// Instance types aren't part of the EventBridge events, so the label is
+	// left empty.
+	for instanceID, s := range c.terminations {
+		ch <- prometheus.MustNewConstMetric(c.terminationIndicator, prometheus.GaugeValue, 1, s.action, instanceID, "")
+		delta := time.Until(s.time)
+		if delta.Seconds() > 0 {
+			ch <- prometheus.MustNewConstMetric(c.terminationTime, prometheus.GaugeValue, delta.Seconds(), instanceID, "")
+		}
+	}
+	for instanceID := range c.rebalances {
+		ch <- prometheus.MustNewConstMetric(c.rebalanceIndicator, prometheus.GaugeValue, 1, instanceID, "")
+	}
+}
+
+// expire drops events older than the retention period, as the instances they
+// refer to are long gone by then. The caller must hold c.mu.
+func (c *EventCollector) expire() {
+	for instanceID, s := range c.terminations {
+		if time.Since(s.received) > c.retention {
+			delete(c.terminations, instanceID)
+		}
+	}
+	for instanceID, s := range c.rebalances {
+		if time.Since(s.received) > c.retention {
+			delete(c.rebalances, instanceID)
+		}
+	}
+}
+
+// Run long polls the SQS queue until ctx is cancelled.
+func (c *EventCollector) Run(ctx context.Context) error {
+	cfg, err := config.LoadDefaultConfig(ctx)
+	if err != nil {
+		return err
+	}
+	client := sqs.NewFromConfig(cfg)
+	ec2Client := ec2.NewFromConfig(cfg)
+
+	for ctx.Err() == nil {
+		out, err := client.ReceiveMessage(ctx, &sqs.ReceiveMessageInput{
+			QueueUrl:            aws.String(c.queueURL),
+			MaxNumberOfMessages: 10,
+			WaitTimeSeconds:     20,
+		})
+		if err != nil {
+			if ctx.Err() != nil {
+				break
+			}
+			log.Errorf("couldn't receive messages from SQS: %s", err)
+			time.Sleep(5 * time.Second)
+			continue
+		}
+
+		for _, message := range out.Messages {
+			if event := c.handleMessage(aws.ToString(message.Body)); event != nil && c.eventHandler != nil {
+				c.describeInstance(ctx, ec2Client, event)
+				go c.eventHandler(*event)
+			}
+			_, err := client.DeleteMessage(ctx, &sqs.DeleteMessageInput{
+				QueueUrl:      aws.String(c.queueURL),
+				ReceiptHandle: message.ReceiptHandle,
+			})
+			if err != nil {
+				log.Errorf("couldn't delete message from SQS: %s", err)
+			}
+		}
+	}
+	return nil
+}
+
+// handleMessage records the event in body, returning it as interruption
+// event if it is new for the instance.
+func (c *EventCollector) handleMessage(body string) *InterruptionEvent {
+	var event eventBridgeEvent
+	if err := json.Unmarshal([]byte(body), &event); err != nil {
+		log.Errorf("Couldn't parse EventBridge event: %s", err)
+		return nil
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	interruption := InterruptionEvent{Observed: now, InstanceID: event.Detail.InstanceID, Region: event.Region, Raw: body}
+	switch event.DetailType {
+	case spotInterruptionWarning:
+		log.Infof("spot interruption warning received for %s, action: %s", event.Detail.InstanceID, event.Detail.InstanceAction)
+		previous, seen := c.terminations[event.Detail.InstanceID]
+		c.terminations[event.Detail.InstanceID] = eventState{
+			action:   event.Detail.InstanceAction,
+			time:     event.Time.Add(interruptionNotice),
+			received: now,
+		}
+		if seen && previous.action == event.Detail.InstanceAction {
+			return nil
+		}
+		interruption.Type = EventTermination
+		interruption.Action = event.Detail.InstanceAction
+		interruption.Time = event.Time.Add(interruptionNotice)
+	case rebalanceRecommendation:
+		log.Infof("rebalance recommendation received for %s", event.Detail.InstanceID)
+		_, seen := c.rebalances[event.Detail.InstanceID]
+		c.rebalances[event.Detail.InstanceID] = eventState{
+			time:     event.Time,
+			received: now,
+		}
+		if seen {
+			return nil
+		}
+		interruption.Type = EventRebalance
+		interruption.Time = event.Time
+	default:
+		log.Debugf("ignoring event of type %q", event.DetailType)
+		return nil
+	}
+	interruption.ID = eventID(interruption)
+	return &interruption
+}
+
+// describeInstance completes event with the type and availability zone of
+// its instance, leaving them empty if the instance can't be described, e.g.
+// without permission to.
+func (c *EventCollector) describeInstance(ctx context.Context, client *ec2.Client, event *InterruptionEvent) {
+	out, err := client.DescribeInstances(ctx, &ec2.DescribeInstancesInput{InstanceIds: []string{event.InstanceID}})
+	if err != nil {
+		log.WithError(err).Debugf("Couldn't describe instance %s", event.InstanceID)
+		return
+	}
+	for _, reservation := range out.Reservations {
+		for _, instance := range reservation.Instances {
+			event.InstanceType = string(instance.InstanceType)
+			if instance.Placement != nil {
+				event.AvailabilityZone = aws.ToString(instance.Placement.AvailabilityZone)
+			}
+		}
+	}
+}
@@ -0,0 +1,354 @@
+package collector
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	ec2types "github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+)
+
+// spotStatusActions maps the spot request status codes set while an
+// interruption is pending to the action that will be taken.
+var spotStatusActions = map[string]string{
+	"marked-for-termination": "terminate",
+	"marked-for-stop":        "stop",
+	"marked-for-hibernation": "hibernate",
+}
+
+const (
+	// recentInterruptionWindow is how long an interruption counts as recent.
+	recentInterruptionWindow = time.Hour
+	// DefaultRateWindow is the default window interruption rates are
+	// computed over.
+	DefaultRateWindow = 24 * time.Hour
+)
+
+// FleetCollector periodically describes the spot instances matching a set of
+// tags through the EC2 API and exports their interruption status, so a single
+// exporter per region can cover a whole fleet.
+type FleetCollector struct {
+	tagFilters   map[string]string
+	pollInterval time.Duration
+	summaryOnly  bool
+	rateWindow   time.Duration
+
+	mu            sync.Mutex
+	running       bool
+	instances     []fleetInstance
+	pollSucceeded bool
+	// interruptions holds when the instances still marked for interruption,
+	// or marked within the recentInterruptionWindow, were first seen marked.
+	interruptions map[string]fleetInterruption
+	// samples hold the instance-hours and new interruptions of each poll
+	// within the rateWindow, oldest first.
+	samples  []fleetSample
+	lastPoll time.Time
+
+	apiAvailable         *prometheus.Desc
+	requestStatus        *prometheus.Desc
+	terminationIndicator *prometheus.Desc
+	instanceCount        *prometheus.Desc
+	interruptionCount    *prometheus.Desc
+	recentInterruptions  *prometheus.Desc
+	interruptionRate     *prometheus.Desc
+}
+
+// fleetGroup is the instance type and availability zone metrics of the fleet
+// are aggregated by.
+type fleetGroup struct {
+	instanceType     string
+	availabilityZone string
+}
+
+// fleetSample is what a poll observed: the instance-hours since the previous
+// poll and the instances newly marked for interruption per group.
+type fleetSample struct {
+	observed      time.Time
+	instanceHours map[fleetGroup]float64
+	interruptions map[fleetGroup]int
+}
+
+type fleetInterruption struct {
+	instanceType     string
+	availabilityZone string
+	observed         time.Time
+}
+
+type fleetInstance struct {
+	instanceID       string
+	instanceType     string
+	availabilityZone string
+	statusCode       string
+}
+
+// NewFleetCollector returns a FleetCollector selecting spot instances by the
+// given tags.
+func NewFleetCollector(tagFilters map[string]string, pollInterval time.Duration) *FleetCollector {
+	return &FleetCollector{
+		tagFilters:           tagFilters,
+		pollInterval:         pollInterval,
+		rateWindow:           DefaultRateWindow,
+		interruptions:        map[string]fleetInterruption{},
+		apiAvailable:         prometheus.NewDesc("aws_fleet_api_available", "Last poll of the EC2 API was successful", nil, nil),
+		requestStatus:        prometheus.NewDesc("aws_spot_request_status", "Status code of the spot request of the instance", []string{"instance_id", "instance_type", "availability_zone", "status_code"}, nil),
+		terminationIndicator: prometheus.NewDesc("aws_instance_termination_imminent", "Instance is about to be terminated", []string{"instance_action", "instance_id", "instance_type"}, nil),
+		instanceCount:        prometheus.NewDesc("aws_fleet_spot_instances", "Number of spot instances in the fleet", []string{"instance_type", "availability_zone"}, nil),
+		interruptionCount:    prometheus.NewDesc("aws_fleet_spot_interruptions_pending", "Number of spot instances in the fleet marked for interruption", []string{"instance_type", "availability_zone"}, nil),
+		recentInterruptions:  prometheus.NewDesc("aws_fleet_spot_interruptions_last_hour", "Number of spot instances in the fleet first seen marked for interruption within the last hour", []string{"instance_type", "availability_zone"}, nil),
+		interruptionRate:     prometheus.NewDesc("aws_fleet_spot_interruption_rate", "Interruptions per instance-hour of the spot instances in the fleet over the rate window", []string{"instance_type", "availability_zone"}, nil),
+	}
+}
+
+// SetRateWindow sets the window interruption rates are computed over,
+// DefaultRateWindow by default.
+func (c *FleetCollector) SetRateWindow(window time.Duration) {
+	c.rateWindow = window
+}
+
+// SetSummaryOnly makes the collector export only the aggregated metrics, not
+// those of each instance, e.g. when running next to per-node collectors
+// exporting the same metrics.
+func (c *FleetCollector) SetSummaryOnly(summaryOnly bool) {
+	c.summaryOnly = summaryOnly
+}
+
+func (c *FleetCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.apiAvailable
+	ch <- c.requestStatus
+	ch <- c.terminationIndicator
+	ch <- c.instanceCount
+	ch <- c.interruptionCount
+	ch <- c.recentInterruptions
+	ch <- c.interruptionRate
+}
+
+func (c *FleetCollector) Collect(ch chan<- prometheus.Metric) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if !c.running {
+		return
+	}
+
+	if !c.pollSucceeded {
+		ch <- prometheus.MustNewConstMetric(c.apiAvailable, prometheus.GaugeValue, 0)
+	} else {
+		ch <- prometheus.MustNewConstMetric(c.apiAvailable, prometheus.GaugeValue, 1)
+	}
+
+	instances := map[fleetGroup]int{}
+	interruptions := map[fleetGroup]int{}
+	for _, i := range c.instances {
+		g := fleetGroup{i.instanceType, i.availabilityZone}
+		instances[g]++
+		action, interrupted := spotStatusActions[i.statusCode]
+		if interrupted {
+			interruptions[g]++
+		}
+		if c.summaryOnly {
+			continue
+		}
+
+		ch <- prometheus.MustNewConstMetric(c.requestStatus, prometheus.GaugeValue, 1, i.instanceID, i.instanceType, i.availabilityZone, i.statusCode)
+		if interrupted {
+			ch <- prometheus.MustNewConstMetric(c.terminationIndicator, prometheus.GaugeValue, 1, action, i.instanceID, i.instanceType)
+		} else {
+			ch <- prometheus.MustNewConstMetric(c.terminationIndicator, prometheus.GaugeValue, 0, "", i.instanceID, i.instanceType)
+		}
+	}
+	for g, count := range instances {
+		ch <- prometheus.MustNewConstMetric(c.instanceCount, prometheus.GaugeValue, float64(count), g.instanceType, g.availabilityZone)
+		ch <- prometheus.MustNewConstMetric(c.interruptionCount, prometheus.GaugeValue, float64(interruptions[g]), g.instanceType, g.availabilityZone)
+	}
+
+	// interrupted instances leave the fleet, so they are counted from the
+	// recorded interruptions rather than the current instances
+	recent := map[fleetGroup]int{}
+	for _, i := range c.interruptions {
+		if time.Since(i.observed) <= recentInterruptionWindow {
+			recent[fleetGroup{i.instanceType, i.availabilityZone}]++
+		}
+	}
+	for g, count := range recent {
+		ch <- prometheus.MustNewConstMetric(c.recentInterruptions, prometheus.GaugeValue, float64(count), g.instanceType, g.availabilityZone)
+	}
+
+	instanceHours := map[fleetGroup]float64{}
+	windowInterruptions := map[fleetGroup]int{}
+	for _, sample := range c.samples {
+		for g, hours := range sample.instanceHours {
+			instanceHours[g] += hours
+		}
+		for g, count := range sample.interruptions {
+			windowInterruptions[g] += count
+		}
+	}
+	for g, hours := range instanceHours {
+		if hours > 0 {
+			ch <- prometheus.MustNewConstMetric(c.interruptionRate, prometheus.GaugeValue, float64(windowInterruptions[g])/hours, g.instanceType, g.availabilityZone)
+		}
+	}
+}
+
+// recordInterruptions remembers when the instances marked for interruption
+// were first seen marked, and forgets the instances no longer marked once
+// that is longer ago than the recentInterruptionWindow. The caller must hold
+// c.mu.
+func (c *FleetCollector) recordInterruptions(instances []fleetInstance) {
+	now := time.Now()
+	sample := fleetSample{
+		observed:      now,
+		instanceHours: map[fleetGroup]float64{},
+		interruptions: map[fleetGroup]int{},
+	}
+	// the instances are assumed to have been running since the last poll
+	var elapsed float64
+	if !c.lastPoll.IsZero() {
+		elapsed = now.Sub(c.lastPoll).Hours()
+	}
+	c.lastPoll = now
+
+	marked := map[string]bool{}
+	for _, i := range instances {
+		g := fleetGroup{i.instanceType, i.availabilityZone}
+		sample.instanceHours[g] += elapsed
+		if _, ok := spotStatusActions[i.statusCode]; !ok {
+			continue
+		}
+		marked[i.instanceID] = true
+		if _, ok := c.interruptions[i.instanceID]; !ok {
+			c.interruptions[i.instanceID] = fleetInterruption{instanceType: i.instanceType, availabilityZone: i.availabilityZone, observed: now}
+			// instances already marked at the first poll were interrupted
+			// outside of the observed instance-hours
+			if elapsed > 0 {
+				sample.interruptions[g]++
+			}
+		}
+	}
+	c.samples = append(c.samples, sample)
+	for len(c.samples) > 0 && now.Sub(c.samples[0].observed) > c.rateWindow {
+		c.samples = c.samples[1:]
+	}
+	for id, i := range c.interruptions {
+		if !marked[id] && now.Sub(i.observed) > recentInterruptionWindow {
+			delete(c.interruptions, id)
+		}
+	}
+}
+
+// Run polls the EC2 API every pollInterval until ctx is cancelled. Nothing is
+// exported while Run isn't running.
+func (c *FleetCollector) Run(ctx context.Context) error {
+	cfg, err := config.LoadDefaultConfig(ctx)
+	if err != nil {
+		return err
+	}
+	client := ec2.NewFromConfig(cfg)
+
+	c.mu.Lock()
+	c.running = true
+	c.mu.Unlock()
+	defer func() {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		c.running = false
+		c.instances = nil
+		c.pollSucceeded = false
+		c.samples = nil
+		c.lastPoll = time.Time{}
+	}()
+
+	ticker := time.NewTicker(c.pollInterval)
+	defer ticker.Stop()
+	for {
+		instances, err := c.poll(ctx, client)
+		c.mu.Lock()
+		if err != nil {
+			log.Errorf("Failed to describe fleet instances: %s", err)
+			c.pollSucceeded = false
+		} else {
+			log.Debugf("found %d spot instances in the fleet", len(instances))
+			c.instances = instances
+			c.recordInterruptions(instances)
+			c.pollSucceeded = true
+		}
+		c.mu.Unlock()
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+func (c *FleetCollector) poll(ctx context.Context, client *ec2.Client) ([]fleetInstance, error) {
+	filters := []ec2types.Filter{
+		{Name: aws.String("instance-lifecycle"), Values: []string{"spot"}},
+		{Name: aws.String("instance-state-name"), Values: []string{"pending", "running", "stopping", "stopped"}},
+	}
+	for key, value := range c.tagFilters {
+		filters = append(filters, ec2types.Filter{Name: aws.String("tag:" + key), Values: []string{value}})
+	}
+
+	var instances []fleetInstance
+	requests := map[string]int{}
+	paginator := ec2.NewDescribeInstancesPaginator(client, &ec2.DescribeInstancesInput{Filters: filters})
+	for paginator.HasMorePages() {
+		out, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, err
+		}
+		for _, reservation := range out.Reservations {
+			for _, instance := range reservation.Instances {
+				if instance.SpotInstanceRequestId != nil {
+					requests[aws.ToString(instance.SpotInstanceRequestId)] = len(instances)
+				}
+				az := ""
+				if instance.Placement != nil {
+					az = aws.ToString(instance.Placement.AvailabilityZone)
+				}
+				instances = append(instances, fleetInstance{
+					instanceID:       aws.ToString(instance.InstanceId),
+					instanceType:     string(instance.InstanceType),
+					availabilityZone: az,
+				})
+			}
+		}
+	}
+	if len(requests) == 0 {
+		return instances, nil
+	}
+
+	requestIDs := make([]string, 0, len(requests))
+	for id := range requests {
+		requestIDs = append(requestIDs, id)
+	}
+	// DescribeSpotInstanceRequests doesn't paginate when request ids are given,
+	// so look them up in batches.
+	for start := 0; start < len(requestIDs); start += 100 {
+		end := min(start+100, len(requestIDs))
+		out, err := client.DescribeSpotInstanceRequests(ctx, &ec2.DescribeSpotInstanceRequestsInput{
+			SpotInstanceRequestIds: requestIDs[start:end],
+		})
+		if err != nil {
+			return nil, fmt.Errorf("describe spot instance requests: %w", err)
+		}
+		for _, request := range out.SpotInstanceRequests {
+			if request.Status == nil {
+				continue
+			}
+			if i, ok := requests[aws.ToString(request.SpotInstanceRequestId)]; ok {
+				instances[i].statusCode = aws.ToString(request.Status.Code)
+			}
+		}
+	}
+	return instances, nil
+}
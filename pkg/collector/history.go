@@ -0,0 +1,75 @@
+package collector
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/gjtempleton/spot-termination-exporter/pkg/imds"
+	"github.com/gjtempleton/spot-termination-exporter/pkg/provider"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// MaintenanceHistoryCollector exports the number of past maintenance events
+// of the instance per code and state, giving a per-node audit of provider
+// initiated events.
+type MaintenanceHistoryCollector struct {
+	provider provider.Provider
+	history  provider.MaintenanceHistoryProvider
+
+	mu     sync.RWMutex
+	events *prometheus.Desc
+}
+
+// NewMaintenanceHistoryCollector returns a MaintenanceHistoryCollector reading
+// the identity from p and the events from history, usually the same provider. nodeLabels are attached to every metric as constant labels.
+func NewMaintenanceHistoryCollector(p provider.Provider, history provider.MaintenanceHistoryProvider, nodeLabels prometheus.Labels) *MaintenanceHistoryCollector {
+	c := &MaintenanceHistoryCollector{
+		provider: p,
+		history:  history,
+	}
+	c.SetNodeLabels(nodeLabels)
+	return c
+}
+
+// SetNodeLabels replaces the constant labels attached to every metric, e.g.
+// after the labels of the node changed.
+func (c *MaintenanceHistoryCollector) SetNodeLabels(nodeLabels prometheus.Labels) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.events = prometheus.NewDesc("aws_instance_maintenance_events_history_total", "Past maintenance events of the instance", []string{"code", "state", "instance_id"}, nodeLabels)
+}
+
+// Describe sends no descriptors, making this an unchecked collector, as the
+// node labels attached to the descriptors can change at runtime.
+func (c *MaintenanceHistoryCollector) Describe(ch chan<- *prometheus.Desc) {
+}
+
+func (c *MaintenanceHistoryCollector) Collect(ch chan<- prometheus.Metric) {
+	c.mu.RLock()
+	desc := c.events
+	c.mu.RUnlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	identity, err := c.provider.GetInstanceIdentity(ctx)
+	if err != nil {
+		imds.WithError(err).Error("couldn't fetch instance identity")
+		return
+	}
+	events, err := c.history.GetMaintenanceHistory(ctx)
+	if err != nil {
+		imds.WithError(err).Error("Failed to fetch maintenance event history from metadata service")
+		return
+	}
+
+	type key struct{ code, state string }
+	counts := map[key]int{}
+	for _, event := range events {
+		counts[key{event.Code, event.State}]++
+	}
+	for k, count := range counts {
+		ch <- prometheus.MustNewConstMetric(desc, prometheus.CounterValue, float64(count), k.code, k.state, identity.InstanceID)
+	}
+}
@@ -0,0 +1,180 @@
+package collector
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	ec2types "github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	"github.com/gjtempleton/spot-termination-exporter/pkg/imds"
+	"github.com/gjtempleton/spot-termination-exporter/pkg/provider"
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+)
+
+// InstanceInfoCollector exports details of the instance which the metadata
+// service doesn't provide, read from the EC2 API. They rarely change, so they
+// are cached rather than fetched on every scrape, until the instance is
+// restarted.
+type InstanceInfoCollector struct {
+	provider provider.Provider
+	cacheTTL time.Duration
+
+	mu        sync.Mutex
+	details   *instanceDetails
+	cachedAt  time.Time
+	cachedFor *provider.InstanceIdentity
+	descs     instanceInfoDescs
+}
+
+// instanceDetails holds the description of the instance and, for spot
+// instances, of its spot request.
+type instanceDetails struct {
+	instance    ec2types.Instance
+	spotRequest *ec2types.SpotInstanceRequest
+}
+
+type instanceInfoDescs struct {
+	capacityReservation *prometheus.Desc
+	marketInfo          *prometheus.Desc
+	spotBlockRemaining  *prometheus.Desc
+}
+
+// NewInstanceInfoCollector returns an InstanceInfoCollector for the instance p
+// belongs to. nodeLabels are attached to every metric as constant labels.
+func NewInstanceInfoCollector(p provider.Provider, cacheTTL time.Duration, nodeLabels prometheus.Labels) *InstanceInfoCollector {
+	return &InstanceInfoCollector{
+		provider: p,
+		cacheTTL: cacheTTL,
+		descs:    newInstanceInfoDescs(nodeLabels),
+	}
+}
+
+func newInstanceInfoDescs(nodeLabels prometheus.Labels) instanceInfoDescs {
+	return instanceInfoDescs{
+		capacityReservation: prometheus.NewDesc("aws_instance_capacity_reservation_info", "Capacity reservation or capacity block the instance runs in, type is none outside of one", []string{"instance_id", "type", "capacity_reservation_id", "capacity_block_id"}, nodeLabels),
+		marketInfo:          prometheus.NewDesc("aws_instance_market_info", "Market options of the instance", []string{"instance_id", "market_type", "interruption_behavior", "tenancy"}, nodeLabels),
+		spotBlockRemaining:  prometheus.NewDesc("aws_instance_spot_block_remaining_seconds", "Time left until the end of the defined duration of a spot block", []string{"instance_id"}, nodeLabels),
+	}
+}
+
+// SetNodeLabels replaces the constant labels attached to every metric, e.g.
+// after the labels of the node changed.
+func (c *InstanceInfoCollector) SetNodeLabels(nodeLabels prometheus.Labels) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.descs = newInstanceInfoDescs(nodeLabels)
+}
+
+// Describe sends no descriptors, making this an unchecked collector, as the
+// node labels attached to the descriptors can change at runtime.
+func (c *InstanceInfoCollector) Describe(ch chan<- *prometheus.Desc) {
+}
+
+func (c *InstanceInfoCollector) Collect(ch chan<- prometheus.Metric) {
+	log.Debug("Fetching instance details")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	identity, err := c.provider.GetInstanceIdentity(ctx)
+	if err != nil {
+		imds.WithError(err).Error("couldn't fetch instance identity")
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.cachedFor != nil && !identity.SameRun(c.cachedFor) {
+		// e.g. the launch time changed after a stop and start
+		log.Infof("instance %s was restarted, refreshing its details", identity.InstanceID)
+		c.details = nil
+		c.cachedAt = time.Time{}
+	}
+	if time.Since(c.cachedAt) > c.cacheTTL {
+		details, err := c.fetchDetails(ctx, identity)
+		if err != nil {
+			log.Errorf("couldn't describe instance %s: %s", identity.InstanceID, err)
+		} else {
+			c.details = details
+			c.cachedAt = time.Now()
+		}
+	}
+	c.cachedFor = identity
+	if c.details == nil {
+		return
+	}
+	instance := c.details.instance
+
+	reservationType := "none"
+	switch {
+	case instance.InstanceLifecycle == ec2types.InstanceLifecycleTypeCapacityBlock || instance.CapacityBlockId != nil:
+		reservationType = "capacity-block"
+	case instance.CapacityReservationId != nil:
+		reservationType = "on-demand"
+	}
+	ch <- prometheus.MustNewConstMetric(c.descs.capacityReservation, prometheus.GaugeValue, 1,
+		identity.InstanceID, reservationType, aws.ToString(instance.CapacityReservationId), aws.ToString(instance.CapacityBlockId))
+
+	marketType := string(instance.InstanceLifecycle)
+	if marketType == "" {
+		marketType = "on-demand"
+	}
+	interruptionBehavior := ""
+	if c.details.spotRequest != nil {
+		interruptionBehavior = string(c.details.spotRequest.InstanceInterruptionBehavior)
+	}
+	tenancy := ""
+	if instance.Placement != nil {
+		tenancy = string(instance.Placement.Tenancy)
+	}
+	ch <- prometheus.MustNewConstMetric(c.descs.marketInfo, prometheus.GaugeValue, 1, identity.InstanceID, marketType, interruptionBehavior, tenancy)
+
+	if spotRequest := c.details.spotRequest; spotRequest != nil && spotRequest.BlockDurationMinutes != nil && instance.LaunchTime != nil {
+		end := instance.LaunchTime.Add(time.Duration(*spotRequest.BlockDurationMinutes) * time.Minute)
+		if remaining := time.Until(end); remaining > 0 {
+			ch <- prometheus.MustNewConstMetric(c.descs.spotBlockRemaining, prometheus.GaugeValue, remaining.Seconds(), identity.InstanceID)
+		}
+	}
+}
+
+func (c *InstanceInfoCollector) fetchDetails(ctx context.Context, identity *provider.InstanceIdentity) (*instanceDetails, error) {
+	cfg, err := config.LoadDefaultConfig(ctx, config.WithRegion(identity.Region))
+	if err != nil {
+		return nil, err
+	}
+	client := ec2.NewFromConfig(cfg)
+	out, err := client.DescribeInstances(ctx, &ec2.DescribeInstancesInput{
+		InstanceIds: []string{identity.InstanceID},
+	})
+	if err != nil {
+		return nil, err
+	}
+	var details *instanceDetails
+	for _, reservation := range out.Reservations {
+		for _, instance := range reservation.Instances {
+			details = &instanceDetails{instance: instance}
+		}
+	}
+	if details == nil {
+		return nil, fmt.Errorf("instance not found")
+	}
+
+	if details.instance.SpotInstanceRequestId != nil {
+		requests, err := client.DescribeSpotInstanceRequests(ctx, &ec2.DescribeSpotInstanceRequestsInput{
+			SpotInstanceRequestIds: []string{*details.instance.SpotInstanceRequestId},
+		})
+		if err != nil {
+			return nil, fmt.Errorf("describe spot request: %w", err)
+		}
+		if len(requests.SpotInstanceRequests) > 0 {
+			details.spotRequest = &requests.SpotInstanceRequests[0]
+		}
+	}
+	return details, nil
+}
@@ -0,0 +1,45 @@
+package collector
+
+// ReservedLabelNames are the variable labels of the metrics node labels are
+// attached to. Node labels must not be exported under these names, as a
+// constant label colliding with a variable one makes the metric invalid.
+var ReservedLabelNames = map[string]bool{
+	"action":                  true,
+	"architecture":            true,
+	"availability_zone":       true,
+	"capacity_block_id":       true,
+	"capacity_reservation_id": true,
+	"code":                    true,
+	"collector":               true,
+	"device_number":           true,
+	"effect":                  true,
+	"endpoint":                true,
+	"event_id":                true,
+	"event_type":              true,
+	"image_id":                true,
+	"instance_action":         true,
+	"instance_id":             true,
+	"instance_type":           true,
+	"interface_id":            true,
+	"interruption_behavior":   true,
+	"kernel_id":               true,
+	"key":                     true,
+	"lifecycle_state":         true,
+	"mac":                     true,
+	"market_type":             true,
+	"namespace":               true,
+	"node":                    true,
+	"nodegroup":               true,
+	"owner_kind":              true,
+	"poddisruptionbudget":     true,
+	"private_ip":              true,
+	"region":                  true,
+	"state":                   true,
+	"status":                  true,
+	"subnet_id":               true,
+	"tenancy":                 true,
+	"type":                    true,
+	"value":                   true,
+	"virtualization_type":     true,
+	"vpc_id":                  true,
+}
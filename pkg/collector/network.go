@@ -0,0 +1,88 @@
+package collector
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/gjtempleton/spot-termination-exporter/pkg/imds"
+	"github.com/gjtempleton/spot-termination-exporter/pkg/provider"
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+)
+
+// NetworkInfoCollector exports the network interfaces attached to the
+// instance, so interruptions can be correlated with network-scoped resources
+// such as interfaces to clean up or addresses to remove from allowlists.
+// Interfaces can be attached at any time, e.g. by a CNI plugin, so they are
+// cached for cacheTTL rather than until the instance is restarted.
+type NetworkInfoCollector struct {
+	provider   provider.Provider
+	interfaces provider.NetworkInterfacesProvider
+	cacheTTL   time.Duration
+
+	mu       sync.Mutex
+	cached   []provider.NetworkInterface
+	cachedAt time.Time
+	desc     *prometheus.Desc
+}
+
+// NewNetworkInfoCollector returns a NetworkInfoCollector reading the
+// interfaces of the instance p belongs to from interfaces. nodeLabels are
+// attached to every metric as constant labels.
+func NewNetworkInfoCollector(p provider.Provider, interfaces provider.NetworkInterfacesProvider, cacheTTL time.Duration, nodeLabels prometheus.Labels) *NetworkInfoCollector {
+	return &NetworkInfoCollector{
+		provider:   p,
+		interfaces: interfaces,
+		cacheTTL:   cacheTTL,
+		desc:       newNetworkInfoDesc(nodeLabels),
+	}
+}
+
+func newNetworkInfoDesc(nodeLabels prometheus.Labels) *prometheus.Desc {
+	return prometheus.NewDesc("aws_instance_network_info", "Network interface attached to the instance", []string{"instance_id", "interface_id", "device_number", "mac", "private_ip", "subnet_id", "vpc_id"}, nodeLabels)
+}
+
+// SetNodeLabels replaces the constant labels attached to every metric, e.g.
+// after the labels of the node changed.
+func (c *NetworkInfoCollector) SetNodeLabels(nodeLabels prometheus.Labels) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.desc = newNetworkInfoDesc(nodeLabels)
+}
+
+// Describe sends no descriptors, making this an unchecked collector, as the
+// node labels attached to the descriptors can change at runtime.
+func (c *NetworkInfoCollector) Describe(ch chan<- *prometheus.Desc) {
+}
+
+func (c *NetworkInfoCollector) Collect(ch chan<- prometheus.Metric) {
+	log.Debug("Fetching network interfaces")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	identity, err := c.provider.GetInstanceIdentity(ctx)
+	if err != nil {
+		imds.WithError(err).Error("couldn't fetch instance identity")
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if time.Since(c.cachedAt) > c.cacheTTL {
+		interfaces, err := c.interfaces.GetNetworkInterfaces(ctx)
+		if err != nil {
+			// the interfaces last read are kept, as they rarely change
+			imds.WithError(err).Error("couldn't fetch network interfaces")
+		} else {
+			c.cached = interfaces
+			c.cachedAt = time.Now()
+		}
+	}
+	for _, networkInterface := range c.cached {
+		ch <- prometheus.MustNewConstMetric(c.desc, prometheus.GaugeValue, 1, identity.InstanceID,
+			networkInterface.ID, networkInterface.DeviceNumber, networkInterface.MAC, networkInterface.PrivateIP, networkInterface.SubnetID, networkInterface.VPCID)
+	}
+}
@@ -0,0 +1,55 @@
+package collector
+
+import (
+	"context"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	ec2types "github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	"github.com/gjtempleton/spot-termination-exporter/pkg/provider"
+	log "github.com/sirupsen/logrus"
+)
+
+// NodegroupTag is the tag EKS sets on the instances of a managed node group.
+const NodegroupTag = "eks:nodegroup-name"
+
+// ResolveNodegroup returns the EKS managed node group the instance p belongs
+// to, from its eks:nodegroup-name tag, or "" if the instance isn't tagged.
+// The tag is read from the metadata service when instance tags are exposed
+// there, and otherwise with ec2:DescribeTags.
+func ResolveNodegroup(ctx context.Context, p provider.Provider) (string, error) {
+	identity, err := p.GetInstanceIdentity(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	if getter, ok := p.(provider.MetadataGetter); ok {
+		body, found, err := getter.GetMetadata(ctx, "tags/instance/"+NodegroupTag)
+		if err == nil && found {
+			return strings.TrimSpace(string(body)), nil
+		}
+		if err != nil {
+			log.WithError(err).Debug("couldn't read the node group tag from the metadata service")
+		}
+	}
+
+	cfg, err := config.LoadDefaultConfig(ctx, config.WithRegion(identity.Region))
+	if err != nil {
+		return "", err
+	}
+	out, err := ec2.NewFromConfig(cfg).DescribeTags(ctx, &ec2.DescribeTagsInput{
+		Filters: []ec2types.Filter{
+			{Name: aws.String("resource-id"), Values: []string{identity.InstanceID}},
+			{Name: aws.String("key"), Values: []string{NodegroupTag}},
+		},
+	})
+	if err != nil {
+		return "", err
+	}
+	for _, tag := range out.Tags {
+		return aws.ToString(tag.Value), nil
+	}
+	return "", nil
+}
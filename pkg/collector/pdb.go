@@ -0,0 +1,120 @@
+package collector
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/gjtempleton/spot-termination-exporter/pkg/imds"
+	"github.com/gjtempleton/spot-termination-exporter/pkg/provider"
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+	policyv1 "k8s.io/api/policy/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+// PDBLister lists the PodDisruptionBudgets of all namespaces.
+type PDBLister func(ctx context.Context) ([]policyv1.PodDisruptionBudget, error)
+
+// PDBCollector exports, while a termination notice is pending, how many pods
+// on the node each PodDisruptionBudget would prevent from being evicted, so
+// teams learn which budgets block a clean drain within the notice period.
+// Nothing is exported until SetNodeName is called.
+type PDBCollector struct {
+	provider provider.Provider
+	listPods PodLister
+	listPDBs PDBLister
+
+	mu         sync.RWMutex
+	nodeName   string
+	pdbBlocked *prometheus.Desc
+}
+
+// NewPDBCollector returns a PDBCollector reading notices from p, pods from
+// listPods and budgets from listPDBs. nodeLabels are attached to every metric
+// as constant labels.
+func NewPDBCollector(p provider.Provider, listPods PodLister, listPDBs PDBLister, nodeLabels prometheus.Labels) *PDBCollector {
+	c := &PDBCollector{
+		provider: p,
+		listPods: listPods,
+		listPDBs: listPDBs,
+	}
+	c.SetNodeLabels(nodeLabels)
+	return c
+}
+
+// SetNodeName sets the node whose pods are evaluated.
+func (c *PDBCollector) SetNodeName(nodeName string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.nodeName = nodeName
+}
+
+// SetNodeLabels replaces the constant labels attached to every metric, e.g.
+// after the labels of the node changed.
+func (c *PDBCollector) SetNodeLabels(nodeLabels prometheus.Labels) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.pdbBlocked = prometheus.NewDesc("aws_instance_interruption_pdb_blocked", "Pods on the node the PodDisruptionBudget would prevent from being evicted while a termination notice is pending", []string{"namespace", "poddisruptionbudget"}, nodeLabels)
+}
+
+// Describe sends no descriptors, making this an unchecked collector, as the
+// node labels attached to the descriptors can change at runtime.
+func (c *PDBCollector) Describe(ch chan<- *prometheus.Desc) {
+}
+
+func (c *PDBCollector) Collect(ch chan<- prometheus.Metric) {
+	c.mu.RLock()
+	nodeName, desc := c.nodeName, c.pdbBlocked
+	c.mu.RUnlock()
+	if nodeName == "" {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	notice, err := c.provider.GetTerminationNotice(ctx)
+	if err != nil {
+		imds.WithError(err).Error("Failed to fetch termination notice")
+		return
+	}
+	if notice == nil {
+		return
+	}
+
+	pods, err := c.listPods(ctx, nodeName)
+	if err != nil {
+		log.WithError(err).Error("Failed to list pods on the node")
+		return
+	}
+	pdbs, err := c.listPDBs(ctx)
+	if err != nil {
+		log.WithError(err).Error("Failed to list PodDisruptionBudgets")
+		return
+	}
+
+	for _, pdb := range pdbs {
+		selector, err := metav1.LabelSelectorAsSelector(pdb.Spec.Selector)
+		if err != nil {
+			log.WithError(err).Warnf("invalid selector of PodDisruptionBudget %s/%s", pdb.Namespace, pdb.Name)
+			continue
+		}
+		matched := 0
+		for _, pod := range pods {
+			if pod.Namespace != pdb.Namespace || pod.Status.Phase != corev1.PodRunning {
+				continue
+			}
+			if selector.Matches(labels.Set(pod.Labels)) {
+				matched++
+			}
+		}
+		if matched == 0 {
+			continue
+		}
+		blocked := max(matched-int(pdb.Status.DisruptionsAllowed), 0)
+		ch <- prometheus.MustNewConstMetric(desc, prometheus.GaugeValue, float64(blocked), pdb.Namespace, pdb.Name)
+	}
+}
@@ -0,0 +1,116 @@
+package collector
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+)
+
+// PlacementScoreCollector exports spot placement scores for a configured set
+// of instance types. It doesn't depend on the local instance metadata, so it
+// is meant to run in a single central deployment rather than on every node.
+type PlacementScoreCollector struct {
+	instanceTypes  []string
+	regions        []string
+	targetCapacity int32
+	singleAZ       bool
+	cacheTTL       time.Duration
+
+	mu       sync.Mutex
+	scores   []placementScore
+	cachedAt time.Time
+
+	placementScore *prometheus.Desc
+}
+
+type placementScore struct {
+	region             string
+	availabilityZoneID string
+	score              float64
+}
+
+// NewPlacementScoreCollector returns a PlacementScoreCollector for the given
+// instance types and regions, all regions being scored when regions is empty.
+func NewPlacementScoreCollector(
+	instanceTypes,
+	regions []string,
+	targetCapacity int32,
+	singleAZ bool,
+	cacheTTL time.Duration,
+) *PlacementScoreCollector {
+	return &PlacementScoreCollector{
+		instanceTypes:  instanceTypes,
+		regions:        regions,
+		targetCapacity: targetCapacity,
+		singleAZ:       singleAZ,
+		cacheTTL:       cacheTTL,
+		placementScore: prometheus.NewDesc("aws_spot_placement_score", "Likelihood from 1 to 10 that a spot request for the configured instance types would succeed", []string{"instance_types", "region", "availability_zone_id"}, nil),
+	}
+}
+
+func (c *PlacementScoreCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.placementScore
+}
+
+func (c *PlacementScoreCollector) Collect(ch chan<- prometheus.Metric) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	// GetSpotPlacementScores is heavily rate limited, so scores are only
+	// refreshed once the cache has expired.
+	if time.Since(c.cachedAt) > c.cacheTTL {
+		log.Debug("Fetching spot placement scores")
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+
+		scores, err := c.fetchScores(ctx)
+		if err != nil {
+			log.Errorf("couldn't fetch spot placement scores: %s", err)
+		} else {
+			c.scores = scores
+			c.cachedAt = time.Now()
+		}
+	}
+
+	instanceTypes := strings.Join(c.instanceTypes, ",")
+	for _, s := range c.scores {
+		ch <- prometheus.MustNewConstMetric(c.placementScore, prometheus.GaugeValue, s.score, instanceTypes, s.region, s.availabilityZoneID)
+	}
+}
+
+func (c *PlacementScoreCollector) fetchScores(ctx context.Context) ([]placementScore, error) {
+	cfg, err := config.LoadDefaultConfig(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	paginator := ec2.NewGetSpotPlacementScoresPaginator(ec2.NewFromConfig(cfg), &ec2.GetSpotPlacementScoresInput{
+		InstanceTypes:          c.instanceTypes,
+		RegionNames:            c.regions,
+		TargetCapacity:         aws.Int32(c.targetCapacity),
+		SingleAvailabilityZone: aws.Bool(c.singleAZ),
+	})
+
+	var scores []placementScore
+	for paginator.HasMorePages() {
+		out, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, err
+		}
+		for _, s := range out.SpotPlacementScores {
+			scores = append(scores, placementScore{
+				region:             aws.ToString(s.Region),
+				availabilityZoneID: aws.ToString(s.AvailabilityZoneId),
+				score:              float64(aws.ToInt32(s.Score)),
+			})
+		}
+	}
+	return scores, nil
+}
@@ -0,0 +1,125 @@
+package collector
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/gjtempleton/spot-termination-exporter/pkg/imds"
+	"github.com/gjtempleton/spot-termination-exporter/pkg/provider"
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+)
+
+// PodLister lists the pods scheduled on a node.
+type PodLister func(ctx context.Context, nodeName string) ([]corev1.Pod, error)
+
+// AffectedPodsCollector exports the number of pods running on the node while
+// a termination notice is pending, so on-call can see the blast radius of an
+// interruption. Nothing is exported until SetNodeName is called.
+type AffectedPodsCollector struct {
+	provider    provider.Provider
+	listPods    PodLister
+	byOwnerKind bool
+
+	mu           sync.RWMutex
+	nodeName     string
+	affectedPods *prometheus.Desc
+}
+
+// NewAffectedPodsCollector returns an AffectedPodsCollector reading notices
+// from p and pods from listPods. With byOwnerKind the pods are additionally
+// counted per kind of their controlling owner. nodeLabels are attached to
+// every metric as constant labels.
+func NewAffectedPodsCollector(p provider.Provider, listPods PodLister, byOwnerKind bool, nodeLabels prometheus.Labels) *AffectedPodsCollector {
+	c := &AffectedPodsCollector{
+		provider:    p,
+		listPods:    listPods,
+		byOwnerKind: byOwnerKind,
+	}
+	c.SetNodeLabels(nodeLabels)
+	return c
+}
+
+// SetNodeName sets the node whose pods are counted.
+func (c *AffectedPodsCollector) SetNodeName(nodeName string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.nodeName = nodeName
+}
+
+// SetNodeLabels replaces the constant labels attached to every metric, e.g.
+// after the labels of the node changed.
+func (c *AffectedPodsCollector) SetNodeLabels(nodeLabels prometheus.Labels) {
+	labels := []string{"namespace"}
+	if c.byOwnerKind {
+		labels = append(labels, "owner_kind")
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.affectedPods = prometheus.NewDesc("aws_instance_interruption_affected_pods", "Pods running on the node while a termination notice is pending", labels, nodeLabels)
+}
+
+// Describe sends no descriptors, making this an unchecked collector, as the
+// node labels attached to the descriptors can change at runtime.
+func (c *AffectedPodsCollector) Describe(ch chan<- *prometheus.Desc) {
+}
+
+func (c *AffectedPodsCollector) Collect(ch chan<- prometheus.Metric) {
+	c.mu.RLock()
+	nodeName, desc := c.nodeName, c.affectedPods
+	c.mu.RUnlock()
+	if nodeName == "" {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	notice, err := c.provider.GetTerminationNotice(ctx)
+	if err != nil {
+		imds.WithError(err).Error("Failed to fetch termination notice")
+		return
+	}
+	if notice == nil {
+		return
+	}
+
+	pods, err := c.listPods(ctx, nodeName)
+	if err != nil {
+		log.WithError(err).Error("Failed to list pods affected by the interruption")
+		return
+	}
+
+	type key struct{ namespace, ownerKind string }
+	counts := map[key]int{}
+	for _, pod := range pods {
+		if pod.Status.Phase == corev1.PodSucceeded || pod.Status.Phase == corev1.PodFailed {
+			continue
+		}
+		k := key{namespace: pod.Namespace}
+		if c.byOwnerKind {
+			k.ownerKind = ownerKind(pod)
+		}
+		counts[k]++
+	}
+	for k, count := range counts {
+		labels := []string{k.namespace}
+		if c.byOwnerKind {
+			labels = append(labels, k.ownerKind)
+		}
+		ch <- prometheus.MustNewConstMetric(desc, prometheus.GaugeValue, float64(count), labels...)
+	}
+}
+
+// ownerKind returns the kind of the controlling owner of pod, or an empty
+// string for bare pods.
+func ownerKind(pod corev1.Pod) string {
+	for _, owner := range pod.OwnerReferences {
+		if owner.Controller != nil && *owner.Controller {
+			return owner.Kind
+		}
+	}
+	return ""
+}
@@ -0,0 +1,264 @@
+package collector
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	ec2types "github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	"github.com/aws/aws-sdk-go-v2/service/pricing"
+	pricingtypes "github.com/aws/aws-sdk-go-v2/service/pricing/types"
+	"github.com/gjtempleton/spot-termination-exporter/pkg/imds"
+	"github.com/gjtempleton/spot-termination-exporter/pkg/provider"
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// minPriceBackoff and maxPriceBackoff bound the time to wait before
+	// fetching a price again after failing to, e.g. as the permission to is
+	// missing.
+	minPriceBackoff = time.Minute
+	maxPriceBackoff = 30 * time.Minute
+)
+
+// SavingsCollector exports the on-demand and current spot price of the
+// instance type along with the ratio saved by running on spot. Prices change
+// rarely, so they are cached rather than fetched on every scrape. The savings
+// are also accumulated over the uptime of the exporter.
+type SavingsCollector struct {
+	provider         provider.Provider
+	pricingRegion    string
+	onDemandCacheTTL time.Duration
+	spotCacheTTL     time.Duration
+	pricing          *pricing.Client
+	ec2              *ec2.Client
+
+	mu               sync.Mutex
+	onDemandPrice    float64
+	onDemandCachedAt time.Time
+	onDemandBackoff  priceBackoff
+	spotPrice        float64
+	spotCachedAt     time.Time
+	spotBackoff      priceBackoff
+	pricedFor        *provider.InstanceIdentity
+	savedDollars     float64
+	accruedUntil     time.Time
+	descs            savingsDescs
+}
+
+// priceBackoff is the time to wait before fetching a price again after the
+// last fetch failed, doubling with each further failure.
+type priceBackoff struct {
+	retryAt time.Time
+	backoff time.Duration
+}
+
+// waiting tells whether the price isn't to be fetched again yet.
+func (b *priceBackoff) waiting() bool {
+	return time.Now().Before(b.retryAt)
+}
+
+// failed records a failed fetch, returning the time to wait before the next.
+func (b *priceBackoff) failed() time.Duration {
+	b.backoff = min(max(2*b.backoff, minPriceBackoff), maxPriceBackoff)
+	b.retryAt = time.Now().Add(b.backoff)
+	return b.backoff
+}
+
+type savingsDescs struct {
+	onDemandPriceDesc *prometheus.Desc
+	spotPriceDesc     *prometheus.Desc
+	savingsRatio      *prometheus.Desc
+	estimatedSavings  *prometheus.Desc
+}
+
+type priceListItem struct {
+	Terms struct {
+		OnDemand map[string]struct {
+			PriceDimensions map[string]struct {
+				Unit         string            `json:"unit"`
+				PricePerUnit map[string]string `json:"pricePerUnit"`
+			} `json:"priceDimensions"`
+		} `json:"OnDemand"`
+	} `json:"terms"`
+}
+
+// NewSavingsCollector returns a SavingsCollector for the instance p belongs
+// to, querying the Pricing API in pricingRegion.
+func NewSavingsCollector(
+	p provider.Provider,
+	pricingRegion string,
+	onDemandCacheTTL,
+	spotCacheTTL time.Duration,
+	nodeLabels prometheus.Labels,
+) (*SavingsCollector, error) {
+	cfg, err := config.LoadDefaultConfig(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	return &SavingsCollector{
+		provider:         p,
+		pricingRegion:    pricingRegion,
+		onDemandCacheTTL: onDemandCacheTTL,
+		spotCacheTTL:     spotCacheTTL,
+		pricing:          pricing.NewFromConfig(cfg, func(o *pricing.Options) { o.Region = pricingRegion }),
+		ec2:              ec2.NewFromConfig(cfg),
+		accruedUntil:     time.Now(),
+		descs:            newSavingsDescs(nodeLabels),
+	}, nil
+}
+
+func newSavingsDescs(nodeLabels prometheus.Labels) savingsDescs {
+	return savingsDescs{
+		onDemandPriceDesc: prometheus.NewDesc("aws_instance_on_demand_price_dollars_per_hour", "On-demand price of the instance type in USD per hour", []string{"instance_id", "instance_type", "region"}, nodeLabels),
+		spotPriceDesc:     prometheus.NewDesc("aws_instance_spot_price_dollars_per_hour", "Current spot price of the instance type in USD per hour", []string{"instance_id", "instance_type", "availability_zone"}, nodeLabels),
+		savingsRatio:      prometheus.NewDesc("aws_instance_spot_savings_ratio", "Ratio of the on-demand price saved by running on spot", []string{"instance_id", "instance_type"}, nodeLabels),
+		estimatedSavings:  prometheus.NewDesc("aws_instance_estimated_savings_dollars_total", "Estimated USD saved by running on spot rather than on-demand since the exporter started", []string{"instance_id", "instance_type"}, nodeLabels),
+	}
+}
+
+// SetNodeLabels replaces the constant labels attached to every metric, e.g.
+// after the labels of the node changed.
+func (c *SavingsCollector) SetNodeLabels(nodeLabels prometheus.Labels) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.descs = newSavingsDescs(nodeLabels)
+}
+
+// Describe sends no descriptors, making this an unchecked collector, as the
+// node labels attached to the descriptors can change at runtime.
+func (c *SavingsCollector) Describe(ch chan<- *prometheus.Desc) {
+}
+
+func (c *SavingsCollector) Collect(ch chan<- prometheus.Metric) {
+	log.Debug("Fetching price data")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	identity, err := c.provider.GetInstanceIdentity(ctx)
+	if err != nil {
+		imds.WithError(err).Error("couldn't fetch instance identity")
+		return
+	}
+	instanceID := identity.InstanceID
+	instanceType := identity.InstanceType
+	region := identity.Region
+	az := identity.AvailabilityZone
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.pricedFor != nil && !identity.SameRun(c.pricedFor) {
+		// the instance type may have changed while the instance was stopped
+		c.onDemandCachedAt = time.Time{}
+		c.spotCachedAt = time.Time{}
+		c.onDemandBackoff = priceBackoff{}
+		c.spotBackoff = priceBackoff{}
+		// nothing is saved while the instance is stopped or hibernated
+		if identity.PendingTime.After(c.accruedUntil) {
+			c.accruedUntil = identity.PendingTime
+		}
+	}
+	c.pricedFor = identity
+
+	if time.Since(c.onDemandCachedAt) > c.onDemandCacheTTL && !c.onDemandBackoff.waiting() {
+		price, err := c.fetchOnDemandPrice(ctx, instanceType, region)
+		if err != nil {
+			log.Errorf("couldn't fetch on-demand price for %s, retrying in %s: %s", instanceType, c.onDemandBackoff.failed(), err)
+		} else {
+			c.onDemandPrice = price
+			c.onDemandCachedAt = time.Now()
+			c.onDemandBackoff = priceBackoff{}
+		}
+	}
+	if time.Since(c.spotCachedAt) > c.spotCacheTTL && !c.spotBackoff.waiting() {
+		price, err := c.fetchSpotPrice(ctx, instanceType, region, az)
+		if err != nil {
+			log.Errorf("couldn't fetch spot price for %s, retrying in %s: %s", instanceType, c.spotBackoff.failed(), err)
+		} else {
+			c.spotPrice = price
+			c.spotCachedAt = time.Now()
+			c.spotBackoff = priceBackoff{}
+		}
+	}
+
+	if c.onDemandCachedAt.IsZero() {
+		return
+	}
+	ch <- prometheus.MustNewConstMetric(c.descs.onDemandPriceDesc, prometheus.GaugeValue, c.onDemandPrice, instanceID, instanceType, region)
+	if c.spotCachedAt.IsZero() {
+		return
+	}
+	ch <- prometheus.MustNewConstMetric(c.descs.spotPriceDesc, prometheus.GaugeValue, c.spotPrice, instanceID, instanceType, az)
+	if c.onDemandPrice > 0 {
+		ch <- prometheus.MustNewConstMetric(c.descs.savingsRatio, prometheus.GaugeValue, 1-c.spotPrice/c.onDemandPrice, instanceID, instanceType)
+	}
+
+	// accrue the savings since the last scrape at the current prices, never
+	// letting the counter decrease should spot cost more than on-demand
+	now := time.Now()
+	c.savedDollars += max(c.onDemandPrice-c.spotPrice, 0) * now.Sub(c.accruedUntil).Hours()
+	c.accruedUntil = now
+	ch <- prometheus.MustNewConstMetric(c.descs.estimatedSavings, prometheus.CounterValue, c.savedDollars, instanceID, instanceType)
+}
+
+func (c *SavingsCollector) fetchOnDemandPrice(ctx context.Context, instanceType, region string) (float64, error) {
+	filter := func(field, value string) pricingtypes.Filter {
+		return pricingtypes.Filter{Type: pricingtypes.FilterTypeTermMatch, Field: aws.String(field), Value: aws.String(value)}
+	}
+	out, err := c.pricing.GetProducts(ctx, &pricing.GetProductsInput{
+		ServiceCode: aws.String("AmazonEC2"),
+		Filters: []pricingtypes.Filter{
+			filter("instanceType", instanceType),
+			filter("regionCode", region),
+			filter("operatingSystem", "Linux"),
+			filter("tenancy", "Shared"),
+			filter("preInstalledSw", "NA"),
+			filter("capacitystatus", "Used"),
+		},
+		MaxResults: aws.Int32(1),
+	})
+	if err != nil {
+		return 0, err
+	}
+	if len(out.PriceList) == 0 {
+		return 0, fmt.Errorf("no price list found")
+	}
+
+	var item priceListItem
+	if err := json.Unmarshal([]byte(out.PriceList[0]), &item); err != nil {
+		return 0, err
+	}
+	for _, term := range item.Terms.OnDemand {
+		for _, dimension := range term.PriceDimensions {
+			if usd, ok := dimension.PricePerUnit["USD"]; ok && dimension.Unit == "Hrs" {
+				return strconv.ParseFloat(usd, 64)
+			}
+		}
+	}
+	return 0, fmt.Errorf("no hourly USD price found")
+}
+
+func (c *SavingsCollector) fetchSpotPrice(ctx context.Context, instanceType, region, az string) (float64, error) {
+	out, err := c.ec2.DescribeSpotPriceHistory(ctx, &ec2.DescribeSpotPriceHistoryInput{
+		AvailabilityZone:    aws.String(az),
+		InstanceTypes:       []ec2types.InstanceType{ec2types.InstanceType(instanceType)},
+		ProductDescriptions: []string{"Linux/UNIX"},
+		StartTime:           aws.Time(time.Now()),
+	}, func(o *ec2.Options) { o.Region = region })
+	if err != nil {
+		return 0, err
+	}
+	if len(out.SpotPriceHistory) == 0 {
+		return 0, fmt.Errorf("no spot price history found")
+	}
+	return strconv.ParseFloat(aws.ToString(out.SpotPriceHistory[0].SpotPrice), 64)
+}
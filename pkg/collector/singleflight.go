@@ -0,0 +1,72 @@
+package collector
+
+import (
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// SingleFlight wraps a collector so that concurrent scrapes, e.g. by two
+// Prometheus servers, share one collection rather than each querying the
+// metadata service. A scrape arriving while a collection is in flight waits
+// for it and receives the same metrics.
+func SingleFlight(c prometheus.Collector) prometheus.Collector {
+	return &singleFlightCollector{collector: c}
+}
+
+type singleFlightCollector struct {
+	collector prometheus.Collector
+
+	mu     sync.Mutex
+	flight *flight
+}
+
+// flight is a collection in progress. metrics is set before done is closed.
+type flight struct {
+	done    chan struct{}
+	metrics []prometheus.Metric
+}
+
+func (c *singleFlightCollector) Describe(ch chan<- *prometheus.Desc) {
+	c.collector.Describe(ch)
+}
+
+func (c *singleFlightCollector) Collect(ch chan<- prometheus.Metric) {
+	c.mu.Lock()
+	f := c.flight
+	leader := f == nil
+	if leader {
+		f = &flight{done: make(chan struct{})}
+		c.flight = f
+	}
+	c.mu.Unlock()
+
+	if leader {
+		f.metrics = collectAll(c.collector)
+		c.mu.Lock()
+		c.flight = nil
+		c.mu.Unlock()
+		close(f.done)
+	} else {
+		<-f.done
+	}
+
+	for _, m := range f.metrics {
+		ch <- m
+	}
+}
+
+// collectAll returns the metrics collected by c.
+func collectAll(c prometheus.Collector) []prometheus.Metric {
+	ch := make(chan prometheus.Metric)
+	go func() {
+		c.Collect(ch)
+		close(ch)
+	}()
+
+	var metrics []prometheus.Metric
+	for m := range ch {
+		metrics = append(metrics, m)
+	}
+	return metrics
+}
@@ -0,0 +1,61 @@
+package collector
+
+import (
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	corev1 "k8s.io/api/core/v1"
+)
+
+// TaintCollector exports the current taints of the Kubernetes node, so alert
+// rules can suppress interruption alerts for nodes already tainted for
+// removal. The taints are kept up to date by calling SetNode.
+type TaintCollector struct {
+	mu         sync.Mutex
+	nodeName   string
+	taints     []corev1.Taint
+	nodeLabels prometheus.Labels
+	taint      *prometheus.Desc
+}
+
+// NewTaintCollector returns a TaintCollector exporting the taints of node,
+// which may be nil to export nothing until SetNode is called. nodeLabels are
+// attached to every metric as constant labels.
+func NewTaintCollector(node *corev1.Node, nodeLabels prometheus.Labels) *TaintCollector {
+	c := &TaintCollector{}
+	if node != nil {
+		c.SetNode(node)
+	}
+	c.SetNodeLabels(nodeLabels)
+	return c
+}
+
+// SetNode replaces the exported taints with those of node.
+func (c *TaintCollector) SetNode(node *corev1.Node) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.nodeName = node.Name
+	c.taints = node.Spec.Taints
+}
+
+// SetNodeLabels replaces the constant labels attached to every metric, e.g.
+// after the labels of the node changed.
+func (c *TaintCollector) SetNodeLabels(nodeLabels prometheus.Labels) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.taint = prometheus.NewDesc("kube_node_spot_taint", "Taint currently set on the node", []string{"node", "key", "value", "effect"}, nodeLabels)
+}
+
+// Describe sends no descriptors, making this an unchecked collector, as the
+// node labels attached to the descriptors can change at runtime.
+func (c *TaintCollector) Describe(ch chan<- *prometheus.Desc) {
+}
+
+func (c *TaintCollector) Collect(ch chan<- prometheus.Metric) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, taint := range c.taints {
+		ch <- prometheus.MustNewConstMetric(c.taint, prometheus.GaugeValue, 1, c.nodeName, taint.Key, taint.Value, string(taint.Effect))
+	}
+}
@@ -0,0 +1,562 @@
+// Package collector implements the Prometheus collectors exporting spot
+// interruption, rebalance and pricing metrics.
+package collector
+
+import (
+	"context"
+	"maps"
+	"math/rand/v2"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gjtempleton/spot-termination-exporter/pkg/imds"
+	"github.com/gjtempleton/spot-termination-exporter/pkg/provider"
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+)
+
+// TerminationCollector exports termination notices, rebalance
+// recommendations and scheduled maintenance events read from a Provider on
+// every scrape.
+type TerminationCollector struct {
+	provider provider.Provider
+
+	mu         sync.RWMutex
+	descs      terminationDescs
+	nodeLabels prometheus.Labels
+	nodegroup  string
+	onDemand   bool
+
+	tracker      *InterruptionTracker
+	watchChanges bool
+	// rebalanceInterval replaces the interval of WatchNotices for
+	// rebalanceWindow after a rebalance recommendation, if it is non-zero.
+	rebalanceInterval time.Duration
+	rebalanceWindow   time.Duration
+	// pollJitter randomizes the intervals of WatchNotices by up to this
+	// fraction.
+	pollJitter float64
+
+	pollMu    sync.Mutex
+	lastPolls map[string]time.Time
+
+	breakerMu         sync.Mutex
+	breakerThreshold  int
+	breakerCooldown   time.Duration
+	failures          int
+	openUntil         time.Time
+	lastInstanceID    string
+	lastSuccess       time.Time
+	watchdogThreshold int
+	watchdog          func(failures int, lastSuccess time.Time, lastErr error)
+}
+
+type terminationDescs struct {
+	circuitOpen               *prometheus.Desc
+	endpoint                  *prometheus.Desc
+	hopLimitBlocked           *prometheus.Desc
+	info                      *prometheus.Desc
+	warmPool                  *prometheus.Desc
+	lastSuccessfulPoll        *prometheus.Desc
+	scheduledEvent            *prometheus.Desc
+	scheduledEventIn          *prometheus.Desc
+	liveMigration             *prometheus.Desc
+	hostMaintenanceTerminate  *prometheus.Desc
+	imdsFallbackV1            *prometheus.Desc
+	imdsTokenAge              *prometheus.Desc
+	imdsTokenTTLRemaining     *prometheus.Desc
+	maintenanceEventIn        *prometheus.Desc
+	maintenanceEventScheduled *prometheus.Desc
+	rebalanceIndicator        *prometheus.Desc
+	rebalanceScrapeSuccessful *prometheus.Desc
+	scrapeSuccessful          *prometheus.Desc
+	terminationIndicator      *prometheus.Desc
+	terminationTime           *prometheus.Desc
+}
+
+// NewTerminationCollector returns a TerminationCollector reading from p.
+// nodeLabels are attached to every metric as constant labels.
+func NewTerminationCollector(
+	p provider.Provider,
+	nodeLabels prometheus.Labels,
+) *TerminationCollector {
+	return &TerminationCollector{
+		provider:   p,
+		descs:      newTerminationDescs(nodeLabels, ""),
+		nodeLabels: nodeLabels,
+		lastPolls:  map[string]time.Time{},
+	}
+}
+
+// newTerminationDescs returns the descriptors with nodeLabels attached, and
+// the nodegroup label attached to the interruption metrics if it is set.
+func newTerminationDescs(nodeLabels prometheus.Labels, nodegroup string) terminationDescs {
+	interruptionLabels := nodeLabels
+	if nodegroup != "" {
+		interruptionLabels = prometheus.Labels{"nodegroup": nodegroup}
+		maps.Copy(interruptionLabels, nodeLabels)
+	}
+	return terminationDescs{
+		circuitOpen:               prometheus.NewDesc("aws_instance_metadata_service_circuit_open", "Metadata service requests are skipped after repeated failures", nil, nodeLabels),
+		endpoint:                  prometheus.NewDesc("aws_instance_metadata_service_endpoint", "Metadata endpoint which served the last request", []string{"endpoint", "instance_id"}, nodeLabels),
+		imdsFallbackV1:            prometheus.NewDesc("aws_imds_fallback_v1", "Last request fell back to IMDSv1 as no IMDSv2 token could be obtained", []string{"instance_id"}, nodeLabels),
+		imdsTokenAge:              prometheus.NewDesc("spot_exporter_imdsv2_token_age_seconds", "Age of the cached IMDSv2 session token", []string{"endpoint"}, nodeLabels),
+		imdsTokenTTLRemaining:     prometheus.NewDesc("spot_exporter_imdsv2_token_ttl_remaining_seconds", "Time left until the cached IMDSv2 session token expires", []string{"endpoint"}, nodeLabels),
+		lastSuccessfulPoll:        prometheus.NewDesc("spot_exporter_last_successful_poll_timestamp_seconds", "Time of the last successful poll of the metadata service since unix epoch in seconds", []string{"collector"}, nodeLabels),
+		info:                      prometheus.NewDesc("aws_instance_info", "Image, architecture and virtualization type of the instance", []string{"instance_id", "instance_type", "image_id", "architecture", "kernel_id", "virtualization_type"}, nodeLabels),
+		warmPool:                  prometheus.NewDesc("aws_instance_warm_pool", "Instance is in the warm pool of its Auto Scaling group", []string{"instance_id", "lifecycle_state"}, nodeLabels),
+		hopLimitBlocked:           prometheus.NewDesc("aws_imdsv2_hop_limit_blocked", "IMDSv2 token requests time out while the metadata service answers, likely due to a hop limit of 1", nil, nodeLabels),
+		scheduledEvent:            prometheus.NewDesc("aws_instance_scheduled_event", "Event of the given type is scheduled for the instance", []string{"event_type", "event_id", "status", "instance_id", "instance_type"}, nodeLabels),
+		scheduledEventIn:          prometheus.NewDesc("aws_instance_scheduled_event_in", "Scheduled event will start in, 0 once it started", []string{"event_type", "event_id", "instance_id", "instance_type"}, nodeLabels),
+		liveMigration:             prometheus.NewDesc("aws_instance_live_migration_pending", "Host maintenance will live migrate the instance, which needs no action", []string{"instance_id", "instance_type"}, interruptionLabels),
+		hostMaintenanceTerminate:  prometheus.NewDesc("aws_instance_host_maintenance_termination_pending", "Host maintenance will stop the instance", []string{"instance_id", "instance_type"}, interruptionLabels),
+		maintenanceEventIn:        prometheus.NewDesc("aws_instance_maintenance_event_in", "Scheduled maintenance event will start in", []string{"code", "event_id", "instance_id", "instance_type"}, nodeLabels),
+		maintenanceEventScheduled: prometheus.NewDesc("aws_instance_maintenance_event_scheduled", "Maintenance event is scheduled for the instance", []string{"code", "event_id", "state", "instance_id", "instance_type"}, nodeLabels),
+		rebalanceIndicator:        prometheus.NewDesc("aws_instance_rebalance_recommended", "Instance rebalance is recommended", []string{"instance_id", "instance_type"}, interruptionLabels),
+		rebalanceScrapeSuccessful: prometheus.NewDesc("aws_instance_metadata_service_events_available", "Metadata service events endpoint available", []string{"instance_id"}, nodeLabels),
+		scrapeSuccessful:          prometheus.NewDesc("aws_instance_metadata_service_available", "Metadata service available", []string{"instance_id"}, nodeLabels),
+		terminationIndicator:      prometheus.NewDesc("aws_instance_termination_imminent", "Instance is about to be terminated", []string{"instance_action", "instance_id", "instance_type"}, interruptionLabels),
+		terminationTime:           prometheus.NewDesc("aws_instance_termination_in", "Instance will be terminated in", []string{"instance_id", "instance_type"}, interruptionLabels),
+	}
+}
+
+// SetTracker makes the collector report the termination notices it reads to
+// tracker.
+func (c *TerminationCollector) SetTracker(tracker *InterruptionTracker) {
+	c.tracker = tracker
+}
+
+// SetOnDemand makes the collector skip termination notices and rebalance
+// recommendations while onDemand is true, as only spot instances receive
+// them, still exporting the instance info and maintenance events.
+func (c *TerminationCollector) SetOnDemand(onDemand bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.onDemand = onDemand
+}
+
+// SetCircuitBreaker makes the collector skip the metadata service for cooldown
+// after threshold consecutive scrapes failed, so a broken metadata path
+// doesn't add latency to every scrape. A threshold of 0 disables it.
+func (c *TerminationCollector) SetCircuitBreaker(threshold int, cooldown time.Duration) {
+	c.breakerMu.Lock()
+	defer c.breakerMu.Unlock()
+	c.breakerThreshold = threshold
+	c.breakerCooldown = cooldown
+}
+
+// SetWatchdog makes the collector call trigger once threshold consecutive
+// scrapes failed to read the metadata service, with the number of failures,
+// the time of the last successful scrape, zero if there was none, and the
+// last error. A threshold of 0 disables it.
+func (c *TerminationCollector) SetWatchdog(threshold int, trigger func(failures int, lastSuccess time.Time, lastErr error)) {
+	c.breakerMu.Lock()
+	defer c.breakerMu.Unlock()
+	c.watchdogThreshold = threshold
+	c.watchdog = trigger
+}
+
+// PollStatus returns the time of the last successful scrape of the metadata
+// service, zero if there was none, and the number of scrapes which failed in
+// a row since.
+func (c *TerminationCollector) PollStatus() (time.Time, int) {
+	c.breakerMu.Lock()
+	defer c.breakerMu.Unlock()
+	return c.lastSuccess, c.failures
+}
+
+// WatchNotices reads the termination notice every interval until ctx is
+// cancelled and reports it to the tracker, so the notice handler is called
+// soon after the notice is issued whether or not the exporter is scraped.
+// If the provider is a ChangeWatcher the notice is instead read whenever the
+// provider reports a change. Errors are only logged, as the scrapes report
+// them.
+func (c *TerminationCollector) WatchNotices(ctx context.Context, interval time.Duration) {
+	if watcher, ok := c.provider.(provider.ChangeWatcher); ok && c.watchChanges {
+		log.Info("Watching for termination notices with long polling")
+		c.pollNotice(ctx, interval)
+		watcher.WatchChanges(ctx, func() {
+			c.pollNotice(ctx, interval)
+		})
+		return
+	}
+	current := interval
+	timer := time.NewTimer(Jitter(current, c.pollJitter))
+	defer timer.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-timer.C:
+		}
+		c.pollNotice(ctx, current)
+		next := c.nextPollInterval(interval)
+		if next != current {
+			log.Infof("Reading the termination notice every %s", next)
+			current = next
+		}
+		timer.Reset(Jitter(current, c.pollJitter))
+	}
+}
+
+// SetPollJitter makes WatchNotices randomize each interval by up to fraction
+// of it, so the exporters started together don't keep polling in phase.
+func (c *TerminationCollector) SetPollJitter(fraction float64) {
+	c.pollJitter = fraction
+}
+
+// Jitter returns d randomized by up to fraction of it either way.
+func Jitter(d time.Duration, fraction float64) time.Duration {
+	if fraction <= 0 || d <= 0 {
+		return d
+	}
+	return d + time.Duration((2*rand.Float64()-1)*fraction*float64(d))
+}
+
+// SetRebalanceInterval makes WatchNotices read the termination notice every
+// interval instead for window after a rebalance recommendation was observed,
+// as a termination is then likely to follow. Zero disables it.
+func (c *TerminationCollector) SetRebalanceInterval(interval, window time.Duration) {
+	c.rebalanceInterval = interval
+	c.rebalanceWindow = window
+}
+
+// nextPollInterval returns the interval until the next read of the
+// termination notice by WatchNotices, which polls every interval unless a
+// rebalance recommendation was observed recently.
+func (c *TerminationCollector) nextPollInterval(interval time.Duration) time.Duration {
+	if c.rebalanceInterval <= 0 || c.tracker == nil {
+		return interval
+	}
+	observed := c.tracker.RebalanceObserved()
+	if observed.IsZero() || time.Since(observed) > c.rebalanceWindow {
+		return interval
+	}
+	return c.rebalanceInterval
+}
+
+// SetWatchChanges sets whether WatchNotices relies on the provider reporting
+// changes when it can, rather than polling.
+func (c *TerminationCollector) SetWatchChanges(watch bool) {
+	c.watchChanges = watch
+}
+
+// pollNotice reads the termination notice once for WatchNotices.
+func (c *TerminationCollector) pollNotice(ctx context.Context, timeout time.Duration) {
+	c.mu.RLock()
+	onDemand := c.onDemand
+	c.mu.RUnlock()
+	if open, _ := c.circuitOpen(); open || onDemand || c.tracker == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	identity, err := c.provider.GetInstanceIdentity(ctx)
+	if err != nil {
+		imds.WithError(err).Debug("couldn't fetch instance identity to watch for termination notices")
+		return
+	}
+	notice, err := c.provider.GetTerminationNotice(ctx)
+	if err != nil {
+		imds.WithError(err).Debug("couldn't fetch termination notice")
+		return
+	}
+	if notice != nil && notice.Stale(identity) {
+		notice = nil
+	}
+	c.recordPoll("termination")
+	c.tracker.ObserveIdentity(identity)
+	c.tracker.ObserveNotice(notice)
+
+	if c.rebalanceInterval > 0 {
+		rebalance, err := c.provider.GetRebalance(ctx)
+		if err != nil {
+			imds.WithError(err).Debug("couldn't fetch rebalance recommendation")
+			return
+		}
+		c.recordPoll("rebalance")
+		c.tracker.ObserveRebalance(rebalance)
+	}
+}
+
+// circuitOpen reports whether the metadata service is to be skipped, and the
+// last instance id seen to export the failed scrape with.
+func (c *TerminationCollector) circuitOpen() (bool, string) {
+	c.breakerMu.Lock()
+	defer c.breakerMu.Unlock()
+	return time.Now().Before(c.openUntil), c.lastInstanceID
+}
+
+// recordScrape updates the circuit breaker with the outcome of a scrape,
+// err being nil if it succeeded, opening it once threshold scrapes in a row
+// failed, and triggers the watchdog once its threshold is reached.
+func (c *TerminationCollector) recordScrape(instanceID string, err error) {
+	c.breakerMu.Lock()
+	if instanceID != "" {
+		c.lastInstanceID = instanceID
+	}
+	if err == nil {
+		c.failures = 0
+		c.lastSuccess = time.Now()
+		c.breakerMu.Unlock()
+		return
+	}
+	c.failures++
+	if c.breakerThreshold > 0 && c.failures >= c.breakerThreshold {
+		log.Warnf("Metadata service failed %d scrapes in a row, skipping it for %s", c.failures, c.breakerCooldown)
+		c.openUntil = time.Now().Add(c.breakerCooldown)
+	}
+	failures, lastSuccess := c.failures, c.lastSuccess
+	trigger := c.watchdogThreshold > 0 && failures >= c.watchdogThreshold && c.watchdog != nil
+	c.breakerMu.Unlock()
+
+	if trigger {
+		c.watchdog(failures, lastSuccess, err)
+	}
+}
+
+// recordPoll records a successful poll of the given kind of data.
+func (c *TerminationCollector) recordPoll(kind string) {
+	c.pollMu.Lock()
+	defer c.pollMu.Unlock()
+	c.lastPolls[kind] = time.Now()
+}
+
+// collectLastPolls exports the time of the last successful poll of each kind
+// of data, as scrape success alone doesn't prove the data is fresh.
+func (c *TerminationCollector) collectLastPolls(ch chan<- prometheus.Metric, d terminationDescs) {
+	c.pollMu.Lock()
+	defer c.pollMu.Unlock()
+	for kind, last := range c.lastPolls {
+		ch <- prometheus.MustNewConstMetric(d.lastSuccessfulPoll, prometheus.GaugeValue, float64(last.UnixNano())/1e9, kind)
+	}
+}
+
+// SetNodeLabels replaces the constant labels attached to every metric, e.g.
+// after the labels of the node changed.
+func (c *TerminationCollector) SetNodeLabels(nodeLabels prometheus.Labels) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.nodeLabels = nodeLabels
+	c.descs = newTerminationDescs(nodeLabels, c.nodegroup)
+}
+
+// SetNodegroup attaches the EKS managed node group of the instance as the
+// nodegroup label to the termination, rebalance and host maintenance metrics.
+func (c *TerminationCollector) SetNodegroup(nodegroup string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.nodegroup = nodegroup
+	c.descs = newTerminationDescs(c.nodeLabels, nodegroup)
+}
+
+// Describe sends no descriptors, making this an unchecked collector, as the
+// node labels attached to the descriptors can change at runtime.
+func (c *TerminationCollector) Describe(ch chan<- *prometheus.Desc) {
+}
+
+func (c *TerminationCollector) Collect(ch chan<- prometheus.Metric) {
+	log.Info("Fetching termination data from metadata-service")
+
+	c.mu.RLock()
+	d := c.descs
+	onDemand := c.onDemand
+	c.mu.RUnlock()
+	defer c.collectLastPolls(ch, d)
+
+	open, lastInstanceID := c.circuitOpen()
+	if open {
+		ch <- prometheus.MustNewConstMetric(d.circuitOpen, prometheus.GaugeValue, 1)
+		ch <- prometheus.MustNewConstMetric(d.scrapeSuccessful, prometheus.GaugeValue, 0, lastInstanceID)
+		return
+	}
+	ch <- prometheus.MustNewConstMetric(d.circuitOpen, prometheus.GaugeValue, 0)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	identity, err := c.provider.GetInstanceIdentity(ctx)
+	if reporter, ok := c.provider.(provider.HopLimitReporter); ok {
+		if reporter.HopLimitBlocked() {
+			ch <- prometheus.MustNewConstMetric(d.hopLimitBlocked, prometheus.GaugeValue, 1)
+		} else {
+			ch <- prometheus.MustNewConstMetric(d.hopLimitBlocked, prometheus.GaugeValue, 0)
+		}
+	}
+	if err != nil {
+		imds.WithError(err).Error("couldn't fetch instance identity")
+		c.recordScrape("", err)
+		ch <- prometheus.MustNewConstMetric(d.scrapeSuccessful, prometheus.GaugeValue, 0, lastInstanceID)
+		return
+	}
+	instanceID := identity.InstanceID
+	instanceType := identity.InstanceType
+	if c.tracker != nil {
+		c.tracker.ObserveIdentity(identity)
+	}
+	if identity.ImageID != "" {
+		// only paravirtual instances boot a kernel image of their own
+		virtualizationType := "hvm"
+		if identity.KernelID != "" {
+			virtualizationType = "paravirtual"
+		}
+		ch <- prometheus.MustNewConstMetric(d.info, prometheus.GaugeValue, 1, instanceID, instanceType, identity.ImageID, identity.Architecture, identity.KernelID, virtualizationType)
+	}
+
+	if onDemand {
+		c.recordScrape(instanceID, nil)
+		ch <- prometheus.MustNewConstMetric(d.scrapeSuccessful, prometheus.GaugeValue, 1, instanceID)
+		c.collectEndpoint(ch, d, instanceID)
+		c.collectLifecycle(ctx, ch, d, instanceID)
+		c.collectMaintenance(ctx, ch, d, instanceID, instanceType)
+		c.collectScheduledEvents(ctx, ch, d, instanceID, instanceType)
+		return
+	}
+
+	notice, err := c.provider.GetTerminationNotice(ctx)
+	if notice != nil && notice.Stale(identity) {
+		log.Debugf("ignoring %s notice from before the instance was last started", notice.Action)
+		notice = nil
+	}
+	c.recordScrape(instanceID, err)
+	if err != nil {
+		imds.WithError(err).Error("Failed to fetch termination notice from metadata service")
+		ch <- prometheus.MustNewConstMetric(d.scrapeSuccessful, prometheus.GaugeValue, 0, instanceID)
+	} else {
+		ch <- prometheus.MustNewConstMetric(d.scrapeSuccessful, prometheus.GaugeValue, 1, instanceID)
+		c.recordPoll("termination")
+		if c.tracker != nil {
+			c.tracker.ObserveNotice(notice)
+		}
+
+		if notice == nil {
+			ch <- prometheus.MustNewConstMetric(d.terminationIndicator, prometheus.GaugeValue, 0, "", instanceID, instanceType)
+		} else {
+			log.Infof("instance-action endpoint available, termination time: %v", notice.Time)
+			ch <- prometheus.MustNewConstMetric(d.terminationIndicator, prometheus.GaugeValue, 1, notice.Action, instanceID, instanceType)
+			delta := time.Until(notice.Time)
+			if delta.Seconds() > 0 {
+				ch <- prometheus.MustNewConstMetric(d.terminationTime, prometheus.GaugeValue, delta.Seconds(), instanceID, instanceType)
+			}
+		}
+	}
+
+	c.collectEndpoint(ch, d, instanceID)
+
+	rebalance, err := c.provider.GetRebalance(ctx)
+	if err != nil {
+		imds.WithError(err).Error("Failed to fetch rebalance recommendation from metadata service")
+		ch <- prometheus.MustNewConstMetric(d.rebalanceScrapeSuccessful, prometheus.GaugeValue, 0, instanceID)
+	} else {
+		ch <- prometheus.MustNewConstMetric(d.rebalanceScrapeSuccessful, prometheus.GaugeValue, 1, instanceID)
+		c.recordPoll("rebalance")
+		if c.tracker != nil {
+			c.tracker.ObserveRebalance(rebalance)
+		}
+
+		if rebalance == nil {
+			ch <- prometheus.MustNewConstMetric(d.rebalanceIndicator, prometheus.GaugeValue, 0, instanceID, instanceType)
+		} else {
+			log.Infof("rebalance recommendation event endpoint available, recommendation time: %v", rebalance.NoticeTime)
+			ch <- prometheus.MustNewConstMetric(d.rebalanceIndicator, prometheus.GaugeValue, 1, instanceID, instanceType)
+		}
+	}
+
+	c.collectLifecycle(ctx, ch, d, instanceID)
+	c.collectMaintenance(ctx, ch, d, instanceID, instanceType)
+	c.collectScheduledEvents(ctx, ch, d, instanceID, instanceType)
+}
+
+// collectEndpoint exports which endpoint served the last request and whether
+// it fell back to IMDSv1, for providers reporting them.
+func (c *TerminationCollector) collectEndpoint(ch chan<- prometheus.Metric, d terminationDescs, instanceID string) {
+	if reporter, ok := c.provider.(provider.V1FallbackReporter); ok {
+		if reporter.FallbackV1() {
+			ch <- prometheus.MustNewConstMetric(d.imdsFallbackV1, prometheus.GaugeValue, 1, instanceID)
+		} else {
+			ch <- prometheus.MustNewConstMetric(d.imdsFallbackV1, prometheus.GaugeValue, 0, instanceID)
+		}
+	}
+	if reporter, ok := c.provider.(provider.EndpointReporter); ok {
+		if endpoint := reporter.LastEndpoint(); endpoint != "" {
+			ch <- prometheus.MustNewConstMetric(d.endpoint, prometheus.GaugeValue, 1, endpoint, instanceID)
+		}
+	}
+	if reporter, ok := c.provider.(provider.TokenReporter); ok {
+		for _, token := range reporter.IMDSTokens() {
+			age := time.Since(token.Obtained)
+			ch <- prometheus.MustNewConstMetric(d.imdsTokenAge, prometheus.GaugeValue, age.Seconds(), token.Endpoint)
+			ch <- prometheus.MustNewConstMetric(d.imdsTokenTTLRemaining, prometheus.GaugeValue, (token.TTL - age).Seconds(), token.Endpoint)
+		}
+	}
+}
+
+// collectLifecycle exports whether the instance is in a warm pool, for
+// providers reading the Auto Scaling lifecycle state.
+func (c *TerminationCollector) collectLifecycle(ctx context.Context, ch chan<- prometheus.Metric, d terminationDescs, instanceID string) {
+	if lifecycle, ok := c.provider.(provider.LifecycleStateProvider); ok {
+		state, err := lifecycle.GetTargetLifecycleState(ctx)
+		switch {
+		case err != nil:
+			imds.WithError(err).Error("Failed to fetch target lifecycle state from metadata service")
+		case strings.HasPrefix(state, "Warmed:"):
+			ch <- prometheus.MustNewConstMetric(d.warmPool, prometheus.GaugeValue, 1, instanceID, state)
+		case state != "":
+			ch <- prometheus.MustNewConstMetric(d.warmPool, prometheus.GaugeValue, 0, instanceID, state)
+		}
+	}
+}
+
+// collectMaintenance exports the scheduled maintenance events of the
+// instance, and whether host maintenance will migrate or stop it if the
+// provider tells them apart.
+func (c *TerminationCollector) collectMaintenance(ctx context.Context, ch chan<- prometheus.Metric, d terminationDescs, instanceID, instanceType string) {
+	events, err := c.provider.GetMaintenanceEvents(ctx)
+	if err != nil {
+		imds.WithError(err).Error("Failed to fetch scheduled maintenance events from metadata service")
+		return
+	}
+	c.recordPoll("maintenance")
+	for _, event := range events {
+		ch <- prometheus.MustNewConstMetric(d.maintenanceEventScheduled, prometheus.GaugeValue, 1, event.Code, event.ID, event.State, instanceID, instanceType)
+		delta := time.Until(event.NotBefore)
+		if !event.NotBefore.IsZero() && delta.Seconds() > 0 {
+			ch <- prometheus.MustNewConstMetric(d.maintenanceEventIn, prometheus.GaugeValue, delta.Seconds(), event.Code, event.ID, instanceID, instanceType)
+		}
+	}
+
+	classifier, ok := c.provider.(provider.HostMaintenanceClassifier)
+	if !ok {
+		return
+	}
+	migrate, terminate := 0.0, 0.0
+	for _, event := range events {
+		switch classifier.HostMaintenanceKind(event) {
+		case provider.HostMaintenanceMigrate:
+			migrate = 1
+		case provider.HostMaintenanceTerminate:
+			terminate = 1
+		}
+	}
+	ch <- prometheus.MustNewConstMetric(d.liveMigration, prometheus.GaugeValue, migrate, instanceID, instanceType)
+	ch <- prometheus.MustNewConstMetric(d.hostMaintenanceTerminate, prometheus.GaugeValue, terminate, instanceID, instanceType)
+}
+
+// collectScheduledEvents exports the scheduled events of all types with
+// their deadlines, if the provider reports them.
+func (c *TerminationCollector) collectScheduledEvents(ctx context.Context, ch chan<- prometheus.Metric, d terminationDescs, instanceID, instanceType string) {
+	scheduled, ok := c.provider.(provider.ScheduledEventsProvider)
+	if !ok {
+		return
+	}
+	events, err := scheduled.GetScheduledEvents(ctx)
+	if err != nil {
+		imds.WithError(err).Error("Failed to fetch scheduled events from metadata service")
+		return
+	}
+	for _, event := range events {
+		ch <- prometheus.MustNewConstMetric(d.scheduledEvent, prometheus.GaugeValue, 1, event.Type, event.ID, event.Status, instanceID, instanceType)
+		ch <- prometheus.MustNewConstMetric(d.scheduledEventIn, prometheus.GaugeValue, max(time.Until(event.NotBefore).Seconds(), 0), event.Type, event.ID, instanceID, instanceType)
+	}
+}
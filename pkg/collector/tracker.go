@@ -0,0 +1,338 @@
+package collector
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/gjtempleton/spot-termination-exporter/pkg/provider"
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+)
+
+// InterruptionTracker follows termination notices and rebalance
+// recommendations across scrapes. It exports how long the instance actually
+// survived after a notice, measured until the notice is cleared or the
+// exporter last saw it, and whether rebalance recommendations were followed
+// by a termination notice. With a state file the pending signals survive a
+// restart, e.g. after a stop or hibernate, and are accounted for when the
+// exporter starts again, and the counters keep counting from where they
+// were.
+type InterruptionTracker struct {
+	stateFile     string
+	eventLog      *EventLog
+	noticeHandler func(event InterruptionEvent)
+	eventHandler  func(event InterruptionEvent)
+	identity      *provider.InstanceIdentity
+
+	mu                     sync.Mutex
+	state                  trackerState
+	leadTime               prometheus.Histogram
+	rebalances             prometheus.Counter
+	rebalancesFollowed     prometheus.Counter
+	rebalanceToTermination prometheus.Histogram
+	hibernations           prometheus.Counter
+	hibernated             prometheus.Counter
+	watchdogRestarts       prometheus.Counter
+}
+
+type trackerState struct {
+	NoticeObserved    time.Time `json:"notice_observed,omitzero"`
+	LastSeen          time.Time `json:"last_seen,omitzero"`
+	NoticeAction      string    `json:"notice_action,omitempty"`
+	RebalanceObserved time.Time `json:"rebalance_observed,omitzero"`
+	// HandledRebalance is the notice time of the last recommendation
+	// observed, so it isn't counted again while it is still pending.
+	HandledRebalance *time.Time `json:"handled_rebalance,omitempty"`
+	InstanceID       string     `json:"instance_id,omitempty"`
+	PendingTime      time.Time  `json:"pending_time,omitzero"`
+	WatchdogRestarts int        `json:"watchdog_restarts,omitempty"`
+	// the lifetime counters, restored after a restart
+	Rebalances         int     `json:"rebalances,omitempty"`
+	RebalancesFollowed int     `json:"rebalances_followed,omitempty"`
+	Hibernations       int     `json:"hibernations,omitempty"`
+	HibernatedSeconds  float64 `json:"hibernated_seconds,omitempty"`
+}
+
+// NewInterruptionTracker returns an InterruptionTracker persisting its state
+// to stateFile, or keeping it in memory only if stateFile is empty. A notice
+// still pending in the state file is observed right away.
+func NewInterruptionTracker(stateFile string) (*InterruptionTracker, error) {
+	t := &InterruptionTracker{
+		stateFile: stateFile,
+		leadTime: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Name:    "aws_instance_termination_notice_lead_time_seconds",
+			Help:    "Time the instance was seen alive after a termination notice",
+			Buckets: []float64{15, 30, 60, 90, 120, 150, 180, 240, 300, 600},
+		}),
+		rebalances: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "aws_instance_rebalance_recommendations_total",
+			Help: "Rebalance recommendations observed",
+		}),
+		rebalancesFollowed: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "aws_instance_rebalance_followed_by_termination_total",
+			Help: "Rebalance recommendations followed by a termination notice",
+		}),
+		rebalanceToTermination: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Name:    "aws_instance_rebalance_to_termination_seconds",
+			Help:    "Time between a rebalance recommendation and the termination notice following it",
+			Buckets: prometheus.ExponentialBuckets(60, 2, 10),
+		}),
+		hibernations: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "aws_instance_hibernations_total",
+			Help: "Times the instance resumed after being hibernated",
+		}),
+		hibernated: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "aws_instance_hibernated_seconds_total",
+			Help: "Time the instance spent hibernated",
+		}),
+		watchdogRestarts: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "spot_exporter_watchdog_restarts_total",
+			Help: "Times the exporter exited after repeatedly failing to read the metadata service, counted across restarts with a state file",
+		}),
+	}
+	if stateFile == "" {
+		return t, nil
+	}
+
+	data, err := os.ReadFile(stateFile)
+	if errors.Is(err, os.ErrNotExist) {
+		return t, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("read state file: %w", err)
+	}
+	if err := json.Unmarshal(data, &t.state); err != nil {
+		log.WithError(err).Warnf("ignoring invalid state file %s", stateFile)
+		t.state = trackerState{}
+	}
+	t.watchdogRestarts.Add(float64(t.state.WatchdogRestarts))
+	t.rebalances.Add(float64(t.state.Rebalances))
+	t.rebalancesFollowed.Add(float64(t.state.RebalancesFollowed))
+	t.hibernations.Add(float64(t.state.Hibernations))
+	t.hibernated.Add(t.state.HibernatedSeconds)
+	if !t.state.NoticeObserved.IsZero() {
+		t.finishNotice(t.state.LastSeen)
+	}
+	return t, nil
+}
+
+// SetEventLog makes the tracker add the termination notices and rebalance
+// recommendations it observes to eventLog, when they are first observed and
+// when the action of a pending notice changes.
+func (t *InterruptionTracker) SetEventLog(eventLog *EventLog) {
+	t.eventLog = eventLog
+}
+
+// SetNoticeHandler makes the tracker call handler, in a goroutine of its own,
+// when a termination notice is first observed.
+func (t *InterruptionTracker) SetNoticeHandler(handler func(event InterruptionEvent)) {
+	t.noticeHandler = handler
+}
+
+// SetEventHandler makes the tracker call handler, in a goroutine of its own,
+// with every termination notice and rebalance recommendation it adds to the
+// event log, or observes if there is none.
+func (t *InterruptionTracker) SetEventHandler(handler func(event InterruptionEvent)) {
+	t.eventHandler = handler
+}
+
+// ObserveIdentity records the run of the instance the signals belong to. When
+// the instance was restarted since, e.g. after a stop and start, or the state
+// file belongs to another instance, the pending signals are dropped, ending a
+// pending notice when it was last seen.
+func (t *InterruptionTracker) ObserveIdentity(identity *provider.InstanceIdentity) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.identity = identity
+	if t.state.InstanceID == identity.InstanceID && t.state.PendingTime.Equal(identity.PendingTime) {
+		return
+	}
+	if t.state.InstanceID != "" {
+		log.Infof("instance %s was restarted, resetting pending interruption signals", identity.InstanceID)
+		if t.state.NoticeAction == "hibernate" && t.state.InstanceID == identity.InstanceID {
+			hibernated := max(identity.PendingTime.Sub(t.state.LastSeen), 0)
+			log.Infof("instance resumed after being hibernated for %s", hibernated)
+			t.hibernations.Inc()
+			t.hibernated.Add(hibernated.Seconds())
+			t.state.Hibernations++
+			t.state.HibernatedSeconds += hibernated.Seconds()
+		}
+		if !t.state.NoticeObserved.IsZero() {
+			t.finishNotice(t.state.LastSeen)
+		}
+		t.state.RebalanceObserved = time.Time{}
+		t.state.HandledRebalance = nil
+	}
+	t.state.InstanceID = identity.InstanceID
+	t.state.PendingTime = identity.PendingTime
+	t.save()
+}
+
+// ObserveNotice records the pending termination notice, or that none is
+// pending if notice is nil.
+func (t *InterruptionTracker) ObserveNotice(notice *provider.TerminationNotice) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	pending := notice != nil
+	now := time.Now()
+	if pending && (t.state.NoticeObserved.IsZero() || notice.Action != t.state.NoticeAction) {
+		event := t.logEvent(InterruptionEvent{Observed: now, Type: EventTermination, Action: notice.Action, Time: notice.Time, Raw: string(notice.Raw)})
+		if t.state.NoticeObserved.IsZero() && t.noticeHandler != nil {
+			go t.noticeHandler(event)
+		}
+	}
+	if pending {
+		t.state.NoticeAction = notice.Action
+	}
+	switch {
+	case pending && t.state.NoticeObserved.IsZero():
+		t.state.NoticeObserved = now
+		t.state.LastSeen = now
+		if !t.state.RebalanceObserved.IsZero() {
+			t.followRebalance(now)
+		}
+		t.save()
+	case pending:
+		t.state.LastSeen = now
+		t.save()
+	case !t.state.NoticeObserved.IsZero():
+		t.finishNotice(now)
+	}
+}
+
+// ObserveRebalance records the pending rebalance recommendation, or that
+// none is pending if rebalance is nil. A recommendation stays linked to the
+// instance until a termination notice follows it, even if it is withdrawn in
+// the meantime. A recommendation already observed, e.g. still pending after
+// the notice following it, isn't counted again.
+func (t *InterruptionTracker) ObserveRebalance(rebalance *provider.RebalanceRecommendation) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if rebalance == nil || !t.state.RebalanceObserved.IsZero() {
+		return
+	}
+	if t.state.HandledRebalance != nil && t.state.HandledRebalance.Equal(rebalance.NoticeTime) {
+		return
+	}
+	noticeTime := rebalance.NoticeTime
+	t.state.HandledRebalance = &noticeTime
+	now := time.Now()
+	t.logEvent(InterruptionEvent{Observed: now, Type: EventRebalance, Time: rebalance.NoticeTime, Raw: string(rebalance.Raw)})
+	t.rebalances.Inc()
+	t.state.Rebalances++
+	t.state.RebalanceObserved = now
+	// the notice may have been read first in the scrape seeing both
+	if !t.state.NoticeObserved.IsZero() {
+		t.followRebalance(t.state.NoticeObserved)
+	}
+	t.save()
+}
+
+// RebalanceObserved returns when the pending rebalance recommendation was
+// observed, zero if none is pending or a termination notice followed it.
+func (t *InterruptionTracker) RebalanceObserved() time.Time {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.state.RebalanceObserved
+}
+
+// RecordWatchdogRestart counts that the exporter is about to exit as the
+// metadata service failed too often, persisting the count so it is exported
+// again after the restart.
+func (t *InterruptionTracker) RecordWatchdogRestart() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.state.WatchdogRestarts++
+	t.watchdogRestarts.Inc()
+	t.save()
+}
+
+// logEvent completes event with the current instance, its details and the ID
+// of the event, and adds it to the event log, if any, passing it to the event
+// handler unless it was logged already. The caller must hold t.mu.
+func (t *InterruptionTracker) logEvent(event InterruptionEvent) InterruptionEvent {
+	event.InstanceID = t.state.InstanceID
+	if t.identity != nil {
+		event.InstanceType = t.identity.InstanceType
+		event.AvailabilityZone = t.identity.AvailabilityZone
+		event.Region = t.identity.Region
+	}
+	event.ID = eventID(event)
+	if t.eventLog == nil || t.eventLog.Add(event) {
+		log.WithFields(log.Fields{"event_id": event.ID, "action": event.Action}).Infof("observed %s event", event.Type)
+		if t.eventHandler != nil {
+			go t.eventHandler(event)
+		}
+	}
+	return event
+}
+
+// followRebalance records that the pending rebalance recommendation was
+// followed by a termination notice observed at noticeTime. The caller must
+// hold t.mu.
+func (t *InterruptionTracker) followRebalance(noticeTime time.Time) {
+	t.rebalancesFollowed.Inc()
+	t.state.RebalancesFollowed++
+	t.rebalanceToTermination.Observe(max(noticeTime.Sub(t.state.RebalanceObserved).Seconds(), 0))
+	t.state.RebalanceObserved = time.Time{}
+}
+
+// finishNotice observes the lead time of the pending notice, which ended at
+// end, and clears it. The caller must hold t.mu unless t isn't shared yet.
+func (t *InterruptionTracker) finishNotice(end time.Time) {
+	leadTime := end.Sub(t.state.NoticeObserved)
+	log.Infof("termination notice lead time was %s", leadTime)
+	t.leadTime.Observe(leadTime.Seconds())
+	t.state.NoticeObserved = time.Time{}
+	t.state.LastSeen = time.Time{}
+	t.state.NoticeAction = ""
+	t.save()
+}
+
+// save writes the state file. The caller must hold t.mu.
+func (t *InterruptionTracker) save() {
+	if t.stateFile == "" {
+		return
+	}
+	data, err := json.Marshal(t.state)
+	if err != nil {
+		log.WithError(err).Error("Failed to encode state")
+		return
+	}
+	// write and rename, so a crash mid-write doesn't leave a truncated file
+	tmp := t.stateFile + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		log.WithError(err).Error("Failed to write state file")
+		return
+	}
+	if err := os.Rename(tmp, t.stateFile); err != nil {
+		log.WithError(err).Error("Failed to write state file")
+	}
+}
+
+func (t *InterruptionTracker) Describe(ch chan<- *prometheus.Desc) {
+	t.leadTime.Describe(ch)
+	t.rebalances.Describe(ch)
+	t.rebalancesFollowed.Describe(ch)
+	t.rebalanceToTermination.Describe(ch)
+	t.hibernations.Describe(ch)
+	t.hibernated.Describe(ch)
+	t.watchdogRestarts.Describe(ch)
+}
+
+func (t *InterruptionTracker) Collect(ch chan<- prometheus.Metric) {
+	t.leadTime.Collect(ch)
+	t.rebalances.Collect(ch)
+	t.rebalancesFollowed.Collect(ch)
+	t.rebalanceToTermination.Collect(ch)
+	t.hibernations.Collect(ch)
+	t.hibernated.Collect(ch)
+	t.watchdogRestarts.Collect(ch)
+}
@@ -0,0 +1,57 @@
+package collector
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gjtempleton/spot-termination-exporter/pkg/provider"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+)
+
+func TestRebalanceFollowedByNoticeCountedOnce(t *testing.T) {
+	tracker, err := NewInterruptionTracker("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var events atomic.Int32
+	tracker.SetEventHandler(func(InterruptionEvent) { events.Add(1) })
+	tracker.ObserveIdentity(&provider.InstanceIdentity{InstanceID: "i-0123456789abcdef0"})
+
+	rebalance := &provider.RebalanceRecommendation{NoticeTime: time.Now().Add(-time.Minute)}
+	notice := &provider.TerminationNotice{Action: "terminate", Time: time.Now().Add(2 * time.Minute)}
+	for range 5 {
+		tracker.ObserveNotice(notice)
+		tracker.ObserveRebalance(rebalance)
+	}
+
+	if got := testutil.ToFloat64(tracker.rebalances); got != 1 {
+		t.Errorf("rebalance recommendations = %v, want 1", got)
+	}
+	if got := testutil.ToFloat64(tracker.rebalancesFollowed); got != 1 {
+		t.Errorf("rebalances followed by termination = %v, want 1", got)
+	}
+	var histogram dto.Metric
+	if err := tracker.rebalanceToTermination.Write(&histogram); err != nil {
+		t.Fatal(err)
+	}
+	if got := histogram.GetHistogram().GetSampleCount(); got != 1 {
+		t.Errorf("rebalance to termination observations = %v, want 1", got)
+	}
+	// the handlers run in goroutines of their own
+	deadline := time.Now().Add(time.Second)
+	for events.Load() < 2 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if got := events.Load(); got != 2 {
+		t.Errorf("event handler called %d times, want 2", got)
+	}
+
+	// a new recommendation is counted again
+	tracker.ObserveRebalance(&provider.RebalanceRecommendation{NoticeTime: time.Now()})
+	if got := testutil.ToFloat64(tracker.rebalances); got != 2 {
+		t.Errorf("rebalance recommendations after a new one = %v, want 2", got)
+	}
+}
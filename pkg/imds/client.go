@@ -0,0 +1,515 @@
+// Package imds implements a minimal client for the EC2 instance metadata
+// service, including IMDSv2 session token handling.
+package imds
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	neturl "net/url"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// DefaultMetadataEndpoint is the base URL of the meta-data tree.
+	DefaultMetadataEndpoint = "http://169.254.169.254/latest/meta-data/"
+	// DefaultTokenEndpoint is the URL IMDSv2 session tokens are requested from.
+	DefaultTokenEndpoint = "http://169.254.169.254/latest/api/token"
+	// TokenTTL is the default lifetime requested for IMDSv2 session tokens,
+	// and the longest the metadata service accepts.
+	TokenTTL = 21600 * time.Second
+	// MinTokenTTL is the shortest lifetime the metadata service accepts.
+	MinTokenTTL = time.Second
+	// requestTimeout limits each request to the metadata service, which is
+	// local and answers quickly when it answers at all.
+	requestTimeout = time.Second
+	// maxDrain is the most of an unread response body read before closing
+	// it, so the connection can be reused without reading a huge body.
+	maxDrain = 64 << 10
+	// minTokenBackoff and maxTokenBackoff bound the time token requests are
+	// skipped after failing when falling back to IMDSv1.
+	minTokenBackoff = 10 * time.Second
+	maxTokenBackoff = 5 * time.Minute
+)
+
+// defaultTransport is shared by the clients created without a transport, so
+// they reuse its idle connections.
+var defaultTransport = NewTransport(nil, false)
+
+// Client reads paths below the meta-data tree of the instance metadata
+// service. When IMDSv2 is enabled a session token is requested on first use
+// and cached until shortly before it expires, or until the metadata service
+// rejects it, e.g. after the instance was stopped and started. Fallback
+// endpoints added with AddFallback are tried in order when an endpoint can't
+// be reached. A Client is safe for concurrent use.
+type Client struct {
+	useIMDSv2       bool
+	allowV1Fallback bool
+	tokenTTL        time.Duration
+	client          *http.Client
+	// tokenClient is used for token requests, which may need a longer
+	// timeout than metadata requests.
+	tokenClient *http.Client
+
+	mu           sync.Mutex
+	endpoints    []endpoint
+	tokens       map[string]cachedToken
+	tokenFlights map[string]*tokenFlight
+	tokenFails   map[string]tokenBackoff
+	lastEndpoint string
+	hopLimit     bool
+	fallbackV1   bool
+}
+
+type endpoint struct {
+	metadata string
+	token    string
+}
+
+type cachedToken struct {
+	token    string
+	obtained time.Time
+	ttl      time.Duration
+}
+
+// tokenBackoff is the time token requests to an endpoint are skipped after
+// they failed, doubling with each further failure.
+type tokenBackoff struct {
+	until   time.Time
+	backoff time.Duration
+}
+
+// tokenFlight is a token request in progress, shared by the requests needing
+// a token meanwhile. token and err are set before done is closed.
+type tokenFlight struct {
+	done  chan struct{}
+	token string
+	err   error
+}
+
+// Token describes an IMDSv2 session token cached by a Client.
+type Token struct {
+	// Endpoint is the token endpoint the token was obtained from.
+	Endpoint string
+	Obtained time.Time
+	TTL      time.Duration
+}
+
+// Tokens returns the IMDSv2 session tokens currently cached, one per token
+// endpoint, ordered by endpoint.
+func (c *Client) Tokens() []Token {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	tokens := make([]Token, 0, len(c.tokens))
+	for endpoint, cached := range c.tokens {
+		tokens = append(tokens, Token{Endpoint: endpoint, Obtained: cached.obtained, TTL: cached.ttl})
+	}
+	slices.SortFunc(tokens, func(a, b Token) int { return strings.Compare(a.Endpoint, b.Endpoint) })
+	return tokens
+}
+
+// NewTransport returns a transport for requests to a metadata service using
+// tlsConfig for https endpoints when it is non-nil. With noProxy it ignores the
+// HTTP_PROXY and HTTPS_PROXY environment variables, as the link-local metadata
+// endpoints are usually unreachable through a proxy. Connections are kept
+// alive between polls, enough of them for the collectors polling
+// concurrently.
+func NewTransport(tlsConfig *tls.Config, noProxy bool) *http.Transport {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+	if noProxy {
+		transport.Proxy = nil
+	}
+	transport.MaxIdleConnsPerHost = 8
+	transport.IdleConnTimeout = 90 * time.Second
+	return transport
+}
+
+// NewHTTPClient returns a client for requests to a metadata service using
+// transport, or a transport shared by all such clients if it is nil. It is
+// meant to be created once and reused, so connections are kept alive.
+func NewHTTPClient(transport http.RoundTripper) *http.Client {
+	if transport == nil {
+		transport = defaultTransport
+	}
+	return &http.Client{
+		Timeout:   requestTimeout,
+		Transport: transport,
+	}
+}
+
+// DrainAndClose reads what is left of a response body, up to a limit, and
+// closes it, so the connection can be reused for the next request.
+func DrainAndClose(body io.ReadCloser) {
+	io.Copy(io.Discard, io.LimitReader(body, maxDrain))
+	body.Close()
+}
+
+// NewClient returns a Client for the given endpoints, falling back to the
+// default endpoints when they are empty.
+func NewClient(metadataEndpoint, tokenEndpoint string, useIMDSv2 bool) *Client {
+	if metadataEndpoint == "" {
+		metadataEndpoint = DefaultMetadataEndpoint
+	}
+	if tokenEndpoint == "" {
+		tokenEndpoint = DefaultTokenEndpoint
+	}
+	return &Client{
+		useIMDSv2:    useIMDSv2,
+		tokenTTL:     TokenTTL,
+		client:       NewHTTPClient(nil),
+		tokenClient:  NewHTTPClient(nil),
+		endpoints:    []endpoint{{metadata: metadataEndpoint, token: tokenEndpoint}},
+		tokens:       map[string]cachedToken{},
+		tokenFlights: map[string]*tokenFlight{},
+		tokenFails:   map[string]tokenBackoff{},
+	}
+}
+
+// AddFallback adds an endpoint to try when the ones added before can't be
+// reached, e.g. the IPv6 address of the metadata service or a local proxy.
+func (c *Client) AddFallback(metadataEndpoint, tokenEndpoint string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.endpoints = append(c.endpoints, endpoint{metadata: metadataEndpoint, token: tokenEndpoint})
+}
+
+// LastEndpoint returns the metadata endpoint which served the last successful
+// request, or an empty string before the first one.
+func (c *Client) LastEndpoint() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.lastEndpoint
+}
+
+// SetV1Fallback makes requests fall back to IMDSv1 when no IMDSv2 token can be
+// obtained, rather than failing.
+func (c *Client) SetV1Fallback(allow bool) {
+	c.allowV1Fallback = allow
+}
+
+// FallbackV1 reports whether the last request fell back to IMDSv1.
+func (c *Client) FallbackV1() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.fallbackV1
+}
+
+// SetTokenTTL sets the lifetime requested for IMDSv2 session tokens, which
+// must be whole seconds between MinTokenTTL and TokenTTL. Tokens are
+// refreshed when a tenth of their lifetime, at most a minute, is left.
+func (c *Client) SetTokenTTL(ttl time.Duration) error {
+	if ttl < MinTokenTTL || ttl > TokenTTL || ttl%time.Second != 0 {
+		return fmt.Errorf("token TTL %s must be whole seconds between %s and %s", ttl, MinTokenTTL, TokenTTL)
+	}
+	c.tokenTTL = ttl
+	return nil
+}
+
+// SetTransport sets the transport used for requests, e.g. one created by
+// NewTransport. nil uses a transport shared by all clients. It resets the
+// timeouts, so it has to be called before SetTimeouts.
+func (c *Client) SetTransport(transport http.RoundTripper) {
+	c.client = NewHTTPClient(transport)
+	c.tokenClient = NewHTTPClient(transport)
+}
+
+// SetTimeouts sets the timeouts of metadata requests and of IMDSv2 token
+// requests, which often need longer, e.g. on the slow first boot path or
+// when the response to the PUT crosses an extra hop. Zero keeps the default
+// of a second.
+func (c *Client) SetTimeouts(request, token time.Duration) {
+	if request > 0 {
+		c.client.Timeout = request
+	}
+	if token > 0 {
+		c.tokenClient.Timeout = token
+	}
+}
+
+// Get fetches a path below the metadata endpoint, e.g. "instance-id". It
+// reports whether the path was found rather than returning an error for a
+// 404, as several paths only exist while a notice is pending.
+func (c *Client) Get(ctx context.Context, path string) ([]byte, bool, error) {
+	return c.getFirst(ctx, path, func(e endpoint) string { return e.metadata + path })
+}
+
+// GetDynamic fetches a path below the dynamic tree next to the meta-data tree,
+// e.g. "instance-identity-document", like Get.
+func (c *Client) GetDynamic(ctx context.Context, path string) ([]byte, bool, error) {
+	return c.getFirst(ctx, "dynamic/"+path, func(e endpoint) string { return dynamicURL(e.metadata, path) })
+}
+
+// getFirst fetches the URL built for each endpoint in turn until one answers.
+// path identifies the request in metrics.
+func (c *Client) getFirst(ctx context.Context, path string, url func(e endpoint) string) ([]byte, bool, error) {
+	client := c.client
+
+	var errs []error
+	for _, e := range c.getEndpoints() {
+		body, found, err := c.get(ctx, client, e, path, url(e))
+		if err == nil {
+			c.mu.Lock()
+			c.lastEndpoint = e.metadata
+			c.mu.Unlock()
+			return body, found, nil
+		}
+		errs = append(errs, fmt.Errorf("%s: %w", e.metadata, err))
+	}
+	return nil, false, errors.Join(errs...)
+}
+
+func (c *Client) get(ctx context.Context, client *http.Client, e endpoint, path, url string) ([]byte, bool, error) {
+	token := ""
+	if c.useIMDSv2 && c.allowV1Fallback && c.skipToken(e.token) {
+		// a hop limit dropping the PUT would otherwise make every request
+		// wait for the token timeout first
+		c.mu.Lock()
+		c.fallbackV1 = true
+		c.mu.Unlock()
+	} else if c.useIMDSv2 {
+		maybeToken, err := c.getToken(ctx, c.tokenClient, e.token)
+		c.checkHopLimit(ctx, client, e, err)
+		if c.allowV1Fallback {
+			c.recordTokenResult(e.token, err)
+		}
+		if err != nil && !c.allowV1Fallback {
+			return nil, false, fmt.Errorf("couldn't fetch token for IMDSv2: %w", err)
+		}
+		if err != nil {
+			WithError(err).Debug("couldn't fetch token for IMDSv2, falling back to IMDSv1")
+		}
+		c.mu.Lock()
+		c.fallbackV1 = err != nil
+		c.mu.Unlock()
+		token = maybeToken
+	}
+
+	resp, err := getResponse(ctx, client, url, token)
+	if err == nil && resp.StatusCode == http.StatusUnauthorized && token != "" {
+		// the cached token is no longer accepted, retry once with a new one
+		RecordPoll(path, resp.StatusCode, nil)
+		DrainAndClose(resp.Body)
+		c.invalidateToken(e.token, token)
+		if token, err = c.getToken(ctx, c.tokenClient, e.token); err != nil {
+			return nil, false, fmt.Errorf("couldn't fetch token for IMDSv2: %w", err)
+		}
+		resp, err = getResponse(ctx, client, url, token)
+	}
+	if err != nil {
+		RecordPoll(path, 0, err)
+		return nil, false, err
+	}
+	RecordPoll(path, resp.StatusCode, nil)
+	defer DrainAndClose(resp.Body)
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return nil, false, nil
+	default:
+		return nil, false, &StatusError{Code: resp.StatusCode}
+	}
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, false, err
+	}
+	return body, true, nil
+}
+
+// dynamicURL returns the URL of path below the dynamic tree next to the
+// meta-data tree of metadataEndpoint.
+func dynamicURL(metadataEndpoint, path string) string {
+	base, err := neturl.Parse(metadataEndpoint)
+	if err != nil {
+		return metadataEndpoint + "../dynamic/" + path
+	}
+	return base.ResolveReference(&neturl.URL{Path: "../dynamic/" + path}).String()
+}
+
+// HopLimitBlocked reports whether the last token request looked blocked by
+// the instance's HttpPutResponseHopLimit: the PUT timed out while a GET was
+// answered.
+func (c *Client) HopLimitBlocked() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.hopLimit
+}
+
+// checkHopLimit diagnoses a failed token request. A PUT timing out while a GET
+// is answered, even with 401 when IMDSv1 is disabled, is the signature of a
+// hop limit of 1 on an instance where the exporter runs in a container, as
+// the response to the PUT is dropped after the first hop.
+func (c *Client) checkHopLimit(ctx context.Context, client *http.Client, e endpoint, tokenErr error) {
+	blocked := false
+	var netErr net.Error
+	if tokenErr != nil && errors.As(tokenErr, &netErr) && netErr.Timeout() {
+		if resp, err := getResponse(ctx, client, e.metadata+"instance-id", ""); err == nil {
+			DrainAndClose(resp.Body)
+			blocked = true
+		}
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if blocked && !c.hopLimit {
+		log.Warnf("IMDSv2 token request to %s timed out while the metadata service answers GET requests. "+
+			"This usually means the instance's HttpPutResponseHopLimit is 1 while the exporter runs in a container; "+
+			"raise it to 2 in the launch template or with `aws ec2 modify-instance-metadata-options --http-put-response-hop-limit 2`, "+
+			"or run the exporter with hostNetwork", e.token)
+	}
+	c.hopLimit = blocked
+}
+
+// Token returns the cached IMDSv2 session token of the first endpoint,
+// requesting a new one when none is cached or the cached one is about to
+// expire.
+func (c *Client) Token(ctx context.Context) (string, error) {
+	return c.getToken(ctx, c.tokenClient, c.getEndpoints()[0].token)
+}
+
+// Available checks that the instance-id can be read from any endpoint, trying
+// to obtain an IMDSv2 token first in case IMDSv1 is disabled.
+func (c *Client) Available(ctx context.Context) bool {
+	for _, e := range c.getEndpoints() {
+		if available(ctx, c.client, c.tokenClient, e) {
+			return true
+		}
+	}
+	return false
+}
+
+func available(ctx context.Context, client, tokenClient *http.Client, e endpoint) bool {
+	token, _ := getIMDSv2Token(ctx, tokenClient, e.token, TokenTTL)
+	resp, err := getResponse(ctx, client, e.metadata+"instance-id", token)
+	if err != nil {
+		return false
+	}
+	defer DrainAndClose(resp.Body)
+	body, err := io.ReadAll(resp.Body)
+	return err == nil && resp.StatusCode == http.StatusOK && strings.HasPrefix(string(body), "i-")
+}
+
+func (c *Client) getEndpoints() []endpoint {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.endpoints
+}
+
+// getToken returns the cached token of tokenEndpoint, or requests a new one.
+// Concurrent callers share a single request, which is made without holding
+// c.mu so other requests aren't blocked by a slow token endpoint.
+func (c *Client) getToken(ctx context.Context, client *http.Client, tokenEndpoint string) (string, error) {
+	c.mu.Lock()
+	if cached, ok := c.tokens[tokenEndpoint]; ok && time.Since(cached.obtained) < c.tokenTTL-min(c.tokenTTL/10, time.Minute) {
+		c.mu.Unlock()
+		return cached.token, nil
+	}
+	f, inFlight := c.tokenFlights[tokenEndpoint]
+	if !inFlight {
+		f = &tokenFlight{done: make(chan struct{})}
+		c.tokenFlights[tokenEndpoint] = f
+	}
+	ttl := c.tokenTTL
+	c.mu.Unlock()
+
+	if inFlight {
+		select {
+		case <-f.done:
+			return f.token, f.err
+		case <-ctx.Done():
+			return "", ctx.Err()
+		}
+	}
+
+	f.token, f.err = getIMDSv2Token(ctx, client, tokenEndpoint, ttl)
+	c.mu.Lock()
+	delete(c.tokenFlights, tokenEndpoint)
+	if f.err == nil {
+		c.tokens[tokenEndpoint] = cachedToken{token: f.token, obtained: time.Now(), ttl: ttl}
+		tokenRenewals.Inc()
+	}
+	c.mu.Unlock()
+	close(f.done)
+	return f.token, f.err
+}
+
+// skipToken tells whether token requests to tokenEndpoint are skipped after
+// failing.
+func (c *Client) skipToken(tokenEndpoint string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return time.Now().Before(c.tokenFails[tokenEndpoint].until)
+}
+
+// recordTokenResult starts skipping token requests to tokenEndpoint for
+// twice as long as the last time if err is set, or stops skipping them.
+func (c *Client) recordTokenResult(tokenEndpoint string, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err == nil {
+		delete(c.tokenFails, tokenEndpoint)
+		return
+	}
+	fail := c.tokenFails[tokenEndpoint]
+	if time.Now().Before(fail.until) {
+		// a concurrent request shared the failed token request
+		return
+	}
+	fail.backoff = min(max(2*fail.backoff, minTokenBackoff), maxTokenBackoff)
+	fail.until = time.Now().Add(fail.backoff)
+	c.tokenFails[tokenEndpoint] = fail
+	WithError(err).Debugf("skipping IMDSv2 token requests to %s for %s", tokenEndpoint, fail.backoff)
+}
+
+// invalidateToken drops the cached token of tokenEndpoint if it is still
+// token, so the next request obtains a new one.
+func (c *Client) invalidateToken(tokenEndpoint, token string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if cached, ok := c.tokens[tokenEndpoint]; ok && cached.token == token {
+		delete(c.tokens, tokenEndpoint)
+	}
+}
+
+func getIMDSv2Token(ctx context.Context, client *http.Client, url string, ttl time.Duration) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, "PUT", url, nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Add("X-aws-ec2-metadata-token-ttl-seconds", fmt.Sprint(int(ttl.Seconds())))
+	resp, err := client.Do(req)
+	if err != nil {
+		RecordPoll(TokenPath, 0, err)
+		return "", err
+	}
+	RecordPoll(TokenPath, resp.StatusCode, nil)
+	defer DrainAndClose(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		return "", &StatusError{Code: resp.StatusCode}
+	}
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	return string(body), nil
+}
+
+func getResponse(ctx context.Context, client *http.Client, url, token string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	if token != "" {
+		req.Header.Add("X-aws-ec2-metadata-token", token)
+	}
+	return client.Do(req)
+}
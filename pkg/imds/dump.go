@@ -0,0 +1,106 @@
+package imds
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"maps"
+	"net/http"
+	"slices"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// maxDump is the most of a response body logged by DumpTransport.
+const maxDump = 4 << 10
+
+// redacted replaces the secrets in dumps.
+const redacted = "REDACTED"
+
+// secretHeaders are the headers carrying metadata tokens.
+var secretHeaders = []string{
+	"X-Aws-Ec2-Metadata-Token",
+	"X-Aliyun-Ecs-Metadata-Token",
+	"Authorization",
+}
+
+// secretPaths are parts of the paths whose responses hold secrets, e.g. the
+// token itself or the credentials of the instance role.
+var secretPaths = []string{"token", "credentials"}
+
+// DumpTransport logs every request and its response at debug level, for
+// troubleshooting. Tokens, token headers and credentials are always
+// redacted, so the logs can be shared.
+type DumpTransport struct {
+	next http.RoundTripper
+}
+
+// NewDumpTransport returns a DumpTransport sending the requests with next, or
+// the transport shared by the clients created without one if next is nil.
+func NewDumpTransport(next http.RoundTripper) *DumpTransport {
+	if next == nil {
+		next = defaultTransport
+	}
+	return &DumpTransport{next: next}
+}
+
+func (t *DumpTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if log.GetLevel() < log.DebugLevel {
+		return t.next.RoundTrip(req)
+	}
+	var dump strings.Builder
+	fmt.Fprintf(&dump, "%s %s\n", req.Method, req.URL)
+	dumpHeaders(&dump, req.Header)
+
+	resp, err := t.next.RoundTrip(req)
+	if err != nil {
+		log.WithError(err).Debugf("metadata request failed:\n%s", dump.String())
+		return nil, err
+	}
+	fmt.Fprintf(&dump, "\n%s\n", resp.Status)
+	dumpHeaders(&dump, resp.Header)
+	if secretResponse(req) {
+		fmt.Fprintf(&dump, "\n%s\n", redacted)
+	} else {
+		body, err := io.ReadAll(io.LimitReader(resp.Body, maxDump))
+		// the response is read by the caller afterwards
+		resp.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(body), resp.Body), resp.Body}
+		if err != nil {
+			fmt.Fprintf(&dump, "\ncouldn't read body: %s\n", err)
+		} else {
+			fmt.Fprintf(&dump, "\n%s\n", body)
+		}
+	}
+	log.Debugf("metadata request:\n%s", dump.String())
+	return resp, nil
+}
+
+// dumpHeaders writes headers sorted by name, redacting the secret ones.
+func dumpHeaders(dump *strings.Builder, headers http.Header) {
+	for _, name := range slices.Sorted(maps.Keys(headers)) {
+		for _, value := range headers[name] {
+			if slices.Contains(secretHeaders, http.CanonicalHeaderKey(name)) {
+				value = redacted
+			}
+			fmt.Fprintf(dump, "%s: %s\n", name, value)
+		}
+	}
+}
+
+// secretResponse reports whether the response to req holds a secret.
+func secretResponse(req *http.Request) bool {
+	if req.Method == http.MethodPut {
+		return true
+	}
+	path := strings.ToLower(req.URL.Path)
+	for _, secret := range secretPaths {
+		if strings.Contains(path, secret) {
+			return true
+		}
+	}
+	return false
+}
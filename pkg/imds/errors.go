@@ -0,0 +1,82 @@
+package imds
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"syscall"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Types of errors told apart by ClassifyError, besides the status codes of
+// unexpected responses.
+const (
+	ErrorTimeout           = "timeout"
+	ErrorConnectionRefused = "connection-refused"
+	ErrorDNS               = "dns"
+	ErrorParse             = "parse-error"
+	ErrorOther             = "other"
+)
+
+// StatusError is returned for a response with an unexpected status code.
+type StatusError struct {
+	Code int
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("unexpected status code %d", e.Code)
+}
+
+// ParseError is returned for a response which couldn't be parsed.
+type ParseError struct {
+	Path string
+	Err  error
+}
+
+func (e *ParseError) Error() string {
+	return fmt.Sprintf("couldn't parse %s: %s", e.Path, e.Err)
+}
+
+func (e *ParseError) Unwrap() error {
+	return e.Err
+}
+
+// RecordParseError counts a response for path which couldn't be parsed, and
+// returns err as a ParseError.
+func RecordParseError(path string, err error) error {
+	errorsByType.WithLabelValues(path, ErrorParse).Inc()
+	return &ParseError{Path: path, Err: err}
+}
+
+// ClassifyError returns the type of err: ErrorTimeout, ErrorConnectionRefused,
+// ErrorDNS, ErrorParse, the status code of a StatusError, e.g. "401", or
+// ErrorOther.
+func ClassifyError(err error) string {
+	var statusErr *StatusError
+	var parseErr *ParseError
+	var dnsErr *net.DNSError
+	var netErr net.Error
+	switch {
+	case errors.As(err, &statusErr):
+		return strconv.Itoa(statusErr.Code)
+	case errors.As(err, &parseErr):
+		return ErrorParse
+	// checked before timeouts, as resolvers time out too
+	case errors.As(err, &dnsErr):
+		return ErrorDNS
+	case errors.Is(err, context.DeadlineExceeded), errors.As(err, &netErr) && netErr.Timeout():
+		return ErrorTimeout
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return ErrorConnectionRefused
+	}
+	return ErrorOther
+}
+
+// WithError returns a log entry with err and its type as the error_type
+// field, so failures can be told apart in structured logs.
+func WithError(err error) *log.Entry {
+	return log.WithError(err).WithField("error_type", ClassifyError(err))
+}
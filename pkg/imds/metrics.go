@@ -0,0 +1,57 @@
+package imds
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// TokenPath is the path token requests are recorded under by RecordPoll.
+const TokenPath = "api/token"
+
+var (
+	polls = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "spot_exporter_polls_total",
+		Help: "Requests to the metadata service by path and result",
+	}, []string{"endpoint", "result"})
+	responses = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "spot_exporter_imds_responses_total",
+		Help: "Responses of the metadata service by path and status code",
+	}, []string{"path", "code"})
+	errorsByType = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "spot_exporter_imds_errors_total",
+		Help: "Failed requests to the metadata service by path and error type",
+	}, []string{"path", "error_type"})
+	tokenRenewals = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "spot_exporter_imdsv2_token_renewals_total",
+		Help: "IMDSv2 session tokens obtained, including the first one",
+	})
+)
+
+// RegisterMetrics registers the metadata request metrics with registerer.
+func RegisterMetrics(registerer prometheus.Registerer) {
+	registerer.MustRegister(polls, responses, errorsByType, tokenRenewals)
+}
+
+// RecordPoll counts a request for path, relative to the metadata endpoint
+// and without query parameters, and its response unless err is non-nil. It
+// failed if err is non-nil or statusCode is neither 200 nor 404, which
+// several paths return while no notice is pending. Failures are also counted
+// by their type, see ClassifyError.
+func RecordPoll(path string, statusCode int, err error) {
+	path, _, _ = strings.Cut(path, "?")
+	switch {
+	case err != nil:
+		polls.WithLabelValues(path, "failure").Inc()
+		errorsByType.WithLabelValues(path, ClassifyError(err)).Inc()
+		return
+	case statusCode != http.StatusOK && statusCode != http.StatusNotFound:
+		polls.WithLabelValues(path, "failure").Inc()
+		errorsByType.WithLabelValues(path, strconv.Itoa(statusCode)).Inc()
+	default:
+		polls.WithLabelValues(path, "success").Inc()
+	}
+	responses.WithLabelValues(path, strconv.Itoa(statusCode)).Inc()
+}
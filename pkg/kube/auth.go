@@ -0,0 +1,158 @@
+package kube
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	authenticationv1 "k8s.io/api/authentication/v1"
+	authorizationv1 "k8s.io/api/authorization/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// RequestAuthorizer authenticates requests presenting a bearer token with a
+// TokenReview and authorizes them with a SubjectAccessReview for the request
+// path, like the kubelet does, so RBAC controls who may scrape the exporter.
+// The exporter needs permission to create tokenreviews and
+// subjectaccessreviews. Decisions are cached by token and path.
+type RequestAuthorizer struct {
+	cfg      Config
+	cacheTTL time.Duration
+
+	mu        sync.Mutex
+	clientset kubernetes.Interface
+	decisions map[[sha256.Size]byte]decision
+}
+
+type decision struct {
+	allowed bool
+	reason  string
+	decided time.Time
+}
+
+// NewRequestAuthorizer returns a RequestAuthorizer caching decisions for
+// cacheTTL.
+func NewRequestAuthorizer(cfg Config, cacheTTL time.Duration) *RequestAuthorizer {
+	return &RequestAuthorizer{
+		cfg:       cfg,
+		cacheTTL:  cacheTTL,
+		decisions: map[[sha256.Size]byte]decision{},
+	}
+}
+
+// Wrap returns a handler serving requests allowed to GET their path with
+// next, answering 401 to requests without a valid token and 403 to those not
+// allowed.
+func (a *RequestAuthorizer) Wrap(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || token == "" {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		allowed, reason, err := a.Authorize(r.Context(), token, r.URL.Path)
+		switch {
+		case err != nil:
+			log.WithError(err).Error("Failed to review request")
+			http.Error(w, "couldn't review request", http.StatusInternalServerError)
+		case !allowed:
+			log.Debugf("denied request to %s: %s", r.URL.Path, reason)
+			http.Error(w, "forbidden: "+reason, http.StatusForbidden)
+		default:
+			next.ServeHTTP(w, r)
+		}
+	})
+}
+
+// Authorize reports whether the user the token belongs to may GET path, and
+// if not, why.
+func (a *RequestAuthorizer) Authorize(ctx context.Context, token, path string) (bool, string, error) {
+	key := sha256.Sum256([]byte(token + "\x00" + path))
+	a.mu.Lock()
+	cached, ok := a.decisions[key]
+	a.mu.Unlock()
+	if ok && time.Since(cached.decided) < a.cacheTTL {
+		return cached.allowed, cached.reason, nil
+	}
+
+	allowed, reason, err := a.review(ctx, token, path)
+	if err != nil {
+		return false, "", err
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	// drop expired decisions, so tokens which aren't used anymore don't pile
+	// up
+	for k, d := range a.decisions {
+		if time.Since(d.decided) >= a.cacheTTL {
+			delete(a.decisions, k)
+		}
+	}
+	a.decisions[key] = decision{allowed: allowed, reason: reason, decided: time.Now()}
+	return allowed, reason, nil
+}
+
+func (a *RequestAuthorizer) review(ctx context.Context, token, path string) (bool, string, error) {
+	cs, err := a.getClientset()
+	if err != nil {
+		return false, "", err
+	}
+	ctx, cancel := context.WithTimeout(ctx, a.cfg.timeout())
+	defer cancel()
+
+	tokenReview, err := cs.AuthenticationV1().TokenReviews().Create(ctx, &authenticationv1.TokenReview{
+		Spec: authenticationv1.TokenReviewSpec{Token: token},
+	}, metav1.CreateOptions{})
+	if err != nil {
+		return false, "", fmt.Errorf("create tokenreview: %w", err)
+	}
+	if !tokenReview.Status.Authenticated {
+		return false, "token not authenticated", nil
+	}
+
+	user := tokenReview.Status.User
+	extra := map[string]authorizationv1.ExtraValue{}
+	for k, v := range user.Extra {
+		extra[k] = authorizationv1.ExtraValue(v)
+	}
+	accessReview, err := cs.AuthorizationV1().SubjectAccessReviews().Create(ctx, &authorizationv1.SubjectAccessReview{
+		Spec: authorizationv1.SubjectAccessReviewSpec{
+			User:   user.Username,
+			UID:    user.UID,
+			Groups: user.Groups,
+			Extra:  extra,
+			NonResourceAttributes: &authorizationv1.NonResourceAttributes{
+				Path: path,
+				Verb: "get",
+			},
+		},
+	}, metav1.CreateOptions{})
+	if err != nil {
+		return false, "", fmt.Errorf("create subjectaccessreview: %w", err)
+	}
+	if !accessReview.Status.Allowed {
+		return false, fmt.Sprintf("user %q may not get %s", user.Username, path), nil
+	}
+	return true, "", nil
+}
+
+// getClientset returns the clientset, creating it on first use.
+func (a *RequestAuthorizer) getClientset() (kubernetes.Interface, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.clientset == nil {
+		cs, err := newClientset(a.cfg)
+		if err != nil {
+			return nil, err
+		}
+		a.clientset = cs
+	}
+	return a.clientset, nil
+}
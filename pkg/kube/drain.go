@@ -0,0 +1,396 @@
+package kube
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+	policyv1 "k8s.io/api/policy/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/utils/ptr"
+)
+
+const (
+	// DefaultDrainTimeout bounds a whole drain unless set otherwise, as the
+	// node is gone after the notice period anyway.
+	DefaultDrainTimeout = 2 * time.Minute
+	// evictionRetryInterval is how often evictions refused by a
+	// PodDisruptionBudget, and the pods still terminating, are checked.
+	evictionRetryInterval = 2 * time.Second
+)
+
+// EvictionRule selects pods to evict in the wave of its position in the
+// eviction order.
+type EvictionRule struct {
+	// Kind is "namespace", "priority-class" or "annotation".
+	Kind  string
+	Key   string
+	Value string
+}
+
+// ParseEvictionOrder parses comma-separated rules, e.g.
+// "namespace=databases,priority-class=latency-critical,annotation=example.com/evict-first=true".
+// An annotation rule without value matches any value.
+func ParseEvictionOrder(value string) ([]EvictionRule, error) {
+	var rules []EvictionRule
+	for _, item := range strings.Split(value, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		kind, selector, ok := strings.Cut(item, "=")
+		if !ok || selector == "" {
+			return nil, fmt.Errorf("invalid eviction order rule %q, expected kind=selector", item)
+		}
+		rule := EvictionRule{Kind: kind}
+		switch kind {
+		case "namespace", "priority-class":
+			rule.Value = selector
+		case "annotation":
+			rule.Key, rule.Value, _ = strings.Cut(selector, "=")
+		default:
+			return nil, fmt.Errorf("unknown eviction order rule kind %q", kind)
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+func (r EvictionRule) matches(pod *corev1.Pod) bool {
+	switch r.Kind {
+	case "namespace":
+		return pod.Namespace == r.Value
+	case "priority-class":
+		return pod.Spec.PriorityClassName == r.Value
+	case "annotation":
+		value, ok := pod.Annotations[r.Key]
+		return ok && (r.Value == "" || value == r.Value)
+	}
+	return false
+}
+
+// Drainer cordons the node the exporter runs on and evicts its pods on a
+// termination notice, like kubectl drain --ignore-daemonsets, so they are
+// rescheduled before the instance is gone. Pods are evicted in waves: those
+// matching the first rule of the eviction order, then those matching the
+// second, and so on, with the pods matching no rule last, each wave being
+// evicted once the pods of the previous one are gone. DaemonSet pods and
+// static pods are ignored by default, and pods without controller are left
+// alone unless forced.
+type Drainer struct {
+	cfg              Config
+	nodeName         func() (string, error)
+	order            []EvictionRule
+	ignorePDBAfter   time.Duration
+	timeout          time.Duration
+	gracePeriod      time.Duration
+	force            bool
+	ignoreDaemonSets bool
+	ignoreMirrorPods bool
+}
+
+// NewDrainer returns a Drainer draining the node named by nodeName, which is
+// called on the notice, with the pods evicted in the given order. It needs
+// permission to patch nodes, list pods and create pods/eviction.
+func NewDrainer(cfg Config, nodeName func() (string, error), order []EvictionRule) *Drainer {
+	return &Drainer{
+		cfg:              cfg,
+		nodeName:         nodeName,
+		order:            order,
+		timeout:          DefaultDrainTimeout,
+		gracePeriod:      -1,
+		ignoreDaemonSets: true,
+		ignoreMirrorPods: true,
+	}
+}
+
+// SetIgnore sets whether DaemonSet pods and static pods, which are
+// recreated on the node right away, are ignored. A drain not ignoring them
+// fails without evicting any pod when the node runs such pods, like kubectl
+// drain without --ignore-daemonsets.
+func (d *Drainer) SetIgnore(daemonSets, mirrorPods bool) {
+	d.ignoreDaemonSets = daemonSets
+	d.ignoreMirrorPods = mirrorPods
+}
+
+// SetTimeout limits how long the whole drain may take, DefaultDrainTimeout
+// by default.
+func (d *Drainer) SetTimeout(timeout time.Duration) {
+	d.timeout = timeout
+}
+
+// SetGracePeriod overrides the termination grace period of the evicted
+// pods, so they fit within the notice. A negative grace period, the default,
+// keeps the grace period of each pod.
+func (d *Drainer) SetGracePeriod(gracePeriod time.Duration) {
+	d.gracePeriod = gracePeriod
+}
+
+// SetForce makes the drain evict the pods without controller too, like
+// kubectl drain --force. They aren't recreated elsewhere.
+func (d *Drainer) SetForce(force bool) {
+	d.force = force
+}
+
+// deleteOptions returns the options of evictions and deletions.
+func (d *Drainer) deleteOptions(pod *corev1.Pod) *metav1.DeleteOptions {
+	options := &metav1.DeleteOptions{Preconditions: &metav1.Preconditions{UID: &pod.UID}}
+	if d.gracePeriod >= 0 {
+		options.GracePeriodSeconds = ptr.To(int64(d.gracePeriod.Seconds()))
+	}
+	return options
+}
+
+// SetIgnorePDBAfter makes the drain delete the pods whose eviction is still
+// refused by a PodDisruptionBudget after the drain ran for after, rather
+// than letting them die uncleanly with the node. The pods are still given
+// the same grace period as evicted pods. 0, the default, always respects the
+// budgets.
+func (d *Drainer) SetIgnorePDBAfter(after time.Duration) {
+	d.ignorePDBAfter = after
+}
+
+// DryRun reports which pods the drain would evict, in which wave, without
+// cordoning the node or evicting them.
+func (d *Drainer) DryRun() (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), d.cfg.timeout())
+	defer cancel()
+
+	nodeName, err := d.nodeName()
+	if err != nil {
+		return "", err
+	}
+	pods, err := ListNodePods(ctx, d.cfg, nodeName)
+	if err != nil {
+		return "", err
+	}
+	waves, err := d.waves(pods)
+	if err != nil {
+		return "", fmt.Errorf("drain node %s: %w", nodeName, err)
+	}
+	var planned []string
+	for _, wave := range waves {
+		if len(wave) == 0 {
+			continue
+		}
+		names := make([]string, len(wave))
+		for i, pod := range wave {
+			names[i] = pod.Namespace + "/" + pod.Name
+		}
+		planned = append(planned, "["+strings.Join(names, " ")+"]")
+	}
+	return fmt.Sprintf("would cordon node %s and evict pods in waves %s", nodeName, strings.Join(planned, " ")), nil
+}
+
+// Notify drains the node.
+func (d *Drainer) Notify() (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), d.timeout)
+	defer cancel()
+
+	nodeName, err := d.nodeName()
+	if err != nil {
+		return "", err
+	}
+	cs, err := newClientset(d.cfg)
+	if err != nil {
+		return "", err
+	}
+	if err := d.cordon(ctx, cs, nodeName); err != nil {
+		return "", err
+	}
+	pods, err := ListNodePods(ctx, d.cfg, nodeName)
+	if err != nil {
+		return "", err
+	}
+	waves, err := d.waves(pods)
+	if err != nil {
+		return "", fmt.Errorf("drain node %s: %w", nodeName, err)
+	}
+
+	started := time.Now()
+	evicted, deleted := 0, 0
+	for i, wave := range waves {
+		if len(wave) == 0 {
+			continue
+		}
+		log.Infof("Evicting %d pods in wave %d of the drain of node %s", len(wave), i+1, nodeName)
+		forced, err := d.evictWave(ctx, cs, wave, started)
+		deleted += forced
+		if err != nil {
+			return "", fmt.Errorf("drain node %s: evicted %d pods before: %w", nodeName, evicted, err)
+		}
+		evicted += len(wave)
+	}
+	if deleted > 0 {
+		return fmt.Sprintf("cordoned node %s and evicted %d pods, deleting %d despite their PodDisruptionBudgets", nodeName, evicted, deleted), nil
+	}
+	return fmt.Sprintf("cordoned node %s and evicted %d pods", nodeName, evicted), nil
+}
+
+func (d *Drainer) cordon(ctx context.Context, cs kubernetes.Interface, nodeName string) error {
+	ctx, cancel := context.WithTimeout(ctx, d.cfg.timeout())
+	defer cancel()
+	_, err := cs.CoreV1().Nodes().Patch(ctx, nodeName, types.MergePatchType, []byte(`{"spec":{"unschedulable":true}}`), metav1.PatchOptions{})
+	if err != nil {
+		return fmt.Errorf("cordon node %s: %w", nodeName, err)
+	}
+	return nil
+}
+
+// waves returns the pods to evict grouped by the first rule they match, with
+// the pods matching none in the last group. It fails if pods which aren't to
+// be ignored can't be evicted.
+func (d *Drainer) waves(pods []corev1.Pod) ([][]corev1.Pod, error) {
+	waves := make([][]corev1.Pod, len(d.order)+1)
+	var refused []string
+	for _, pod := range pods {
+		evict, err := d.evictable(&pod)
+		if err != nil {
+			refused = append(refused, fmt.Sprintf("%s/%s (%s)", pod.Namespace, pod.Name, err))
+			continue
+		}
+		if !evict {
+			continue
+		}
+		wave := len(d.order)
+		for i, rule := range d.order {
+			if rule.matches(&pod) {
+				wave = i
+				break
+			}
+		}
+		waves[wave] = append(waves[wave], pod)
+	}
+	if len(refused) > 0 {
+		return nil, fmt.Errorf("can't evict pods %s", strings.Join(refused, ", "))
+	}
+	return waves, nil
+}
+
+// evictable reports whether pod is evicted by the drain, failing if it can't
+// be evicted but isn't to be ignored either.
+func (d *Drainer) evictable(pod *corev1.Pod) (bool, error) {
+	if pod.DeletionTimestamp != nil || pod.Status.Phase == corev1.PodSucceeded || pod.Status.Phase == corev1.PodFailed {
+		return false, nil
+	}
+	if _, mirror := pod.Annotations[corev1.MirrorPodAnnotationKey]; mirror {
+		if !d.ignoreMirrorPods {
+			return false, errors.New("static pod")
+		}
+		return false, nil
+	}
+	owner := metav1.GetControllerOf(pod)
+	if owner == nil {
+		if !d.force {
+			log.Warnf("Not evicting pod %s/%s, which has no controller to recreate it", pod.Namespace, pod.Name)
+		}
+		return d.force, nil
+	}
+	if owner.Kind == "DaemonSet" {
+		if !d.ignoreDaemonSets {
+			return false, errors.New("managed by a DaemonSet")
+		}
+		return false, nil
+	}
+	return true, nil
+}
+
+// evictWave evicts pods, retrying the evictions refused by a
+// PodDisruptionBudget, and waits until they are gone. It returns the number
+// of pods deleted despite their budget, once the drain started at started
+// ran for longer than the PDB override allows.
+func (d *Drainer) evictWave(ctx context.Context, cs kubernetes.Interface, pods []corev1.Pod, started time.Time) (int, error) {
+	forced := 0
+	pending := pods
+	for {
+		ignorePDB := d.ignorePDBAfter > 0 && time.Since(started) >= d.ignorePDBAfter
+		var remaining []corev1.Pod
+		for _, pod := range pending {
+			gone, deleted, err := d.evict(ctx, cs, &pod, ignorePDB)
+			if err != nil {
+				return forced, err
+			}
+			if deleted {
+				forced++
+			}
+			if !gone {
+				remaining = append(remaining, pod)
+			}
+		}
+		if len(remaining) == 0 {
+			return forced, nil
+		}
+		pending = remaining
+		select {
+		case <-ctx.Done():
+			return forced, fmt.Errorf("%d pods not evicted in time", len(pending))
+		case <-time.After(evictionRetryInterval):
+		}
+	}
+}
+
+// evict evicts pod if it wasn't yet, returning whether it is gone, and
+// whether it was deleted instead as ignorePDB is set and a
+// PodDisruptionBudget refused the eviction.
+func (d *Drainer) evict(ctx context.Context, cs kubernetes.Interface, pod *corev1.Pod, ignorePDB bool) (bool, bool, error) {
+	ctx, cancel := context.WithTimeout(ctx, d.cfg.timeout())
+	defer cancel()
+
+	current, err := cs.CoreV1().Pods(pod.Namespace).Get(ctx, pod.Name, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) || (err == nil && current.UID != pod.UID) {
+		return true, false, nil
+	}
+	if err != nil {
+		return false, false, fmt.Errorf("get pod %s/%s: %w", pod.Namespace, pod.Name, err)
+	}
+	if current.DeletionTimestamp != nil {
+		return false, false, nil
+	}
+
+	err = cs.PolicyV1().Evictions(pod.Namespace).Evict(ctx, &policyv1.Eviction{
+		ObjectMeta:    metav1.ObjectMeta{Name: pod.Name, Namespace: pod.Namespace},
+		DeleteOptions: d.deleteOptions(pod),
+	})
+	switch {
+	case apierrors.IsNotFound(err):
+		return true, false, nil
+	case refusedByPDB(err) && ignorePDB:
+		log.Warnf("Eviction of pod %s/%s still refused by a PodDisruptionBudget after %s, deleting it", pod.Namespace, pod.Name, d.ignorePDBAfter)
+		err := cs.CoreV1().Pods(pod.Namespace).Delete(ctx, pod.Name, *d.deleteOptions(pod))
+		if err != nil && !apierrors.IsNotFound(err) {
+			return false, false, fmt.Errorf("delete pod %s/%s: %w", pod.Namespace, pod.Name, err)
+		}
+		return false, true, nil
+	case refusedByPDB(err):
+		log.Debugf("eviction of pod %s/%s refused by a PodDisruptionBudget, retrying", pod.Namespace, pod.Name)
+		return false, false, nil
+	case apierrors.IsTooManyRequests(err):
+		log.WithError(err).Debugf("eviction of pod %s/%s throttled by the API server, retrying", pod.Namespace, pod.Name)
+		return false, false, nil
+	case err != nil:
+		return false, false, fmt.Errorf("evict pod %s/%s: %w", pod.Namespace, pod.Name, err)
+	}
+	return false, false, nil
+}
+
+// refusedByPDB tells whether err is an eviction refused by a
+// PodDisruptionBudget, rather than the API server throttling requests,
+// which answers 429 Too Many Requests as well.
+func refusedByPDB(err error) bool {
+	if !apierrors.IsTooManyRequests(err) {
+		return false
+	}
+	if apierrors.HasStatusCause(err, policyv1.DisruptionBudgetCause) {
+		return true
+	}
+	// older API servers don't set the cause
+	var status apierrors.APIStatus
+	return errors.As(err, &status) && strings.Contains(status.Status().Message, "disruption budget")
+}
@@ -0,0 +1,102 @@
+package kube
+
+import (
+	"maps"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+)
+
+// warnedReserved are the keys already warned about being exported under a
+// reserved name, so node updates don't repeat the warning.
+var warnedReserved sync.Map
+
+// LabelFilter selects which node labels are attached to metrics. A label is
+// kept if its key matches Allow, or Allow is nil, and doesn't match Deny.
+type LabelFilter struct {
+	Allow *regexp.Regexp
+	Deny  *regexp.Regexp
+	// Rename maps keys to the label names they are exported as, e.g.
+	// topology.kubernetes.io/zone to zone.
+	Rename map[string]string
+	// StripPrefixes are removed from keys which aren't renamed, the first
+	// matching prefix wins, e.g. node.kubernetes.io/ turns
+	// node.kubernetes.io/instance-type into instance-type.
+	StripPrefixes []string
+	// Reserved are the label names of the metrics themselves. Keys which
+	// would be exported under one of them, or under a name starting with
+	// "__", are dropped with a warning.
+	Reserved map[string]bool
+}
+
+// labelName returns the label name the key is exported as.
+func (f LabelFilter) labelName(key string) string {
+	if name, ok := f.Rename[key]; ok {
+		return SanitizeLabelName(name)
+	}
+	for _, prefix := range f.StripPrefixes {
+		if stripped, ok := strings.CutPrefix(key, prefix); ok && stripped != "" {
+			return SanitizeLabelName(stripped)
+		}
+	}
+	return SanitizeLabelName(key)
+}
+
+// Apply returns the labels kept by the filter, with their keys renamed and
+// sanitized into valid Prometheus label names. Labels whose names are
+// reserved are dropped.
+func (f LabelFilter) Apply(labels map[string]string) prometheus.Labels {
+	filtered := prometheus.Labels{}
+	for key, value := range labels {
+		if f.Allow != nil && !f.Allow.MatchString(key) {
+			continue
+		}
+		if f.Deny != nil && f.Deny.MatchString(key) {
+			continue
+		}
+		name := f.labelName(key)
+		if f.Reserved[name] || strings.HasPrefix(name, "__") {
+			if _, warned := warnedReserved.LoadOrStore(key, true); !warned {
+				log.Warnf("Not attaching %s to metrics, as %s is a reserved label name", key, name)
+			}
+			continue
+		}
+		filtered[name] = value
+	}
+	return filtered
+}
+
+// MetricLabels returns the labels to attach to metrics for node: its labels
+// kept by labelFilter and its annotations kept by annotationFilter. Either
+// filter may be nil to attach nothing of that kind. Labels take precedence
+// over annotations whose sanitized keys collide with them.
+func MetricLabels(node *corev1.Node, labelFilter, annotationFilter *LabelFilter) prometheus.Labels {
+	labels := prometheus.Labels{}
+	if annotationFilter != nil {
+		maps.Copy(labels, annotationFilter.Apply(node.Annotations))
+	}
+	if labelFilter != nil {
+		maps.Copy(labels, labelFilter.Apply(node.Labels))
+	}
+	return labels
+}
+
+// SanitizeLabelName turns a Kubernetes label key such as
+// topology.kubernetes.io/zone into a valid Prometheus label name by replacing
+// invalid characters with underscores.
+func SanitizeLabelName(key string) string {
+	sanitized := strings.Map(func(r rune) rune {
+		if (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') || r == '_' {
+			return r
+		}
+		return '_'
+	}, key)
+	if sanitized == "" || (sanitized[0] >= '0' && sanitized[0] <= '9') {
+		sanitized = "_" + sanitized
+	}
+	return sanitized
+}
@@ -0,0 +1,39 @@
+package kube
+
+import (
+	"maps"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestLabelFilterDropsReservedNames(t *testing.T) {
+	filter := LabelFilter{
+		Rename:        map[string]string{"topology.kubernetes.io/region": "region", "topology.kubernetes.io/zone": "zone"},
+		StripPrefixes: []string{"node.kubernetes.io/", "karpenter.sh/"},
+		Reserved:      map[string]bool{"instance_id": true, "instance_type": true, "region": true},
+	}
+	got := filter.Apply(map[string]string{
+		"topology.kubernetes.io/region":    "eu-west-1",
+		"topology.kubernetes.io/zone":      "eu-west-1a",
+		"node.kubernetes.io/instance-type": "m5.large",
+		"karpenter.sh/nodepool":            "default",
+		"example.com/__internal":           "x",
+		"__meta":                           "x",
+	})
+	want := prometheus.Labels{
+		"zone":                   "eu-west-1a",
+		"nodepool":               "default",
+		"example_com___internal": "x",
+	}
+	if !maps.Equal(got, want) {
+		t.Errorf("Apply() = %v, want %v", got, want)
+	}
+
+	// the labels are valid constant labels of a metric with the reserved
+	// names as variable labels
+	desc := prometheus.NewDesc("test", "test", []string{"instance_id", "instance_type", "region"}, got)
+	if _, err := prometheus.NewConstMetric(desc, prometheus.GaugeValue, 1, "i-0123456789abcdef0", "m5.large", "eu-west-1"); err != nil {
+		t.Errorf("metric with the filtered labels is invalid: %s", err)
+	}
+}
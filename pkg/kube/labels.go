@@ -0,0 +1,254 @@
+// Package kube reads the Kubernetes node the exporter runs on, so its labels
+// can be attached to the exported metrics.
+package kube
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	corev1 "k8s.io/api/core/v1"
+	policyv1 "k8s.io/api/policy/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/clientcmd"
+)
+
+// DefaultTimeout is the timeout of a single API request used when
+// Config.Timeout is zero.
+const DefaultTimeout = 10 * time.Second
+
+// Config configures the client used to talk to the API server.
+type Config struct {
+	// Kubeconfig is the path to a kubeconfig file. When it and Context are
+	// empty the in-cluster service account is tried first.
+	Kubeconfig string
+	// Context selects a context of the kubeconfig other than the current one.
+	Context string
+	// Timeout limits each API request other than watches.
+	Timeout time.Duration
+	// QPS and Burst override the client-side rate limit when non-zero.
+	QPS   float32
+	Burst int
+}
+
+// BuildConfig loads the client configuration from the kubeconfig and context
+// if set, and otherwise from the in-cluster service account or the default
+// kubeconfig.
+func BuildConfig(cfg Config) (*rest.Config, error) {
+	restConfig, err := loadRestConfig(cfg)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.QPS != 0 {
+		restConfig.QPS = cfg.QPS
+	}
+	if cfg.Burst != 0 {
+		restConfig.Burst = cfg.Burst
+	}
+	return restConfig, nil
+}
+
+func loadRestConfig(cfg Config) (*rest.Config, error) {
+	if cfg.Kubeconfig == "" && cfg.Context == "" {
+		// try in-cluster, then default kubeconfig
+		if restConfig, err := rest.InClusterConfig(); err == nil {
+			return restConfig, nil
+		}
+	}
+
+	loadingRules := clientcmd.NewDefaultClientConfigLoadingRules()
+	loadingRules.ExplicitPath = cfg.Kubeconfig
+	return clientcmd.NewNonInteractiveDeferredLoadingClientConfig(
+		loadingRules,
+		&clientcmd.ConfigOverrides{CurrentContext: cfg.Context}).ClientConfig()
+}
+
+// NodeLabels returns the labels of the node named by the NODE_NAME
+// environment variable.
+func NodeLabels(cfg Config) (prometheus.Labels, error) {
+	nodeName, err := NodeName()
+	if err != nil {
+		return nil, err
+	}
+	node, err := GetNode(cfg, nodeName)
+	if err != nil {
+		return nil, err
+	}
+	return node.Labels, nil
+}
+
+// GetNode returns the node with the given name.
+func GetNode(cfg Config, nodeName string) (*corev1.Node, error) {
+
+	cs, err := newClientset(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.timeout())
+
+	defer cancel()
+
+	node, err := cs.CoreV1().Nodes().Get(ctx, nodeName, metav1.GetOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("get node %q: %w", nodeName, err)
+	}
+
+	return node, nil
+}
+
+// Capacity types returned by CapacityType.
+const (
+	CapacityTypeSpot     = "spot"
+	CapacityTypeOnDemand = "on-demand"
+)
+
+// CapacityType returns the capacity type of the node from the
+// karpenter.sh/capacity-type or eks.amazonaws.com/capacityType label,
+// normalized to CapacityTypeSpot or CapacityTypeOnDemand, the lowercased
+// value for other types such as reserved capacity, or "" if neither label is
+// set.
+func CapacityType(node *corev1.Node) string {
+	if value, ok := node.Labels["karpenter.sh/capacity-type"]; ok {
+		return strings.ToLower(value)
+	}
+	// EKS managed node groups use SPOT, ON_DEMAND and CAPACITY_BLOCK
+	if value, ok := node.Labels["eks.amazonaws.com/capacityType"]; ok {
+		return strings.ReplaceAll(strings.ToLower(value), "_", "-")
+	}
+	return ""
+}
+
+// FindNodeName returns the name of the node whose spec.providerID ends with
+// the given instance id, e.g. aws:///us-east-1a/i-0123456789abcdef0. It needs
+// permission to list nodes.
+func FindNodeName(cfg Config, instanceID string) (string, error) {
+	cs, err := newClientset(cfg)
+	if err != nil {
+		return "", err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.timeout())
+	defer cancel()
+
+	nodes, err := cs.CoreV1().Nodes().List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return "", fmt.Errorf("list nodes: %w", err)
+	}
+	for _, node := range nodes.Items {
+		if strings.HasSuffix(node.Spec.ProviderID, "/"+instanceID) {
+			return node.Name, nil
+		}
+	}
+	return "", fmt.Errorf("no node with provider id ending in %q", instanceID)
+}
+
+// ListNodePods returns the pods scheduled on the node with the given name. It
+// needs permission to list pods in all namespaces.
+func ListNodePods(ctx context.Context, cfg Config, nodeName string) ([]corev1.Pod, error) {
+	cs, err := newClientset(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, cfg.timeout())
+	defer cancel()
+
+	pods, err := cs.CoreV1().Pods(metav1.NamespaceAll).List(ctx, metav1.ListOptions{
+		FieldSelector: fields.OneTermEqualSelector("spec.nodeName", nodeName).String(),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("list pods on node %q: %w", nodeName, err)
+	}
+	return pods.Items, nil
+}
+
+// ListPodDisruptionBudgets returns the PodDisruptionBudgets of all
+// namespaces. It needs permission to list poddisruptionbudgets.
+func ListPodDisruptionBudgets(ctx context.Context, cfg Config) ([]policyv1.PodDisruptionBudget, error) {
+	cs, err := newClientset(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, cfg.timeout())
+	defer cancel()
+
+	pdbs, err := cs.PolicyV1().PodDisruptionBudgets(metav1.NamespaceAll).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("list poddisruptionbudgets: %w", err)
+	}
+	return pdbs.Items, nil
+}
+
+// WatchNode calls onChange with the node with the given name when it is first
+// seen and whenever it is updated, until ctx is cancelled. It needs permission
+// to list and watch nodes.
+func WatchNode(ctx context.Context, cfg Config, nodeName string, onChange func(node *corev1.Node)) error {
+	cs, err := newClientset(cfg)
+	if err != nil {
+		return err
+	}
+
+	factory := informers.NewSharedInformerFactoryWithOptions(cs, 0, informers.WithTweakListOptions(func(options *metav1.ListOptions) {
+		options.FieldSelector = fields.OneTermEqualSelector("metadata.name", nodeName).String()
+	}))
+	_, err = factory.Core().V1().Nodes().Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc: func(obj interface{}) {
+			if node, ok := obj.(*corev1.Node); ok {
+				onChange(node)
+			}
+		},
+		UpdateFunc: func(_, obj interface{}) {
+			if node, ok := obj.(*corev1.Node); ok {
+				onChange(node)
+			}
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("add node event handler: %w", err)
+	}
+
+	factory.Start(ctx.Done())
+	<-ctx.Done()
+	factory.Shutdown()
+	return nil
+}
+
+// NodeName returns the node name set in the NODE_NAME environment variable,
+// usually through the downward API.
+func NodeName() (string, error) {
+	nodeName := os.Getenv("NODE_NAME")
+	if nodeName == "" {
+		return "", fmt.Errorf("required NODE_NAME not set")
+	}
+	return nodeName, nil
+}
+
+func newClientset(cfg Config) (kubernetes.Interface, error) {
+	restConfig, err := BuildConfig(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("load config: %w", err)
+	}
+
+	cs, err := kubernetes.NewForConfig(restConfig)
+	if err != nil {
+		return nil, fmt.Errorf("clientset: %w", err)
+	}
+	return cs, nil
+}
+
+func (cfg Config) timeout() time.Duration {
+	if cfg.Timeout == 0 {
+		return DefaultTimeout
+	}
+	return cfg.Timeout
+}
@@ -0,0 +1,47 @@
+package kube
+
+import (
+	"context"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"k8s.io/client-go/tools/leaderelection"
+	"k8s.io/client-go/tools/leaderelection/resourcelock"
+)
+
+// RunLeaderElection competes for the Lease with the given namespace and name
+// as identity, e.g. the pod name, until ctx is cancelled. lead is called with
+// a context cancelled when the leadership is lost, after which the election
+// starts over. It needs permission to get, create and update leases.
+func RunLeaderElection(ctx context.Context, cfg Config, namespace, name, identity string, lead func(ctx context.Context)) error {
+	restConfig, err := BuildConfig(cfg)
+	if err != nil {
+		return err
+	}
+	lock, err := resourcelock.NewFromKubeconfig(resourcelock.LeasesResourceLock, namespace, name,
+		resourcelock.ResourceLockConfig{Identity: identity}, restConfig, cfg.timeout())
+	if err != nil {
+		return err
+	}
+
+	for ctx.Err() == nil {
+		leaderelection.RunOrDie(ctx, leaderelection.LeaderElectionConfig{
+			Lock:            lock,
+			LeaseDuration:   15 * time.Second,
+			RenewDeadline:   10 * time.Second,
+			RetryPeriod:     2 * time.Second,
+			ReleaseOnCancel: true,
+			Name:            name,
+			Callbacks: leaderelection.LeaderCallbacks{
+				OnStartedLeading: func(ctx context.Context) {
+					log.Infof("Became leader of %s/%s", namespace, name)
+					lead(ctx)
+				},
+				OnStoppedLeading: func() {
+					log.Infof("Stopped leading %s/%s", namespace, name)
+				},
+			},
+		})
+	}
+	return nil
+}
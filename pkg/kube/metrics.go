@@ -0,0 +1,62 @@
+package kube
+
+import (
+	"context"
+	"net/url"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"k8s.io/client-go/tools/metrics"
+)
+
+var (
+	requestLatency = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "spot_exporter_kube_request_duration_seconds",
+		Help:    "Latency of the exporter's requests to the Kubernetes API by verb and host",
+		Buckets: prometheus.ExponentialBuckets(0.005, 2, 12),
+	}, []string{"verb", "host"})
+	requestResult = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "spot_exporter_kube_requests_total",
+		Help: "Requests made by the exporter to the Kubernetes API by status code, method and host",
+	}, []string{"code", "method", "host"})
+	requestRetries = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "spot_exporter_kube_request_retries_total",
+		Help: "Requests to the Kubernetes API retried by the exporter by status code, method and host",
+	}, []string{"code", "method", "host"})
+)
+
+// RegisterClientMetrics registers the latency and result metrics of the
+// client-go REST client with registerer. client-go only accepts one set of
+// metrics per process, so only the first call has an effect on client-go.
+func RegisterClientMetrics(registerer prometheus.Registerer) {
+	registerer.MustRegister(requestLatency, requestResult, requestRetries)
+	metrics.Register(metrics.RegisterOpts{
+		RequestLatency: latencyAdapter{requestLatency},
+		RequestResult:  resultAdapter{requestResult},
+		RequestRetry:   retryAdapter{requestRetries},
+	})
+}
+
+type latencyAdapter struct {
+	histogram *prometheus.HistogramVec
+}
+
+func (a latencyAdapter) Observe(_ context.Context, verb string, u url.URL, latency time.Duration) {
+	a.histogram.WithLabelValues(verb, u.Host).Observe(latency.Seconds())
+}
+
+type resultAdapter struct {
+	counter *prometheus.CounterVec
+}
+
+func (a resultAdapter) Increment(_ context.Context, code, method, host string) {
+	a.counter.WithLabelValues(code, method, host).Inc()
+}
+
+type retryAdapter struct {
+	counter *prometheus.CounterVec
+}
+
+func (a retryAdapter) IncrementRetry(_ context.Context, code, method, host string) {
+	a.counter.WithLabelValues(code, method, host).Inc()
+}
@@ -0,0 +1,65 @@
+package notify
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/gjtempleton/spot-termination-exporter/pkg/provider"
+)
+
+// Acknowledgement acknowledges the pending termination notice once the
+// hooks before it completed, so the platform interrupts the instance without
+// waiting for the deadline of the notice, shortening the downtime.
+type Acknowledgement struct {
+	provider     provider.Provider
+	acknowledger provider.EventAcknowledger
+}
+
+// NewAcknowledgement returns an Acknowledgement of the notices read from p.
+// It fails if p can't acknowledge notices.
+func NewAcknowledgement(p provider.Provider) (*Acknowledgement, error) {
+	acknowledger, ok := p.(provider.EventAcknowledger)
+	if !ok {
+		return nil, fmt.Errorf("the provider can't acknowledge notices")
+	}
+	return &Acknowledgement{provider: p, acknowledger: acknowledger}, nil
+}
+
+// notice reads the pending notice again, as the event to acknowledge may
+// have been replaced while the hooks ran.
+func (a *Acknowledgement) notice(ctx context.Context) (*provider.TerminationNotice, error) {
+	notice, err := a.provider.GetTerminationNotice(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if notice == nil || notice.EventID == "" {
+		return nil, nil
+	}
+	return notice, nil
+}
+
+// DryRun tells which event Notify would acknowledge.
+func (a *Acknowledgement) DryRun() (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	notice, err := a.notice(ctx)
+	if err != nil || notice == nil {
+		return "found no event to acknowledge", err
+	}
+	return fmt.Sprintf("would acknowledge event %s", notice.EventID), nil
+}
+
+// Notify acknowledges the pending notice.
+func (a *Acknowledgement) Notify() (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	notice, err := a.notice(ctx)
+	if err != nil || notice == nil {
+		return "found no event to acknowledge", err
+	}
+	if err := a.acknowledger.AcknowledgeEvent(ctx, notice.EventID); err != nil {
+		return "", fmt.Errorf("acknowledge event %s: %w", notice.EventID, err)
+	}
+	return fmt.Sprintf("acknowledged event %s", notice.EventID), nil
+}
@@ -0,0 +1,92 @@
+package notify
+
+import (
+	"cmp"
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gjtempleton/spot-termination-exporter/pkg/collector"
+)
+
+// Batch is a summary of the interruption events a sink got within a batch
+// window.
+type Batch struct {
+	Events []collector.InterruptionEvent `json:"events"`
+	// ByType, ByAvailabilityZone and ByInstanceType count the events, with
+	// "unknown" for events of instances which couldn't be described.
+	ByType             map[string]int `json:"by_type"`
+	ByAvailabilityZone map[string]int `json:"by_availability_zone"`
+	ByInstanceType     map[string]int `json:"by_instance_type"`
+}
+
+// NewBatch returns the Batch of events.
+func NewBatch(events []collector.InterruptionEvent) Batch {
+	batch := Batch{
+		Events:             events,
+		ByType:             map[string]int{},
+		ByAvailabilityZone: map[string]int{},
+		ByInstanceType:     map[string]int{},
+	}
+	for _, event := range events {
+		batch.ByType[event.Type]++
+		batch.ByAvailabilityZone[cmp.Or(event.AvailabilityZone, "unknown")]++
+		batch.ByInstanceType[cmp.Or(event.InstanceType, "unknown")]++
+	}
+	return batch
+}
+
+// Summary returns a one-line description of the batch.
+func (b Batch) Summary() string {
+	return fmt.Sprintf("%d spot interruption events: %s. By availability zone: %s. By instance type: %s",
+		len(b.Events), formatCounts(b.ByType), formatCounts(b.ByAvailabilityZone), formatCounts(b.ByInstanceType))
+}
+
+// formatCounts formats counts as "key count" pairs, largest count first.
+func formatCounts(counts map[string]int) string {
+	keys := slices.SortedFunc(maps.Keys(counts), func(a, b string) int {
+		return cmp.Or(counts[b]-counts[a], strings.Compare(a, b))
+	})
+	parts := make([]string, len(keys))
+	for i, key := range keys {
+		parts[i] = fmt.Sprintf("%s %d", key, counts[key])
+	}
+	return strings.Join(parts, ", ")
+}
+
+// Batcher collects the events sent to each sink within a window starting at
+// the first of them, and flushes them together once the window ends, so a
+// capacity reclaim interrupting many instances at once makes a single
+// notification.
+type Batcher struct {
+	window time.Duration
+	flush  func(sink *Sink, events []collector.InterruptionEvent)
+
+	mu      sync.Mutex
+	pending map[*Sink][]collector.InterruptionEvent
+}
+
+// NewBatcher returns a Batcher calling flush with the events of a sink
+// window after the first of them was added.
+func NewBatcher(window time.Duration, flush func(sink *Sink, events []collector.InterruptionEvent)) *Batcher {
+	return &Batcher{window: window, flush: flush, pending: map[*Sink][]collector.InterruptionEvent{}}
+}
+
+// Add adds event to the batch of sink, starting it if there is none.
+func (b *Batcher) Add(sink *Sink, event collector.InterruptionEvent) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if _, ok := b.pending[sink]; !ok {
+		time.AfterFunc(b.window, func() {
+			b.mu.Lock()
+			events := b.pending[sink]
+			delete(b.pending, sink)
+			b.mu.Unlock()
+			b.flush(sink, events)
+		})
+	}
+	b.pending[sink] = append(b.pending[sink], event)
+}
@@ -0,0 +1,99 @@
+package notify
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"sync"
+	"syscall"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+)
+
+// Child is a process run by the exporter, making it a graceful shutdown
+// wrapper: on a termination notice the child is sent a signal, and killed
+// if it hasn't exited after a grace period.
+type Child struct {
+	cmd         *exec.Cmd
+	signal      syscall.Signal
+	gracePeriod time.Duration
+	done        chan struct{}
+	notified    sync.Once
+}
+
+// StartChild starts args as a child process sharing the standard streams of
+// the exporter, to be sent signal on a termination notice and killed after
+// gracePeriod.
+func StartChild(args []string, signal syscall.Signal, gracePeriod time.Duration) (*Child, error) {
+	cmd := exec.Command(args[0], args[1:]...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	c := &Child{cmd: cmd, signal: signal, gracePeriod: gracePeriod, done: make(chan struct{})}
+	go func() {
+		cmd.Wait()
+		close(c.done)
+	}()
+	return c, nil
+}
+
+// DryRun tells what Notify would do.
+func (c *Child) DryRun() (string, error) {
+	return fmt.Sprintf("would send %s to child pid %d, killing it after %s", unix.SignalName(c.signal), c.cmd.Process.Pid, c.gracePeriod), nil
+}
+
+// Notify sends the signal to the child, and kills it if it is still running
+// after the grace period. Only the first call has an effect, later ones
+// return ErrAlreadyNotified.
+func (c *Child) Notify() (string, error) {
+	pid := c.cmd.Process.Pid
+	var action string
+	var err error
+	first := false
+	c.notified.Do(func() {
+		first = true
+		if err = c.cmd.Process.Signal(c.signal); err != nil {
+			err = fmt.Errorf("send %s to child pid %d: %w", unix.SignalName(c.signal), pid, err)
+			return
+		}
+		action = fmt.Sprintf("sent %s to child pid %d, killing it after %s", unix.SignalName(c.signal), pid, c.gracePeriod)
+		go c.killAfterGracePeriod()
+	})
+	if !first {
+		return "", fmt.Errorf("child pid %d: %w", pid, ErrAlreadyNotified)
+	}
+	return action, err
+}
+
+func (c *Child) killAfterGracePeriod() {
+	select {
+	case <-c.done:
+	case <-time.After(c.gracePeriod):
+		log.Warnf("Child process still running %s after it was signalled, killing it", c.gracePeriod)
+		c.cmd.Process.Kill()
+	}
+}
+
+// Signal forwards sig to the child, e.g. when the exporter is asked to stop.
+func (c *Child) Signal(sig os.Signal) error {
+	return c.cmd.Process.Signal(sig)
+}
+
+// Done is closed once the child exited.
+func (c *Child) Done() <-chan struct{} {
+	return c.done
+}
+
+// ExitCode returns the exit code of the child once it exited, 128 plus the
+// signal number if it was killed by a signal, like a shell.
+func (c *Child) ExitCode() int {
+	if status, ok := c.cmd.ProcessState.Sys().(syscall.WaitStatus); ok && status.Signaled() {
+		return 128 + int(status.Signal())
+	}
+	return c.cmd.ProcessState.ExitCode()
+}
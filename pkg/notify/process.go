@@ -0,0 +1,112 @@
+// Package notify acts on termination notices: it tells co-located processes
+// that the instance is about to be interrupted, so they can shut down
+// gracefully without polling the metadata service themselves, and takes the
+// instance out of DNS.
+package notify
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// Notifier acts on a termination notice, e.g. by signalling a process.
+type Notifier interface {
+	// Notify returns a description of what was done, e.g. for the event
+	// history.
+	Notify() (string, error)
+}
+
+// ErrAlreadyNotified is returned by the Notifiers which only act on the first
+// notice when they are notified again.
+var ErrAlreadyNotified = errors.New("already notified")
+
+// DryRunner is implemented by the Notifiers which can tell what they would
+// do on a notice without doing it.
+type DryRunner interface {
+	DryRun() (string, error)
+}
+
+// Finisher is implemented by the Notifiers which know when their process
+// finished acting on the notice, which is once Done is closed.
+type Finisher interface {
+	Done() <-chan struct{}
+}
+
+// ParseSignal returns the signal named name, e.g. "SIGTERM", "TERM" or "15".
+func ParseSignal(name string) (syscall.Signal, error) {
+	if number, err := strconv.Atoi(name); err == nil {
+		if unix.SignalName(syscall.Signal(number)) == "" {
+			return 0, fmt.Errorf("unknown signal %d", number)
+		}
+		return syscall.Signal(number), nil
+	}
+	name = strings.ToUpper(name)
+	if !strings.HasPrefix(name, "SIG") {
+		name = "SIG" + name
+	}
+	signal := unix.SignalNum(name)
+	if signal == 0 {
+		return 0, fmt.Errorf("unknown signal %q", name)
+	}
+	return signal, nil
+}
+
+// Process is a process to signal on a termination notice, identified by its
+// PID or by a file holding it. The file is read when the process is
+// signalled, so a process restarted since the exporter started is found.
+type Process struct {
+	PID     int
+	PIDFile string
+	Signal  syscall.Signal
+}
+
+// pid returns the PID of the process.
+func (p *Process) pid() (int, error) {
+	pid := p.PID
+	if p.PIDFile != "" {
+		data, err := os.ReadFile(p.PIDFile)
+		if err != nil {
+			return 0, fmt.Errorf("read pid file: %w", err)
+		}
+		pid, err = strconv.Atoi(strings.TrimSpace(string(data)))
+		if err != nil {
+			return 0, fmt.Errorf("invalid pid in %s: %w", p.PIDFile, err)
+		}
+	}
+	if pid <= 0 {
+		return 0, fmt.Errorf("invalid pid %d", pid)
+	}
+	return pid, nil
+}
+
+// DryRun checks that the process exists, without signalling it.
+func (p *Process) DryRun() (string, error) {
+	pid, err := p.pid()
+	if err != nil {
+		return "", err
+	}
+	// signal 0 only checks whether the process can be signalled
+	if err := syscall.Kill(pid, 0); err != nil {
+		return "", fmt.Errorf("pid %d can't be signalled: %w", pid, err)
+	}
+	return fmt.Sprintf("would send %s to pid %d", unix.SignalName(p.Signal), pid), nil
+}
+
+// Notify sends the signal to the process, returning a description of what
+// was done, e.g. for the event history.
+func (p *Process) Notify() (string, error) {
+	pid, err := p.pid()
+	if err != nil {
+		return "", err
+	}
+	if err := syscall.Kill(pid, p.Signal); err != nil {
+		return "", fmt.Errorf("send %s to pid %d: %w", unix.SignalName(p.Signal), pid, err)
+	}
+	return fmt.Sprintf("sent %s to pid %d", unix.SignalName(p.Signal), pid), nil
+}
@@ -0,0 +1,125 @@
+package notify
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/gjtempleton/spot-termination-exporter/pkg/collector"
+	log "github.com/sirupsen/logrus"
+)
+
+// Retry is a notification a sink failed to get, to be sent again.
+type Retry struct {
+	Sink  string                      `json:"sink"`
+	Event collector.InterruptionEvent `json:"event"`
+	// Batch holds the events of a batch, in which case Event is the first
+	// of them.
+	Batch    []collector.InterruptionEvent `json:"batch,omitempty"`
+	Attempts int                           `json:"attempts"`
+	// Next is when to send the notification again, Deadline when to give
+	// up on it.
+	Next     time.Time `json:"next"`
+	Deadline time.Time `json:"deadline"`
+}
+
+// RetryBackoff returns the time to wait before sending a notification again
+// after attempts failed attempts, doubling from 5 seconds up to 5 minutes.
+func RetryBackoff(attempts int) time.Duration {
+	backoff := 5 * time.Second
+	for i := 1; i < attempts && backoff < 5*time.Minute; i++ {
+		backoff *= 2
+	}
+	return min(backoff, 5*time.Minute)
+}
+
+// RetryQueue keeps the notifications to send again, optionally persisted to
+// a file so they are still sent after a restart. It is safe for concurrent
+// use.
+type RetryQueue struct {
+	path string
+
+	mu      sync.Mutex
+	retries []Retry
+}
+
+// NewRetryQueue returns a RetryQueue kept in memory.
+func NewRetryQueue() *RetryQueue {
+	return &RetryQueue{}
+}
+
+// OpenRetryQueue returns a RetryQueue persisted to the file at path and
+// starting with the notifications already in it.
+func OpenRetryQueue(path string) (*RetryQueue, error) {
+	q := &RetryQueue{path: path}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return q, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("read notification queue: %w", err)
+	}
+	if err := json.Unmarshal(data, &q.retries); err != nil {
+		log.WithError(err).Warnf("ignoring invalid notification queue %s", path)
+		q.retries = nil
+	}
+	return q, nil
+}
+
+// Add queues retry.
+func (q *RetryQueue) Add(retry Retry) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.retries = append(q.retries, retry)
+	q.save()
+}
+
+// Due removes and returns the notifications to send again at now.
+func (q *RetryQueue) Due(now time.Time) []Retry {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	var due, pending []Retry
+	for _, retry := range q.retries {
+		if retry.Next.After(now) {
+			pending = append(pending, retry)
+		} else {
+			due = append(due, retry)
+		}
+	}
+	if len(due) > 0 {
+		q.retries = pending
+		q.save()
+	}
+	return due
+}
+
+// Len returns the number of queued notifications.
+func (q *RetryQueue) Len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.retries)
+}
+
+// save writes the queue to its file, if any. The caller must hold q.mu.
+func (q *RetryQueue) save() {
+	if q.path == "" {
+		return
+	}
+	data, err := json.Marshal(q.retries)
+	if err != nil {
+		log.WithError(err).Error("Failed to encode the notification queue")
+		return
+	}
+	// write and rename, so a crash mid-write doesn't leave a truncated file
+	tmp := q.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		log.WithError(err).Error("Failed to write the notification queue")
+		return
+	}
+	if err := os.Rename(tmp, q.path); err != nil {
+		log.WithError(err).Error("Failed to write the notification queue")
+	}
+}
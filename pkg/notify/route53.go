@@ -0,0 +1,222 @@
+package notify
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/route53"
+	r53types "github.com/aws/aws-sdk-go-v2/service/route53/types"
+	"github.com/gjtempleton/spot-termination-exporter/pkg/provider"
+	log "github.com/sirupsen/logrus"
+)
+
+// Route53 actions.
+const (
+	// Route53Delete removes the addresses of the instance from the records,
+	// deleting the records left without addresses.
+	Route53Delete = "delete"
+	// Route53Downweight sets the weight of weighted records of the instance
+	// to 0.
+	Route53Downweight = "downweight"
+)
+
+// Route53Records takes the instance out of Route53 records on a termination
+// notice, for services registering themselves in DNS rather than behind a
+// load balancer. A record set points at the instance if its set identifier
+// is the instance id or its values include an address of the instance.
+// Alias records are left alone.
+type Route53Records struct {
+	client   *route53.Client
+	provider provider.Provider
+	zoneID   string
+	names    []string
+	action   string
+}
+
+// NewRoute53Records returns a Route53Records acting on the records with the
+// given names in the hosted zone zoneID, with action being Route53Delete or
+// Route53Downweight. The instance id and addresses are read from p on the
+// notice. It needs permission to list and change the record sets of the
+// zone.
+func NewRoute53Records(ctx context.Context, p provider.Provider, zoneID string, names []string, action string) (*Route53Records, error) {
+	if action != Route53Delete && action != Route53Downweight {
+		return nil, fmt.Errorf("unknown Route53 action %q", action)
+	}
+	cfg, err := config.LoadDefaultConfig(ctx)
+	if err != nil {
+		return nil, err
+	}
+	normalized := make([]string, len(names))
+	for i, name := range names {
+		normalized[i] = normalizeRecordName(name)
+	}
+	return &Route53Records{
+		client:   route53.NewFromConfig(cfg),
+		provider: p,
+		zoneID:   zoneID,
+		names:    normalized,
+		action:   action,
+	}, nil
+}
+
+// addressPaths are the metadata paths of the addresses of the instance.
+var addressPaths = []string{"local-ipv4", "public-ipv4", "ipv6"}
+
+// addresses returns the addresses of the instance, if the provider exposes
+// them.
+func (r *Route53Records) addresses(ctx context.Context) []string {
+	getter, ok := r.provider.(provider.MetadataGetter)
+	if !ok {
+		return nil
+	}
+	var addresses []string
+	for _, path := range addressPaths {
+		body, found, err := getter.GetMetadata(ctx, path)
+		if err != nil {
+			log.WithError(err).Debugf("couldn't read %s", path)
+			continue
+		}
+		if found {
+			addresses = append(addresses, strings.TrimSpace(string(body)))
+		}
+	}
+	return addresses
+}
+
+// normalizeRecordName makes a record name comparable with the names listed
+// by Route53, which are lowercase and fully qualified.
+func normalizeRecordName(name string) string {
+	return strings.ToLower(strings.TrimSuffix(name, ".")) + "."
+}
+
+// changes returns the changes taking the instance out of the records, and
+// the id of the instance.
+func (r *Route53Records) changes(ctx context.Context) ([]r53types.Change, string, error) {
+	identity, err := r.provider.GetInstanceIdentity(ctx)
+	if err != nil {
+		return nil, "", err
+	}
+	addresses := r.addresses(ctx)
+
+	var changes []r53types.Change
+	for _, name := range r.names {
+		sets, err := r.recordSets(ctx, name)
+		if err != nil {
+			return nil, "", fmt.Errorf("list Route53 records %s: %w", name, err)
+		}
+		for _, set := range sets {
+			if change := r.change(set, identity.InstanceID, addresses); change != nil {
+				changes = append(changes, *change)
+			}
+		}
+	}
+	return changes, identity.InstanceID, nil
+}
+
+// DryRun lists the changes Notify would make.
+func (r *Route53Records) DryRun() (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	changes, _, err := r.changes(ctx)
+	if err != nil {
+		return "", err
+	}
+	if len(changes) == 0 {
+		return "found no Route53 records pointing at the instance", nil
+	}
+	planned := make([]string, len(changes))
+	for i, change := range changes {
+		set := change.ResourceRecordSet
+		planned[i] = fmt.Sprintf("%s %s %s", change.Action, aws.ToString(set.Name), set.Type)
+		if set.SetIdentifier != nil {
+			planned[i] += " " + aws.ToString(set.SetIdentifier)
+		}
+	}
+	return fmt.Sprintf("would change Route53 record sets in %s: %s", r.zoneID, strings.Join(planned, ", ")), nil
+}
+
+// Notify changes the record sets pointing at the instance in one batch.
+func (r *Route53Records) Notify() (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	changes, instanceID, err := r.changes(ctx)
+	if err != nil {
+		return "", err
+	}
+	if len(changes) == 0 {
+		return "found no Route53 records pointing at the instance", nil
+	}
+	_, err = r.client.ChangeResourceRecordSets(ctx, &route53.ChangeResourceRecordSetsInput{
+		HostedZoneId: aws.String(r.zoneID),
+		ChangeBatch: &r53types.ChangeBatch{
+			Comment: aws.String("termination notice of " + instanceID),
+			Changes: changes,
+		},
+	})
+	if err != nil {
+		return "", fmt.Errorf("change Route53 records: %w", err)
+	}
+	return fmt.Sprintf("%s %d Route53 record sets in %s", r.action, len(changes), r.zoneID), nil
+}
+
+// recordSets returns the record sets named name.
+func (r *Route53Records) recordSets(ctx context.Context, name string) ([]r53types.ResourceRecordSet, error) {
+	var sets []r53types.ResourceRecordSet
+	paginator := route53.NewListResourceRecordSetsPaginator(r.client, &route53.ListResourceRecordSetsInput{
+		HostedZoneId:    aws.String(r.zoneID),
+		StartRecordName: aws.String(name),
+	})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, err
+		}
+		for _, set := range page.ResourceRecordSets {
+			// record sets are listed in order of their names
+			if normalizeRecordName(aws.ToString(set.Name)) != name {
+				return sets, nil
+			}
+			sets = append(sets, set)
+		}
+	}
+	return sets, nil
+}
+
+// change returns the change taking the instance with the given id and
+// addresses out of set, or nil if set doesn't point at it.
+func (r *Route53Records) change(set r53types.ResourceRecordSet, instanceID string, addresses []string) *r53types.Change {
+	if set.AliasTarget != nil {
+		return nil
+	}
+	ownSet := aws.ToString(set.SetIdentifier) == instanceID
+	var kept []r53types.ResourceRecord
+	for _, record := range set.ResourceRecords {
+		if !slices.Contains(addresses, aws.ToString(record.Value)) {
+			kept = append(kept, record)
+		}
+	}
+	if !ownSet && len(kept) == len(set.ResourceRecords) {
+		return nil
+	}
+
+	if r.action == Route53Downweight {
+		if set.Weight == nil {
+			log.Warnf("Route53 record %s %s isn't weighted, leaving it alone", aws.ToString(set.Name), set.Type)
+			return nil
+		}
+		set.Weight = aws.Int64(0)
+		return &r53types.Change{Action: r53types.ChangeActionUpsert, ResourceRecordSet: &set}
+	}
+	if ownSet || len(kept) == 0 {
+		return &r53types.Change{Action: r53types.ChangeActionDelete, ResourceRecordSet: &set}
+	}
+	set.ResourceRecords = kept
+	return &r53types.Change{Action: r53types.ChangeActionUpsert, ResourceRecordSet: &set}
+}
@@ -0,0 +1,593 @@
+package notify
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"os"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/gjtempleton/spot-termination-exporter/pkg/collector"
+	"sigs.k8s.io/yaml"
+)
+
+// Sink types.
+const (
+	// SinkWebhook posts the event as JSON.
+	SinkWebhook = "webhook"
+	// SinkSlack posts a message to a Slack incoming webhook.
+	SinkSlack = "slack"
+	// SinkAlertmanager posts an alert to the v2 API of an Alertmanager.
+	SinkAlertmanager = "alertmanager"
+)
+
+// SinksConfig configures where interruption events are sent.
+type SinksConfig struct {
+	// Cooldown is the time after notifying a rebalance recommendation during
+	// which no other one is sent to any sink.
+	Cooldown Duration     `json:"cooldown"`
+	Sinks    []SinkConfig `json:"sinks"`
+	// Routes pick the sinks of an event, every sink gets every event if
+	// there are none.
+	Routes []RouteConfig `json:"routes"`
+}
+
+// RouteConfig routes the events it matches to its sinks. An empty matcher
+// matches every event.
+type RouteConfig struct {
+	EventTypes    []string `json:"event_types"`
+	InstanceTypes []string `json:"instance_types"`
+	// NodeLabels maps the names of node labels, as attached to the metrics,
+	// to regular expressions their values must fully match.
+	NodeLabels map[string]string `json:"node_labels"`
+	Sinks      []string          `json:"sinks"`
+
+	nodeLabels map[string]*regexp.Regexp
+}
+
+func (r *RouteConfig) validate(sinks map[string]bool) error {
+	if len(r.Sinks) == 0 {
+		return fmt.Errorf("sinks are required")
+	}
+	for _, sink := range r.Sinks {
+		if !sinks[sink] {
+			return fmt.Errorf("unknown sink %q", sink)
+		}
+	}
+	for _, eventType := range r.EventTypes {
+		if eventType != collector.EventTermination && eventType != collector.EventRebalance {
+			return fmt.Errorf("unknown event type %q", eventType)
+		}
+	}
+	r.nodeLabels = map[string]*regexp.Regexp{}
+	for name, value := range r.NodeLabels {
+		re, err := regexp.Compile("^(?:" + value + ")$")
+		if err != nil {
+			return fmt.Errorf("node label %s: %w", name, err)
+		}
+		r.nodeLabels[name] = re
+	}
+	return nil
+}
+
+// matches tells whether event, observed on a node with nodeLabels, matches
+// the route.
+func (r *RouteConfig) matches(event collector.InterruptionEvent, nodeLabels map[string]string) bool {
+	if len(r.EventTypes) > 0 && !slices.Contains(r.EventTypes, event.Type) {
+		return false
+	}
+	if len(r.InstanceTypes) > 0 && !slices.Contains(r.InstanceTypes, event.InstanceType) {
+		return false
+	}
+	for name, re := range r.nodeLabels {
+		if !re.MatchString(nodeLabels[name]) {
+			return false
+		}
+	}
+	return true
+}
+
+// Duration is a time.Duration read from a string such as "10m".
+type Duration time.Duration
+
+// UnmarshalJSON parses a duration string.
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return fmt.Errorf("invalid duration %s", data)
+	}
+	duration, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(duration)
+	return nil
+}
+
+// SinkConfig configures a sink of interruption events.
+type SinkConfig struct {
+	// Name identifies the sink in metrics and logs.
+	Name string `json:"name"`
+	// Type is SinkWebhook, SinkSlack or SinkAlertmanager, SinkWebhook if
+	// empty.
+	Type string `json:"type"`
+	// URL is the URL posted to, the base URL of the Alertmanager for
+	// SinkAlertmanager.
+	URL string `json:"url"`
+	// SecretFile holds the shared secret the body is signed with in the
+	// X-Signature header, unsigned if empty.
+	SecretFile string `json:"secret_file"`
+	// SignatureAlgorithm is the HMAC hash of the signature, sha256 if
+	// empty, or sha512.
+	SignatureAlgorithm string `json:"signature_algorithm"`
+	// TLS configures the connections to https URLs.
+	TLS *TLSConfig `json:"tls"`
+	// DedupWindow is the time after sending an event during which events of
+	// the same type for the same instance aren't sent again.
+	DedupWindow Duration `json:"dedup_window"`
+	// Template is a Go template executed with the event, rendering the body
+	// of a webhook, the message of Slack or the summary of an alert instead
+	// of the default ones.
+	Template string `json:"template"`
+
+	secret    []byte
+	tlsConfig *tls.Config
+	template  *template.Template
+}
+
+// TLSConfig configures the TLS connections to a sink.
+type TLSConfig struct {
+	// CAFile holds the PEM CA certificates to trust instead of the system
+	// ones.
+	CAFile string `json:"ca_file"`
+	// CertFile and KeyFile hold the PEM client certificate and key presented
+	// for mutual TLS.
+	CertFile string `json:"cert_file"`
+	KeyFile  string `json:"key_file"`
+	// ServerName is the name sent with SNI and the certificate of the sink is
+	// verified against, the host of the URL if empty.
+	ServerName         string `json:"server_name"`
+	InsecureSkipVerify bool   `json:"insecure_skip_verify"`
+}
+
+// load returns the tls.Config configured by c.
+func (c *TLSConfig) load() (*tls.Config, error) {
+	cfg := &tls.Config{ServerName: c.ServerName, InsecureSkipVerify: c.InsecureSkipVerify}
+	if c.CAFile != "" {
+		pem, err := os.ReadFile(c.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("read CA certificates: %w", err)
+		}
+		cfg.RootCAs = x509.NewCertPool()
+		if !cfg.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", c.CAFile)
+		}
+	}
+	if (c.CertFile == "") != (c.KeyFile == "") {
+		return nil, fmt.Errorf("cert_file and key_file must be given together")
+	}
+	if c.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("load client certificate: %w", err)
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+	return cfg, nil
+}
+
+// LoadSinksConfig reads and validates a YAML or JSON file configuring the
+// notification sinks.
+func LoadSinksConfig(path string) (*SinksConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var cfg SinksConfig
+	if err := yaml.UnmarshalStrict(data, &cfg); err != nil {
+		return nil, fmt.Errorf("parse %s: %w", path, err)
+	}
+	names := map[string]bool{}
+	for i := range cfg.Sinks {
+		if err := cfg.Sinks[i].validate(); err != nil {
+			return nil, fmt.Errorf("sink %d in %s: %w", i, path, err)
+		}
+		if names[cfg.Sinks[i].Name] {
+			return nil, fmt.Errorf("duplicate sink %q in %s", cfg.Sinks[i].Name, path)
+		}
+		names[cfg.Sinks[i].Name] = true
+	}
+	for i := range cfg.Routes {
+		if err := cfg.Routes[i].validate(names); err != nil {
+			return nil, fmt.Errorf("route %d in %s: %w", i, path, err)
+		}
+	}
+	return &cfg, nil
+}
+
+func (s *SinkConfig) validate() error {
+	if s.Name == "" {
+		return fmt.Errorf("name is required")
+	}
+	if s.Type == "" {
+		s.Type = SinkWebhook
+	}
+	if s.Type != SinkWebhook && s.Type != SinkSlack && s.Type != SinkAlertmanager {
+		return fmt.Errorf("%s: unknown type %q", s.Name, s.Type)
+	}
+	if s.URL == "" {
+		return fmt.Errorf("%s: url is required", s.Name)
+	}
+	if s.SignatureAlgorithm == "" {
+		s.SignatureAlgorithm = "sha256"
+	}
+	if _, ok := signatureHashes[s.SignatureAlgorithm]; !ok {
+		return fmt.Errorf("%s: unknown signature algorithm %q", s.Name, s.SignatureAlgorithm)
+	}
+	if s.SecretFile != "" {
+		secret, err := os.ReadFile(s.SecretFile)
+		if err != nil {
+			return fmt.Errorf("%s: %w", s.Name, err)
+		}
+		s.secret = bytes.TrimSpace(secret)
+		if len(s.secret) == 0 {
+			return fmt.Errorf("%s: secret file %s is empty", s.Name, s.SecretFile)
+		}
+	}
+	if s.Template != "" {
+		tmpl, err := parseTemplate(s.Name, s.Template)
+		if err != nil {
+			return fmt.Errorf("%s: %w", s.Name, err)
+		}
+		s.template = tmpl
+	}
+	if s.TLS != nil {
+		tlsConfig, err := s.TLS.load()
+		if err != nil {
+			return fmt.Errorf("%s: %w", s.Name, err)
+		}
+		s.tlsConfig = tlsConfig
+	}
+	return nil
+}
+
+// Sink sends interruption events to a webhook, Slack or Alertmanager.
+type Sink struct {
+	config  SinkConfig
+	client  *http.Client
+	tracing bool
+
+	mu   sync.Mutex
+	sent map[string]time.Time
+}
+
+// NewSink returns a Sink configured by cfg, which must have been validated
+// by LoadSinksConfig, giving up on requests after timeout.
+func NewSink(cfg SinkConfig, timeout time.Duration) *Sink {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = cfg.tlsConfig
+	return &Sink{config: cfg, client: &http.Client{Timeout: timeout, Transport: transport}, sent: map[string]time.Time{}}
+}
+
+// Name returns the name of the sink.
+func (s *Sink) Name() string {
+	return s.config.Name
+}
+
+// SetTracing makes the sink send a W3C traceparent header with the trace of
+// the event, see TraceID.
+func (s *Sink) SetTracing(enabled bool) {
+	s.tracing = enabled
+}
+
+// Claim tells whether event may be sent to the sink, i.e. no event of the
+// same type for the same instance was claimed within its dedup window, and
+// if so records it as sent. Checking and recording at once keeps concurrent
+// handlers, and events waiting in a batch, from sending the same event twice.
+func (s *Sink) Claim(event collector.InterruptionEvent) bool {
+	if s.config.DedupWindow <= 0 {
+		return true
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key := dedupKey(event)
+	if sent, ok := s.sent[key]; ok && time.Since(sent) < time.Duration(s.config.DedupWindow) {
+		return false
+	}
+	s.sent[key] = time.Now()
+	return true
+}
+
+// Release forgets the claim of event, e.g. after giving up on sending it, so
+// the next event of its type for its instance is sent.
+func (s *Sink) Release(event collector.InterruptionEvent) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.sent, dedupKey(event))
+}
+
+// dedupKey returns the key events are deduplicated by.
+func dedupKey(event collector.InterruptionEvent) string {
+	return event.Type + "\x00" + event.InstanceID
+}
+
+// Send sends event, observed on a node with nodeLabels, to the sink.
+func (s *Sink) Send(ctx context.Context, event collector.InterruptionEvent, nodeLabels map[string]string) error {
+	url, body, err := s.payload(event, nodeLabels)
+	if err != nil {
+		return err
+	}
+	return s.post(ctx, url, body, event.ID)
+}
+
+// SendBatch sends the summary of batch to the sink, continuing the trace of
+// its first event.
+func (s *Sink) SendBatch(ctx context.Context, batch Batch) error {
+	url, body, err := s.batchPayload(batch)
+	if err != nil {
+		return err
+	}
+	return s.post(ctx, url, body, batch.Events[0].ID)
+}
+
+// post posts body to url, with the trace of the event with the given id.
+func (s *Sink) post(ctx context.Context, url string, body []byte, eventID string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if s.config.secret != nil {
+		req.Header.Set("X-Signature", Sign(s.config.SignatureAlgorithm, s.config.secret, body))
+	}
+	if s.tracing {
+		req.Header.Set("traceparent", TraceParent(eventID))
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 4096))
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return nil
+}
+
+// signatureHashes are the hashes of the supported signature algorithms.
+var signatureHashes = map[string]func() hash.Hash{
+	"sha256": sha256.New,
+	"sha512": sha512.New,
+}
+
+// Sign returns the X-Signature header value of body, the hex-encoded HMAC of
+// body keyed with secret prefixed with the algorithm, e.g. "sha256=...".
+// algorithm must be sha256 or sha512.
+func Sign(algorithm string, secret, body []byte) string {
+	mac := hmac.New(signatureHashes[algorithm], secret)
+	mac.Write(body)
+	return algorithm + "=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// payload returns the URL to post event to and the body to post.
+func (s *Sink) payload(event collector.InterruptionEvent, nodeLabels map[string]string) (string, []byte, error) {
+	var text string
+	if s.config.template != nil {
+		var err error
+		text, err = executeTemplate(s.config.template, event, nodeLabels)
+		if err != nil {
+			return "", nil, fmt.Errorf("execute template: %w", err)
+		}
+	}
+	switch s.config.Type {
+	case SinkSlack:
+		if text == "" {
+			text = Summary(event)
+		}
+		body, err := json.Marshal(map[string]string{"text": text})
+		return s.config.URL, body, err
+	case SinkAlertmanager:
+		if text == "" {
+			text = Summary(event)
+		}
+		body, err := json.Marshal([]alert{newAlert(event, text)})
+		return strings.TrimSuffix(s.config.URL, "/") + "/api/v2/alerts", body, err
+	default:
+		if s.config.template != nil {
+			return s.config.URL, []byte(text), nil
+		}
+		body, err := json.Marshal(event)
+		return s.config.URL, body, err
+	}
+}
+
+// batchPayload returns the URL to post batch to and the body to post.
+func (s *Sink) batchPayload(batch Batch) (string, []byte, error) {
+	var text string
+	if s.config.template != nil {
+		var err error
+		text, err = executeTemplate(s.config.template, batch, nil)
+		if err != nil {
+			return "", nil, fmt.Errorf("execute template: %w", err)
+		}
+	}
+	switch s.config.Type {
+	case SinkSlack:
+		body, err := json.Marshal(map[string]string{"text": cmp.Or(text, batch.Summary())})
+		return s.config.URL, body, err
+	case SinkAlertmanager:
+		body, err := json.Marshal([]alert{{
+			Labels:      map[string]string{"alertname": "SpotInterruptions"},
+			Annotations: map[string]string{"summary": cmp.Or(text, batch.Summary())},
+			StartsAt:    batch.Events[0].Observed,
+		}})
+		return strings.TrimSuffix(s.config.URL, "/") + "/api/v2/alerts", body, err
+	default:
+		if s.config.template != nil {
+			return s.config.URL, []byte(text), nil
+		}
+		body, err := json.Marshal(batch)
+		return s.config.URL, body, err
+	}
+}
+
+// Summary returns a one-line description of event.
+func Summary(event collector.InterruptionEvent) string {
+	switch event.Type {
+	case collector.EventTermination:
+		summary := fmt.Sprintf("Spot termination notice for instance %s", event.InstanceID)
+		if event.Action != "" {
+			summary += ": " + event.Action
+		}
+		if !event.Time.IsZero() {
+			summary += " at " + event.Time.UTC().Format(time.RFC3339)
+		}
+		return summary
+	case collector.EventRebalance:
+		return fmt.Sprintf("Spot rebalance recommendation for instance %s", event.InstanceID)
+	default:
+		return fmt.Sprintf("Spot %s event for instance %s", event.Type, event.InstanceID)
+	}
+}
+
+// alert is an alert of the Alertmanager v2 API.
+type alert struct {
+	Labels      map[string]string `json:"labels"`
+	Annotations map[string]string `json:"annotations"`
+	StartsAt    time.Time         `json:"startsAt"`
+}
+
+func newAlert(event collector.InterruptionEvent, summary string) alert {
+	labels := map[string]string{
+		"alertname":   "SpotInterruption",
+		"event_type":  event.Type,
+		"event_id":    event.ID,
+		"instance_id": event.InstanceID,
+	}
+	if event.Action != "" {
+		labels["action"] = event.Action
+	}
+	return alert{
+		Labels:      labels,
+		Annotations: map[string]string{"summary": summary},
+		StartsAt:    event.Observed,
+	}
+}
+
+// Cooldown limits how often rebalance recommendations are sent, so a
+// flapping recommendation doesn't page the on-call channel on every scrape.
+// Termination notices are always sent, as they can't be repeated.
+type Cooldown struct {
+	period time.Duration
+
+	mu   sync.Mutex
+	last time.Time
+}
+
+// NewCooldown returns a Cooldown letting through a rebalance recommendation
+// at most every period, or all of them if period isn't positive.
+func NewCooldown(period time.Duration) *Cooldown {
+	return &Cooldown{period: period}
+}
+
+// Allow tells whether event may be sent, starting the cooldown if it is a
+// rebalance recommendation which may. Other events neither are held back nor
+// start it, so a termination notice doesn't hold back the next
+// recommendation.
+func (c *Cooldown) Allow(event collector.InterruptionEvent) bool {
+	if event.Type != collector.EventRebalance {
+		return true
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	if c.period > 0 && !c.last.IsZero() && now.Sub(c.last) < c.period {
+		return false
+	}
+	c.last = now
+	return true
+}
+
+// Router sends events to the sinks picked by the routes of a SinksConfig.
+type Router struct {
+	routes []RouteConfig
+	sinks  []*Sink
+	byName map[string]*Sink
+
+	mu         sync.Mutex
+	nodeLabels map[string]string
+}
+
+// NewRouter returns a Router of the sinks and routes configured by cfg,
+// giving up on requests to the sinks after timeout.
+func NewRouter(cfg *SinksConfig, timeout time.Duration) *Router {
+	r := &Router{routes: cfg.Routes, byName: map[string]*Sink{}}
+	for _, sinkConfig := range cfg.Sinks {
+		sink := NewSink(sinkConfig, timeout)
+		r.sinks = append(r.sinks, sink)
+		r.byName[sink.Name()] = sink
+	}
+	return r
+}
+
+// Sinks returns all sinks.
+func (r *Router) Sinks() []*Sink {
+	return r.sinks
+}
+
+// Sink returns the sink called name, nil if there is none.
+func (r *Router) Sink(name string) *Sink {
+	return r.byName[name]
+}
+
+// NodeLabels returns the labels of the node set last.
+func (r *Router) NodeLabels() map[string]string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.nodeLabels
+}
+
+// SetNodeLabels sets the labels of the node the routes and templates see.
+func (r *Router) SetNodeLabels(nodeLabels map[string]string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.nodeLabels = nodeLabels
+}
+
+// Route returns the sinks of event, those of every route matching it, or
+// all sinks without routes.
+func (r *Router) Route(event collector.InterruptionEvent) []*Sink {
+	if len(r.routes) == 0 {
+		return r.sinks
+	}
+	nodeLabels := r.NodeLabels()
+	var sinks []*Sink
+	for _, route := range r.routes {
+		if !route.matches(event, nodeLabels) {
+			continue
+		}
+		for _, name := range route.Sinks {
+			if sink := r.byName[name]; !slices.Contains(sinks, sink) {
+				sinks = append(sinks, sink)
+			}
+		}
+	}
+	return sinks
+}
@@ -0,0 +1,95 @@
+package notify
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// templateFuncs are the functions available to the templates of the sinks.
+// nodeLabel is bound to the labels of the node when a template is executed.
+var templateFuncs = template.FuncMap{
+	"humanizeDuration": humanizeDuration,
+	"timeUntil":        time.Until,
+	"timeSince":        time.Since,
+	"nodeLabel":        func(string) string { return "" },
+	"toJSON":           toJSON,
+	"consoleURL":       consoleURL,
+}
+
+// parseTemplate parses the template of the sink called name.
+func parseTemplate(name, text string) (*template.Template, error) {
+	return template.New(name).Option("missingkey=zero").Funcs(templateFuncs).Parse(text)
+}
+
+// executeTemplate executes tmpl with data, an event or a Batch, looking up
+// node labels in nodeLabels.
+func executeTemplate(tmpl *template.Template, data any, nodeLabels map[string]string) (string, error) {
+	tmpl, err := tmpl.Clone()
+	if err != nil {
+		return "", err
+	}
+	tmpl.Funcs(template.FuncMap{"nodeLabel": func(name string) string { return nodeLabels[name] }})
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, data); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+// humanizeDuration formats a duration, or a number of seconds, with its two
+// largest units, e.g. "1m 30s" or "2d 4h".
+func humanizeDuration(v any) (string, error) {
+	var d time.Duration
+	switch v := v.(type) {
+	case time.Duration:
+		d = v
+	case int:
+		d = time.Duration(v) * time.Second
+	case int64:
+		d = time.Duration(v) * time.Second
+	case float64:
+		d = time.Duration(v * float64(time.Second))
+	default:
+		return "", fmt.Errorf("humanizeDuration: unsupported type %T", v)
+	}
+	d = d.Round(time.Second)
+	sign := ""
+	if d < 0 {
+		sign, d = "-", -d
+	}
+	units := []struct {
+		suffix string
+		size   time.Duration
+	}{{"d", 24 * time.Hour}, {"h", time.Hour}, {"m", time.Minute}, {"s", time.Second}}
+	var parts []string
+	for _, unit := range units {
+		if n := d / unit.size; n > 0 || (len(parts) == 0 && unit.size == time.Second) {
+			parts = append(parts, fmt.Sprintf("%d%s", n, unit.suffix))
+			d -= n * unit.size
+		} else if len(parts) > 0 {
+			break
+		}
+		if len(parts) == 2 {
+			break
+		}
+	}
+	return sign + strings.Join(parts, " "), nil
+}
+
+// toJSON encodes v as JSON.
+func toJSON(v any) (string, error) {
+	data, err := json.Marshal(v)
+	return string(data), err
+}
+
+// consoleURL returns the link to the details of the instance in the EC2
+// console.
+func consoleURL(region, instanceID string) string {
+	return fmt.Sprintf("https://%s.console.aws.amazon.com/ec2/home?region=%s#InstanceDetails:instanceId=%s",
+		url.PathEscape(region), url.QueryEscape(region), url.QueryEscape(instanceID))
+}
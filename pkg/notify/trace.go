@@ -0,0 +1,23 @@
+package notify
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+)
+
+// TraceID returns the W3C trace id of the event with the given id. It is
+// derived from the event id, so every notification about the event and
+// every exporter observing it share the trace.
+func TraceID(eventID string) string {
+	sum := sha256.Sum256([]byte(eventID))
+	return hex.EncodeToString(sum[:16])
+}
+
+// TraceParent returns a W3C traceparent header value continuing the trace of
+// the event with the given id in a new, sampled span.
+func TraceParent(eventID string) string {
+	var span [8]byte
+	_, _ = rand.Read(span[:])
+	return "00-" + TraceID(eventID) + "-" + hex.EncodeToString(span[:]) + "-01"
+}
@@ -0,0 +1,253 @@
+package provider
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gjtempleton/spot-termination-exporter/pkg/imds"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	alibabaMetadataEndpoint = "http://100.100.100.200/latest/meta-data/"
+	alibabaTokenEndpoint    = "http://100.100.100.200/latest/api/token"
+	alibabaTokenTTL         = 21600 * time.Second
+)
+
+func init() {
+	Register("alibaba", newAlibabaProvider)
+}
+
+// alibabaProvider reads from the Alibaba Cloud ECS metadata service. When
+// UseIMDSv2 is set, requests use the security hardening mode tokens, which
+// work like IMDSv2 tokens.
+type alibabaProvider struct {
+	metadataEndpoint string
+	tokenEndpoint    string
+	useTokens        bool
+	client           *http.Client
+
+	mu            sync.Mutex
+	token         string
+	tokenObtained time.Time
+	tokenFlight   *tokenFlight
+}
+
+// tokenFlight is a token request in progress, shared by the requests needing
+// a token meanwhile. token and err are set before done is closed.
+type tokenFlight struct {
+	done  chan struct{}
+	token string
+	err   error
+}
+
+func newAlibabaProvider(cfg Config) (Provider, error) {
+	p := &alibabaProvider{
+		metadataEndpoint: cfg.MetadataEndpoint,
+		tokenEndpoint:    cfg.TokenEndpoint,
+		useTokens:        cfg.UseIMDSv2,
+		client:           imds.NewHTTPClient(cfg.Transport),
+	}
+	if p.metadataEndpoint == "" {
+		p.metadataEndpoint = alibabaMetadataEndpoint
+	}
+	if p.tokenEndpoint == "" {
+		p.tokenEndpoint = alibabaTokenEndpoint
+	}
+	return p, nil
+}
+
+func (p *alibabaProvider) GetInstanceIdentity(ctx context.Context) (*InstanceIdentity, error) {
+	values := map[string]string{}
+	for _, path := range []string{"instance-id", "instance/instance-type", "region-id", "zone-id"} {
+		body, found, err := p.get(ctx, path)
+		if err != nil {
+			return nil, fmt.Errorf("couldn't read %s from metadata: %w", path, err)
+		}
+		if !found {
+			return nil, fmt.Errorf("couldn't read %s from metadata: endpoint not found", path)
+		}
+		values[path] = string(body)
+	}
+	return &InstanceIdentity{
+		InstanceID:       values["instance-id"],
+		InstanceType:     values["instance/instance-type"],
+		Region:           values["region-id"],
+		AvailabilityZone: values["zone-id"],
+	}, nil
+}
+
+// GetTerminationNotice reports a termination once the instance has been
+// scheduled for release, which is when instance/spot/termination-time
+// becomes available.
+func (p *alibabaProvider) GetTerminationNotice(ctx context.Context) (*TerminationNotice, error) {
+	body, found, err := p.get(ctx, "instance/spot/termination-time")
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		log.Debug("termination-time endpoint not found")
+		return nil, nil
+	}
+
+	terminationTime, err := time.Parse(time.RFC3339, strings.TrimSpace(string(body)))
+	if err != nil {
+		imds.WithError(imds.RecordParseError("instance/spot/termination-time", err)).Error("Couldn't parse termination-time metadata")
+		return nil, nil
+	}
+	return &TerminationNotice{Action: "terminate", Time: terminationTime, Raw: body}, nil
+}
+
+// GetRebalance always returns nil as Alibaba Cloud has no equivalent of
+// rebalance recommendations.
+func (p *alibabaProvider) GetRebalance(ctx context.Context) (*RebalanceRecommendation, error) {
+	return nil, nil
+}
+
+// GetMaintenanceEvents always returns nil as the ECS metadata service
+// doesn't expose scheduled maintenance.
+func (p *alibabaProvider) GetMaintenanceEvents(ctx context.Context) ([]MaintenanceEvent, error) {
+	return nil, nil
+}
+
+// Detect checks that the region-id, which the EC2 metadata service doesn't
+// serve, can be read.
+func (p *alibabaProvider) Detect(ctx context.Context) bool {
+	_, found, err := p.get(ctx, "region-id")
+	if err != nil {
+		log.Debugf("Alibaba Cloud metadata service not detected: %s", err)
+		return false
+	}
+	return found
+}
+
+func (p *alibabaProvider) get(ctx context.Context, path string) ([]byte, bool, error) {
+	client := p.client
+
+	token := ""
+	if p.useTokens {
+		var err error
+		if token, err = p.getToken(ctx, client); err != nil {
+			return nil, false, fmt.Errorf("couldn't fetch metadata token: %w", err)
+		}
+	}
+	resp, err := p.getResponse(ctx, client, path, token)
+	if err == nil && resp.StatusCode == http.StatusUnauthorized && token != "" {
+		// the cached token is no longer accepted, retry once with a new one
+		imds.RecordPoll(path, resp.StatusCode, nil)
+		imds.DrainAndClose(resp.Body)
+		p.invalidateToken(token)
+		if token, err = p.getToken(ctx, client); err != nil {
+			return nil, false, fmt.Errorf("couldn't fetch metadata token: %w", err)
+		}
+		resp, err = p.getResponse(ctx, client, path, token)
+	}
+	if err != nil {
+		imds.RecordPoll(path, 0, err)
+		return nil, false, err
+	}
+	imds.RecordPoll(path, resp.StatusCode, nil)
+	defer imds.DrainAndClose(resp.Body)
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return nil, false, nil
+	default:
+		return nil, false, &imds.StatusError{Code: resp.StatusCode}
+	}
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, false, err
+	}
+	return body, true, nil
+}
+
+// getResponse requests path, with token unless it is empty.
+func (p *alibabaProvider) getResponse(ctx context.Context, client *http.Client, path, token string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", p.metadataEndpoint+path, nil)
+	if err != nil {
+		return nil, err
+	}
+	if token != "" {
+		req.Header.Add("X-aliyun-ecs-metadata-token", token)
+	}
+	return client.Do(req)
+}
+
+// getToken returns the cached token, or requests a new one. Concurrent
+// callers share a single request, which is made without holding p.mu so
+// other requests aren't blocked by a slow token endpoint.
+func (p *alibabaProvider) getToken(ctx context.Context, client *http.Client) (string, error) {
+	p.mu.Lock()
+	if p.token != "" && time.Since(p.tokenObtained) < alibabaTokenTTL-time.Minute {
+		token := p.token
+		p.mu.Unlock()
+		return token, nil
+	}
+	f := p.tokenFlight
+	inFlight := f != nil
+	if !inFlight {
+		f = &tokenFlight{done: make(chan struct{})}
+		p.tokenFlight = f
+	}
+	p.mu.Unlock()
+
+	if inFlight {
+		select {
+		case <-f.done:
+			return f.token, f.err
+		case <-ctx.Done():
+			return "", ctx.Err()
+		}
+	}
+
+	f.token, f.err = p.requestToken(ctx, client)
+	p.mu.Lock()
+	p.tokenFlight = nil
+	if f.err == nil {
+		p.token = f.token
+		p.tokenObtained = time.Now()
+	}
+	p.mu.Unlock()
+	close(f.done)
+	return f.token, f.err
+}
+
+// invalidateToken drops the cached token if it is still token, so the next
+// request obtains a new one.
+func (p *alibabaProvider) invalidateToken(token string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.token == token {
+		p.token = ""
+	}
+}
+
+// requestToken requests a new token from the token endpoint.
+func (p *alibabaProvider) requestToken(ctx context.Context, client *http.Client) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, "PUT", p.tokenEndpoint, nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Add("X-aliyun-ecs-metadata-token-ttl-seconds", fmt.Sprint(int(alibabaTokenTTL.Seconds())))
+	resp, err := client.Do(req)
+	if err != nil {
+		imds.RecordPoll(imds.TokenPath, 0, err)
+		return "", err
+	}
+	imds.RecordPoll(imds.TokenPath, resp.StatusCode, nil)
+	defer imds.DrainAndClose(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		return "", &imds.StatusError{Code: resp.StatusCode}
+	}
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	return string(body), nil
+}
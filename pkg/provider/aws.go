@@ -0,0 +1,310 @@
+package provider
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/gjtempleton/spot-termination-exporter/pkg/imds"
+	log "github.com/sirupsen/logrus"
+)
+
+// maintenanceTimeFormat is the format of the times in scheduled maintenance
+// events, e.g. "21 Jan 2019 09:00:43 GMT".
+const maintenanceTimeFormat = "2 Jan 2006 15:04:05 MST"
+
+// maxMutableIdentityTTL caps how long the parts of the identity which change
+// when the instance is stopped and started, its type and launch time, are
+// cached, whatever the identity cache TTL, so restarts are still noticed.
+const maxMutableIdentityTTL = time.Minute
+
+func init() {
+	Register("aws", newAWSProvider)
+}
+
+// awsProvider reads from the EC2 instance metadata service, optionally using
+// IMDSv2 session tokens.
+type awsProvider struct {
+	client    *imds.Client
+	cacheTTLs CacheTTLs
+	cache     responseCache
+}
+
+type identityDocument struct {
+	ImageID      string    `json:"imageId"`
+	Architecture string    `json:"architecture"`
+	KernelID     string    `json:"kernelId"`
+	PendingTime  time.Time `json:"pendingTime"`
+}
+
+type instanceAction struct {
+	Action string    `json:"action"`
+	Time   time.Time `json:"time"`
+}
+
+type instanceEvent struct {
+	NoticeTime time.Time `json:"noticeTime"`
+}
+
+type maintenanceEvent struct {
+	EventID     string `json:"EventId"`
+	Code        string `json:"Code"`
+	State       string `json:"State"`
+	Description string `json:"Description"`
+	NotBefore   string `json:"NotBefore"`
+	NotAfter    string `json:"NotAfter"`
+}
+
+func newAWSProvider(cfg Config) (Provider, error) {
+	client := imds.NewClient(cfg.MetadataEndpoint, cfg.TokenEndpoint, cfg.UseIMDSv2)
+	client.SetTransport(cfg.Transport)
+	client.SetTimeouts(cfg.RequestTimeout, cfg.TokenTimeout)
+	client.SetV1Fallback(cfg.IMDSv1Fallback)
+	if cfg.TokenTTL != 0 {
+		if err := client.SetTokenTTL(cfg.TokenTTL); err != nil {
+			return nil, err
+		}
+	}
+	for _, fallback := range cfg.FallbackEndpoints {
+		client.AddFallback(fallback.MetadataEndpoint, fallback.TokenEndpoint)
+	}
+	return &awsProvider{client: client, cacheTTLs: cfg.CacheTTLs}, nil
+}
+
+func (p *awsProvider) GetInstanceIdentity(ctx context.Context) (*InstanceIdentity, error) {
+	mutableTTL := p.cacheTTLs.Identity
+	if mutableTTL < 0 || mutableTTL > maxMutableIdentityTTL {
+		mutableTTL = maxMutableIdentityTTL
+	}
+	values := map[string]string{}
+	for _, path := range []string{"instance-id", "instance-type", "placement/region", "placement/availability-zone"} {
+		ttl := p.cacheTTLs.Identity
+		if path == "instance-type" {
+			ttl = mutableTTL
+		}
+		body, found, err := p.get(ctx, path, ttl)
+		if err != nil {
+			return nil, fmt.Errorf("couldn't read %s from metadata: %w", path, err)
+		}
+		if !found {
+			return nil, fmt.Errorf("couldn't read %s from metadata: endpoint not found", path)
+		}
+		values[path] = string(body)
+	}
+	identity := &InstanceIdentity{
+		InstanceID:       values["instance-id"],
+		InstanceType:     values["instance-type"],
+		Region:           values["placement/region"],
+		AvailabilityZone: values["placement/availability-zone"],
+	}
+
+	// the identity document only adds details, so failing to read it isn't
+	// fatal
+	body, found, err := p.cache.get("../dynamic/instance-identity-document", mutableTTL, func() ([]byte, bool, error) {
+		return p.client.GetDynamic(ctx, "instance-identity-document")
+	})
+	switch {
+	case err != nil:
+		log.Debugf("couldn't read instance identity document: %s", err)
+	case found:
+		var doc identityDocument
+		if err := json.Unmarshal(body, &doc); err != nil {
+			imds.WithError(imds.RecordParseError("dynamic/instance-identity-document", err)).Debug("couldn't parse instance identity document")
+			break
+		}
+		identity.ImageID = doc.ImageID
+		identity.Architecture = doc.Architecture
+		identity.KernelID = doc.KernelID
+		identity.PendingTime = doc.PendingTime
+	}
+	return identity, nil
+}
+
+func (p *awsProvider) GetTerminationNotice(ctx context.Context) (*TerminationNotice, error) {
+	body, found, err := p.get(ctx, "spot/instance-action", p.cacheTTLs.Notice)
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		log.Debug("instance-action endpoint not found")
+		return nil, nil
+	}
+
+	var ia = instanceAction{}
+	// value may be present but not be a time according to AWS docs,
+	// so parse error is not fatal
+	if err := json.Unmarshal(body, &ia); err != nil {
+		imds.WithError(imds.RecordParseError("spot/instance-action", err)).Error("Couldn't parse instance-action metadata")
+		return nil, nil
+	}
+	return &TerminationNotice{Action: ia.Action, Time: ia.Time, Raw: body}, nil
+}
+
+func (p *awsProvider) GetRebalance(ctx context.Context) (*RebalanceRecommendation, error) {
+	body, found, err := p.get(ctx, "events/recommendations/rebalance", p.cacheTTLs.Notice)
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		log.Debug("rebalance endpoint not found")
+		return nil, nil
+	}
+
+	var ie = instanceEvent{}
+	if err := json.Unmarshal(body, &ie); err != nil {
+		imds.WithError(imds.RecordParseError("events/recommendations/rebalance", err)).Error("Couldn't parse rebalance recommendation event metadata")
+		return nil, nil
+	}
+	return &RebalanceRecommendation{NoticeTime: ie.NoticeTime, Raw: body}, nil
+}
+
+func (p *awsProvider) GetMaintenanceEvents(ctx context.Context) ([]MaintenanceEvent, error) {
+	return p.getMaintenanceEvents(ctx, "events/maintenance/scheduled")
+}
+
+// GetMaintenanceHistory reads the completed and canceled maintenance events
+// of the instance.
+func (p *awsProvider) GetMaintenanceHistory(ctx context.Context) ([]MaintenanceEvent, error) {
+	return p.getMaintenanceEvents(ctx, "events/maintenance/history")
+}
+
+// GetMetadata reads a path below the meta-data tree, e.g. "ami-id".
+func (p *awsProvider) GetMetadata(ctx context.Context, path string) ([]byte, bool, error) {
+	return p.client.Get(ctx, path)
+}
+
+func (p *awsProvider) getMaintenanceEvents(ctx context.Context, path string) ([]MaintenanceEvent, error) {
+	body, found, err := p.get(ctx, path, p.cacheTTLs.Maintenance)
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		log.Debugf("%s endpoint not found", path)
+		return nil, nil
+	}
+
+	var raw []maintenanceEvent
+	if err := json.Unmarshal(body, &raw); err != nil {
+		return nil, imds.RecordParseError(path, err)
+	}
+	events := make([]MaintenanceEvent, 0, len(raw))
+	for _, e := range raw {
+		event := MaintenanceEvent{
+			ID:          e.EventID,
+			Code:        e.Code,
+			State:       e.State,
+			Description: e.Description,
+		}
+		// times are informational, so events with unparseable times are
+		// still exported
+		if t, err := time.Parse(maintenanceTimeFormat, e.NotBefore); err == nil {
+			event.NotBefore = t
+		}
+		if t, err := time.Parse(maintenanceTimeFormat, e.NotAfter); err == nil {
+			event.NotAfter = t
+		}
+		events = append(events, event)
+	}
+	return events, nil
+}
+
+// get reads a path below the meta-data tree, caching the response for ttl.
+func (p *awsProvider) get(ctx context.Context, path string, ttl time.Duration) ([]byte, bool, error) {
+	return p.cache.get(path, ttl, func() ([]byte, bool, error) {
+		return p.client.Get(ctx, path)
+	})
+}
+
+// ClearCache drops the cached metadata.
+func (p *awsProvider) ClearCache() {
+	p.cache.clear()
+}
+
+// GetNetworkInterfaces reads the network interfaces attached to the instance
+// below network/interfaces/macs.
+func (p *awsProvider) GetNetworkInterfaces(ctx context.Context) ([]NetworkInterface, error) {
+	body, found, err := p.client.Get(ctx, "network/interfaces/macs/")
+	if err != nil || !found {
+		return nil, err
+	}
+	var interfaces []NetworkInterface
+	for _, entry := range strings.Fields(string(body)) {
+		mac := strings.TrimSuffix(entry, "/")
+		networkInterface := NetworkInterface{MAC: mac}
+		for _, field := range []struct {
+			path  string
+			value *string
+		}{
+			{"interface-id", &networkInterface.ID},
+			{"device-number", &networkInterface.DeviceNumber},
+			{"local-ipv4s", &networkInterface.PrivateIP},
+			{"subnet-id", &networkInterface.SubnetID},
+			{"vpc-id", &networkInterface.VPCID},
+		} {
+			value, found, err := p.client.Get(ctx, "network/interfaces/macs/"+mac+"/"+field.path)
+			if err != nil {
+				return nil, fmt.Errorf("couldn't read %s of %s: %w", field.path, mac, err)
+			}
+			if found {
+				// the primary address of the interface is listed first
+				*field.value = strings.TrimSpace(strings.SplitN(string(value), "\n", 2)[0])
+			}
+		}
+		interfaces = append(interfaces, networkInterface)
+	}
+	return interfaces, nil
+}
+
+// GetHostname reads the local-hostname or hostname of the instance.
+func (p *awsProvider) GetHostname(ctx context.Context, kind string) (string, error) {
+	if kind != "local-hostname" && kind != "hostname" {
+		return "", fmt.Errorf("unknown hostname kind %q", kind)
+	}
+	body, found, err := p.client.Get(ctx, kind)
+	if err != nil {
+		return "", err
+	}
+	if !found || len(body) == 0 {
+		return "", fmt.Errorf("%s not set in metadata", kind)
+	}
+	return string(body), nil
+}
+
+// GetTargetLifecycleState reads the Auto Scaling target lifecycle state of the
+// instance.
+func (p *awsProvider) GetTargetLifecycleState(ctx context.Context) (string, error) {
+	body, found, err := p.get(ctx, "autoscaling/target-lifecycle-state", p.cacheTTLs.Notice)
+	if err != nil || !found {
+		return "", err
+	}
+	return strings.TrimSpace(string(body)), nil
+}
+
+// IMDSTokens returns the IMDSv2 session tokens currently cached.
+func (p *awsProvider) IMDSTokens() []imds.Token {
+	return p.client.Tokens()
+}
+
+// LastEndpoint returns the metadata endpoint which served the last request.
+func (p *awsProvider) LastEndpoint() string {
+	return p.client.LastEndpoint()
+}
+
+// HopLimitBlocked reports whether IMDSv2 token requests look blocked by the
+// instance's hop limit.
+func (p *awsProvider) HopLimitBlocked() bool {
+	return p.client.HopLimitBlocked()
+}
+
+// FallbackV1 reports whether the last request fell back to IMDSv1.
+func (p *awsProvider) FallbackV1() bool {
+	return p.client.FallbackV1()
+}
+
+// Detect checks that the instance-id can be read from the instance metadata
+// service.
+func (p *awsProvider) Detect(ctx context.Context) bool {
+	return p.client.Available(ctx)
+}
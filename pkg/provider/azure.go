@@ -0,0 +1,271 @@
+package provider
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gjtempleton/spot-termination-exporter/pkg/imds"
+	log "github.com/sirupsen/logrus"
+)
+
+const azureMetadataEndpoint = "http://169.254.169.254/metadata/"
+
+func init() {
+	Register("azure", newAzureProvider)
+}
+
+// azureProvider reads from the Azure Instance Metadata Service. Preempt and
+// Terminate scheduled events are reported as termination notices and all
+// other scheduled events as maintenance events.
+type azureProvider struct {
+	metadataEndpoint string
+	client           *http.Client
+
+	// name is the name of the VM once read, which can't change, so the
+	// scheduled events are filtered without reading the instance metadata
+	// each time, as IMDS throttles requests per VM.
+	mu   sync.Mutex
+	name string
+}
+
+type azureInstance struct {
+	Compute struct {
+		Name     string `json:"name"`
+		VMID     string `json:"vmId"`
+		VMSize   string `json:"vmSize"`
+		Location string `json:"location"`
+		Zone     string `json:"zone"`
+	} `json:"compute"`
+}
+
+type azureScheduledEvents struct {
+	DocumentIncarnation int                   `json:"DocumentIncarnation"`
+	Events              []azureScheduledEvent `json:"Events"`
+}
+
+type azureScheduledEvent struct {
+	EventID      string   `json:"EventId"`
+	EventType    string   `json:"EventType"`
+	ResourceType string   `json:"ResourceType"`
+	Resources    []string `json:"Resources"`
+	EventStatus  string   `json:"EventStatus"`
+	NotBefore    string   `json:"NotBefore"`
+	Description  string   `json:"Description"`
+}
+
+func newAzureProvider(cfg Config) (Provider, error) {
+	endpoint := cfg.MetadataEndpoint
+	if endpoint == "" {
+		endpoint = azureMetadataEndpoint
+	}
+	return &azureProvider{metadataEndpoint: endpoint, client: imds.NewHTTPClient(cfg.Transport)}, nil
+}
+
+func (p *azureProvider) GetInstanceIdentity(ctx context.Context) (*InstanceIdentity, error) {
+	instance, err := p.getInstance(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &InstanceIdentity{
+		InstanceID:       instance.Compute.VMID,
+		InstanceType:     instance.Compute.VMSize,
+		Region:           instance.Compute.Location,
+		AvailabilityZone: instance.Compute.Zone,
+	}, nil
+}
+
+func (p *azureProvider) GetTerminationNotice(ctx context.Context) (*TerminationNotice, error) {
+	events, err := p.getScheduledEvents(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for _, event := range events {
+		if event.EventType == "Preempt" || event.EventType == "Terminate" {
+			raw, _ := json.Marshal(event)
+			return &TerminationNotice{
+				Action:  strings.ToLower(event.EventType),
+				Time:    parseAzureTime(event.NotBefore),
+				Raw:     raw,
+				EventID: event.EventID,
+			}, nil
+		}
+	}
+	return nil, nil
+}
+
+// GetRebalance always returns nil as Azure has no equivalent of rebalance
+// recommendations.
+func (p *azureProvider) GetRebalance(ctx context.Context) (*RebalanceRecommendation, error) {
+	return nil, nil
+}
+
+func (p *azureProvider) GetMaintenanceEvents(ctx context.Context) ([]MaintenanceEvent, error) {
+	events, err := p.getScheduledEvents(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var maintenance []MaintenanceEvent
+	for _, event := range events {
+		if event.EventType == "Preempt" || event.EventType == "Terminate" {
+			continue
+		}
+		maintenance = append(maintenance, MaintenanceEvent{
+			ID:          event.EventID,
+			Code:        strings.ToLower(event.EventType),
+			State:       strings.ToLower(event.EventStatus),
+			Description: event.Description,
+			NotBefore:   parseAzureTime(event.NotBefore),
+		})
+	}
+	return maintenance, nil
+}
+
+// GetScheduledEvents returns the scheduled events of all types, e.g. a
+// Redeploy announced 10 minutes ahead as well as a Preempt announced 30
+// seconds ahead.
+func (p *azureProvider) GetScheduledEvents(ctx context.Context) ([]ScheduledEvent, error) {
+	events, err := p.getScheduledEvents(ctx)
+	if err != nil {
+		return nil, err
+	}
+	scheduled := make([]ScheduledEvent, len(events))
+	for i, event := range events {
+		scheduled[i] = ScheduledEvent{
+			ID:        event.EventID,
+			Type:      strings.ToLower(event.EventType),
+			Status:    strings.ToLower(event.EventStatus),
+			NotBefore: parseAzureTime(event.NotBefore),
+		}
+	}
+	return scheduled, nil
+}
+
+// AcknowledgeEvent approves the scheduled event with the given id, so Azure
+// starts it right away rather than at its NotBefore deadline.
+func (p *azureProvider) AcknowledgeEvent(ctx context.Context, eventID string) error {
+	body, err := json.Marshal(map[string][]map[string]string{
+		"StartRequests": {{"EventId": eventID}},
+	})
+	if err != nil {
+		return err
+	}
+	path := "scheduledevents?api-version=2020-07-01"
+	req, err := http.NewRequestWithContext(ctx, "POST", p.metadataEndpoint+path, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Add("Metadata", "true")
+	req.Header.Add("Content-Type", "application/json")
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer imds.DrainAndClose(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		return &imds.StatusError{Code: resp.StatusCode}
+	}
+	return nil
+}
+
+// Detect checks that the instance metadata, which is only served with the
+// Metadata header set, can be read.
+func (p *azureProvider) Detect(ctx context.Context) bool {
+	instance, err := p.getInstance(ctx)
+	if err != nil {
+		log.Debugf("Azure metadata service not detected: %s", err)
+		return false
+	}
+	return instance.Compute.VMID != ""
+}
+
+func (p *azureProvider) getInstance(ctx context.Context) (*azureInstance, error) {
+	var instance azureInstance
+	if err := p.get(ctx, "instance?api-version=2021-02-01", &instance); err != nil {
+		return nil, fmt.Errorf("couldn't read instance metadata: %w", err)
+	}
+	p.mu.Lock()
+	p.name = instance.Compute.Name
+	p.mu.Unlock()
+	return &instance, nil
+}
+
+// instanceName returns the name of the VM, reading the instance metadata
+// only if it wasn't read before.
+func (p *azureProvider) instanceName(ctx context.Context) (string, error) {
+	p.mu.Lock()
+	name := p.name
+	p.mu.Unlock()
+	if name != "" {
+		return name, nil
+	}
+	instance, err := p.getInstance(ctx)
+	if err != nil {
+		return "", err
+	}
+	return instance.Compute.Name, nil
+}
+
+// getScheduledEvents returns the scheduled events affecting this VM. Events
+// are shared by all VMs in an availability set or scale set, so they are
+// filtered by the VM name.
+func (p *azureProvider) getScheduledEvents(ctx context.Context) ([]azureScheduledEvent, error) {
+	name, err := p.instanceName(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var doc azureScheduledEvents
+	if err := p.get(ctx, "scheduledevents?api-version=2020-07-01", &doc); err != nil {
+		return nil, fmt.Errorf("couldn't read scheduled events: %w", err)
+	}
+	var events []azureScheduledEvent
+	for _, event := range doc.Events {
+		if len(event.Resources) == 0 || slices.Contains(event.Resources, name) {
+			events = append(events, event)
+		}
+	}
+	return events, nil
+}
+
+func (p *azureProvider) get(ctx context.Context, path string, v interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, "GET", p.metadataEndpoint+path, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Add("Metadata", "true")
+	resp, err := p.client.Do(req)
+	if err != nil {
+		imds.RecordPoll(path, 0, err)
+		return err
+	}
+	imds.RecordPoll(path, resp.StatusCode, nil)
+	defer imds.DrainAndClose(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		return &imds.StatusError{Code: resp.StatusCode}
+	}
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(body, v); err != nil {
+		return imds.RecordParseError(path, err)
+	}
+	return nil
+}
+
+// parseAzureTime parses the NotBefore time of a scheduled event, which is
+// empty once the event has started.
+func parseAzureTime(value string) time.Time {
+	t, err := time.Parse(time.RFC1123, value)
+	if err != nil {
+		return time.Time{}
+	}
+	return t
+}
@@ -0,0 +1,66 @@
+package provider
+
+import (
+	"sync"
+	"time"
+)
+
+// CacheTTLs sets how long each class of metadata is cached by providers
+// supporting it. Zero disables caching, so the metadata is read on every
+// poll, and a negative TTL caches it forever.
+type CacheTTLs struct {
+	// Identity covers the instance identity, which only changes when the
+	// instance is restarted.
+	Identity time.Duration
+	// Notice covers termination notices, rebalance recommendations and the
+	// Auto Scaling lifecycle state.
+	Notice time.Duration
+	// Maintenance covers scheduled and past maintenance events.
+	Maintenance time.Duration
+}
+
+// responseCache caches metadata responses by path. Errors aren't cached.
+type responseCache struct {
+	mu        sync.Mutex
+	responses map[string]cachedResponse
+}
+
+type cachedResponse struct {
+	body    []byte
+	found   bool
+	fetched time.Time
+}
+
+// get returns the response cached for path if it is younger than ttl, and
+// otherwise calls fetch and caches its response.
+func (c *responseCache) get(path string, ttl time.Duration, fetch func() ([]byte, bool, error)) ([]byte, bool, error) {
+	if ttl == 0 {
+		return fetch()
+	}
+
+	c.mu.Lock()
+	cached, ok := c.responses[path]
+	c.mu.Unlock()
+	if ok && (ttl < 0 || time.Since(cached.fetched) < ttl) {
+		return cached.body, cached.found, nil
+	}
+
+	body, found, err := fetch()
+	if err != nil {
+		return nil, false, err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.responses == nil {
+		c.responses = map[string]cachedResponse{}
+	}
+	c.responses[path] = cachedResponse{body: body, found: found, fetched: time.Now()}
+	return body, found, nil
+}
+
+// clear drops all cached responses.
+func (c *responseCache) clear() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.responses = nil
+}
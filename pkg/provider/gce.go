@@ -0,0 +1,247 @@
+package provider
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gjtempleton/spot-termination-exporter/pkg/imds"
+	log "github.com/sirupsen/logrus"
+)
+
+const gceMetadataEndpoint = "http://metadata.google.internal/computeMetadata/v1/"
+
+const (
+	// gceWatchTimeout is how long the metadata server holds a
+	// wait_for_change request when nothing changes.
+	gceWatchTimeout = 5 * time.Minute
+	// gceWatchRetry is the wait before a failed wait_for_change request is
+	// retried.
+	gceWatchRetry = 5 * time.Second
+)
+
+// gceWatchedKeys are the metadata keys announcing preemption and host
+// maintenance.
+var gceWatchedKeys = []string{"instance/preempted", "instance/maintenance-event"}
+
+func init() {
+	Register("gce", newGCEProvider)
+}
+
+// gceProvider reads from the Google Compute Engine metadata server. A
+// preemption of a spot or preemptible VM is reported as a termination notice
+// and host maintenance as a maintenance event, classified as live migration
+// or termination.
+type gceProvider struct {
+	metadataEndpoint string
+	client           *http.Client
+	// watchClient has no timeout of its own, as wait_for_change requests
+	// are held by the metadata server.
+	watchClient *http.Client
+}
+
+func newGCEProvider(cfg Config) (Provider, error) {
+	endpoint := cfg.MetadataEndpoint
+	if endpoint == "" {
+		endpoint = gceMetadataEndpoint
+	}
+	client := imds.NewHTTPClient(cfg.Transport)
+	watchClient := *client
+	watchClient.Timeout = 0
+	return &gceProvider{metadataEndpoint: endpoint, client: client, watchClient: &watchClient}, nil
+}
+
+func (p *gceProvider) GetInstanceIdentity(ctx context.Context) (*InstanceIdentity, error) {
+	values := map[string]string{}
+	for _, key := range []string{"instance/id", "instance/machine-type", "instance/zone"} {
+		value, err := p.get(ctx, key)
+		if err != nil {
+			return nil, fmt.Errorf("couldn't read %s from metadata: %w", key, err)
+		}
+		values[key] = value
+	}
+	// machine type and zone are returned as full resource names, e.g.
+	// projects/123/zones/us-central1-a
+	zone := path.Base(values["instance/zone"])
+	region := zone
+	if i := strings.LastIndex(zone, "-"); i > 0 {
+		region = zone[:i]
+	}
+	return &InstanceIdentity{
+		InstanceID:       values["instance/id"],
+		InstanceType:     path.Base(values["instance/machine-type"]),
+		Region:           region,
+		AvailabilityZone: zone,
+	}, nil
+}
+
+// GetTerminationNotice reports a preemption once instance/preempted is TRUE.
+// The metadata server doesn't say when the VM will be stopped, so the notice
+// has no time.
+func (p *gceProvider) GetTerminationNotice(ctx context.Context) (*TerminationNotice, error) {
+	preempted, err := p.get(ctx, "instance/preempted")
+	if err != nil {
+		return nil, err
+	}
+	if preempted != "TRUE" {
+		return nil, nil
+	}
+	return &TerminationNotice{Action: "preempt", Raw: []byte(preempted)}, nil
+}
+
+// GetRebalance always returns nil as GCE has no equivalent of rebalance
+// recommendations.
+func (p *gceProvider) GetRebalance(ctx context.Context) (*RebalanceRecommendation, error) {
+	return nil, nil
+}
+
+func (p *gceProvider) GetMaintenanceEvents(ctx context.Context) ([]MaintenanceEvent, error) {
+	event, err := p.get(ctx, "instance/maintenance-event")
+	if err != nil {
+		return nil, err
+	}
+	if event == "NONE" {
+		return nil, nil
+	}
+	return []MaintenanceEvent{{
+		ID:    event,
+		Code:  strings.ToLower(event),
+		State: "active",
+	}}, nil
+}
+
+// HostMaintenanceKind tells live migrations, which need no action, from
+// host maintenance stopping the VM.
+func (p *gceProvider) HostMaintenanceKind(event MaintenanceEvent) string {
+	switch event.ID {
+	case "MIGRATE_ON_HOST_MAINTENANCE":
+		return HostMaintenanceMigrate
+	case "TERMINATE_ON_HOST_MAINTENANCE":
+		return HostMaintenanceTerminate
+	}
+	return ""
+}
+
+// WatchChanges long polls the preemption and maintenance keys with
+// wait_for_change, which the metadata server answers as soon as their value
+// changes, calling changed on every change.
+func (p *gceProvider) WatchChanges(ctx context.Context, changed func()) {
+	var wg sync.WaitGroup
+	for _, key := range gceWatchedKeys {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			p.watchKey(ctx, key, changed)
+		}()
+	}
+	wg.Wait()
+}
+
+// watchKey long polls key until ctx is cancelled.
+func (p *gceProvider) watchKey(ctx context.Context, key string, changed func()) {
+	var etag string
+	for ctx.Err() == nil {
+		newETag, err := p.waitForChange(ctx, key, etag)
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			log.WithError(err).Debugf("couldn't wait for changes of %s, retrying in %s", key, gceWatchRetry)
+			select {
+			case <-ctx.Done():
+			case <-time.After(gceWatchRetry):
+			}
+			continue
+		}
+		// the first request returns right away to learn the etag
+		if etag != "" && newETag != etag {
+			changed()
+		}
+		etag = newETag
+	}
+}
+
+// waitForChange returns the etag of key once it differs from etag, or after
+// gceWatchTimeout.
+func (p *gceProvider) waitForChange(ctx context.Context, key, etag string) (string, error) {
+	target := p.metadataEndpoint + key
+	if etag != "" {
+		query := url.Values{}
+		query.Set("wait_for_change", "true")
+		query.Set("last_etag", etag)
+		query.Set("timeout_sec", strconv.Itoa(int(gceWatchTimeout.Seconds())))
+		target += "?" + query.Encode()
+	}
+	ctx, cancel := context.WithTimeout(ctx, gceWatchTimeout+10*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "GET", target, nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Add("Metadata-Flavor", "Google")
+	resp, err := p.watchClient.Do(req)
+	if err != nil {
+		imds.RecordPoll(key, 0, err)
+		return "", err
+	}
+	imds.RecordPoll(key, resp.StatusCode, nil)
+	defer imds.DrainAndClose(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		return "", &imds.StatusError{Code: resp.StatusCode}
+	}
+	newETag := resp.Header.Get("ETag")
+	if newETag == "" {
+		return "", fmt.Errorf("no ETag in the response")
+	}
+	return newETag, nil
+}
+
+// Detect checks for the Metadata-Flavor header only the GCE metadata server
+// sets.
+func (p *gceProvider) Detect(ctx context.Context) bool {
+	resp, err := p.do(ctx, "instance/id")
+	if err != nil {
+		log.Debugf("GCE metadata server not detected: %s", err)
+		return false
+	}
+	imds.DrainAndClose(resp.Body)
+	return resp.StatusCode == http.StatusOK && resp.Header.Get("Metadata-Flavor") == "Google"
+}
+
+func (p *gceProvider) get(ctx context.Context, key string) (string, error) {
+	resp, err := p.do(ctx, key)
+	if err != nil {
+		return "", err
+	}
+	defer imds.DrainAndClose(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		return "", &imds.StatusError{Code: resp.StatusCode}
+	}
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(body)), nil
+}
+
+func (p *gceProvider) do(ctx context.Context, key string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", p.metadataEndpoint+key, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Add("Metadata-Flavor", "Google")
+	resp, err := p.client.Do(req)
+	if err != nil {
+		imds.RecordPoll(key, 0, err)
+		return nil, err
+	}
+	imds.RecordPoll(key, resp.StatusCode, nil)
+	return resp, nil
+}
@@ -0,0 +1,318 @@
+// Package provider defines the interface the collectors use to read
+// interruption notices from a cloud provider's instance metadata service, and
+// implements it for AWS, Azure, GCE and Alibaba Cloud.
+package provider
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gjtempleton/spot-termination-exporter/pkg/imds"
+)
+
+// Provider fetches interruption related data from a cloud provider's instance
+// metadata service. Implementations return a nil notice rather than an error
+// when the metadata service is reachable but no notice is present.
+type Provider interface {
+	GetInstanceIdentity(ctx context.Context) (*InstanceIdentity, error)
+	GetTerminationNotice(ctx context.Context) (*TerminationNotice, error)
+	GetRebalance(ctx context.Context) (*RebalanceRecommendation, error)
+	GetMaintenanceEvents(ctx context.Context) ([]MaintenanceEvent, error)
+}
+
+// InstanceIdentity describes the instance the metadata service belongs to.
+type InstanceIdentity struct {
+	InstanceID       string
+	InstanceType     string
+	Region           string
+	AvailabilityZone string
+	// ImageID, Architecture and KernelID are empty when the provider doesn't
+	// report them. KernelID is only set for paravirtual instances.
+	ImageID      string
+	Architecture string
+	KernelID     string
+	// PendingTime is when the instance was last started, which changes after
+	// a stop and start. It is zero when the provider doesn't report it.
+	PendingTime time.Time
+}
+
+// SameRun reports whether identity describes the same run of the same
+// instance as other, i.e. the instance wasn't restarted or resized in between.
+// Details cached for other have to be refreshed otherwise.
+func (identity *InstanceIdentity) SameRun(other *InstanceIdentity) bool {
+	return identity.InstanceID == other.InstanceID &&
+		identity.InstanceType == other.InstanceType &&
+		identity.PendingTime.Equal(other.PendingTime)
+}
+
+// TerminationNotice is an imminent interruption of the instance. Time is zero
+// when the provider doesn't announce when the interruption will happen.
+type TerminationNotice struct {
+	Action string
+	Time   time.Time
+	// Raw is the metadata the notice was read from, nil if the provider
+	// doesn't keep it.
+	Raw []byte
+	// EventID identifies the notice for an EventAcknowledger, empty if the
+	// provider doesn't acknowledge notices.
+	EventID string
+}
+
+// Stale reports whether the notice was for an earlier run of the instance,
+// e.g. a hibernate notice still present after the instance resumed.
+func (notice *TerminationNotice) Stale(identity *InstanceIdentity) bool {
+	return !notice.Time.IsZero() && notice.Time.Before(identity.PendingTime)
+}
+
+// RebalanceRecommendation is a signal that the instance is at elevated risk
+// of interruption.
+type RebalanceRecommendation struct {
+	NoticeTime time.Time
+	// Raw is the metadata the recommendation was read from, nil if the
+	// provider doesn't keep it.
+	Raw []byte
+}
+
+// MaintenanceEvent is a maintenance event scheduled for the instance.
+type MaintenanceEvent struct {
+	ID          string    `json:"id"`
+	Code        string    `json:"code"`
+	State       string    `json:"state"`
+	Description string    `json:"description"`
+	NotBefore   time.Time `json:"not_before,omitzero"`
+	NotAfter    time.Time `json:"not_after,omitzero"`
+}
+
+// Detector is implemented by providers which can tell whether the exporter is
+// running on their cloud.
+type Detector interface {
+	Detect(ctx context.Context) bool
+}
+
+// Hostnamer is implemented by providers which can report the hostnames
+// assigned to the instance. kind names the hostname, e.g. "local-hostname" or
+// "hostname" for AWS.
+type Hostnamer interface {
+	GetHostname(ctx context.Context, kind string) (string, error)
+}
+
+// EndpointReporter is implemented by providers which can fall back to other
+// metadata endpoints, reporting the one which served the last request.
+type EndpointReporter interface {
+	LastEndpoint() string
+}
+
+// HopLimitReporter is implemented by providers which can tell that token
+// requests are blocked by the IMDSv2 hop limit.
+type HopLimitReporter interface {
+	HopLimitBlocked() bool
+}
+
+// TokenReporter is implemented by providers caching IMDSv2 session tokens,
+// reporting the tokens currently cached.
+type TokenReporter interface {
+	IMDSTokens() []imds.Token
+}
+
+// V1FallbackReporter is implemented by providers which can fall back to
+// IMDSv1, reporting whether the last request did.
+type V1FallbackReporter interface {
+	FallbackV1() bool
+}
+
+// LifecycleStateProvider is implemented by providers which can report the
+// target lifecycle state of an instance in an Auto Scaling group, e.g.
+// "InService" or "Warmed:Stopped". The state is empty for instances outside
+// an Auto Scaling group.
+type LifecycleStateProvider interface {
+	GetTargetLifecycleState(ctx context.Context) (string, error)
+}
+
+// ScheduledEvent is an event of any type the platform scheduled for the
+// instance, e.g. an Azure Scheduled Event. NotBefore is zero once the event
+// started.
+type ScheduledEvent struct {
+	ID        string
+	Type      string
+	Status    string
+	NotBefore time.Time
+}
+
+// ScheduledEventsProvider is implemented by providers announcing
+// interruptions and maintenance alike as typed scheduled events with a
+// deadline, so each type can be alerted on with its own notice period.
+type ScheduledEventsProvider interface {
+	GetScheduledEvents(ctx context.Context) ([]ScheduledEvent, error)
+}
+
+// EventAcknowledger is implemented by providers which let the instance
+// acknowledge a notice, allowing the platform to interrupt it without
+// waiting for the deadline, e.g. Azure Scheduled Events.
+type EventAcknowledger interface {
+	AcknowledgeEvent(ctx context.Context, eventID string) error
+}
+
+// ChangeWatcher is implemented by providers whose metadata service can hold a
+// request until the metadata changes, e.g. GCE, so notices are seen as soon
+// as they are issued without polling. WatchChanges blocks until ctx is
+// cancelled, calling changed whenever the notices may have changed.
+type ChangeWatcher interface {
+	WatchChanges(ctx context.Context, changed func())
+}
+
+// Kinds of host maintenance told apart by HostMaintenanceClassifier.
+const (
+	// HostMaintenanceMigrate moves the instance to another host without
+	// interrupting it.
+	HostMaintenanceMigrate = "migrate"
+	// HostMaintenanceTerminate stops the instance.
+	HostMaintenanceTerminate = "terminate"
+)
+
+// HostMaintenanceClassifier is implemented by providers whose maintenance
+// events include host maintenance which doesn't interrupt the instance, e.g.
+// GCE live migration, telling it apart from maintenance stopping the
+// instance. HostMaintenanceKind returns HostMaintenanceMigrate,
+// HostMaintenanceTerminate or "" for other events.
+type HostMaintenanceClassifier interface {
+	HostMaintenanceKind(event MaintenanceEvent) string
+}
+
+// MaintenanceHistoryProvider is implemented by providers which can report
+// past maintenance events of the instance, e.g. completed or canceled ones.
+type MaintenanceHistoryProvider interface {
+	GetMaintenanceHistory(ctx context.Context) ([]MaintenanceEvent, error)
+}
+
+// MetadataGetter is implemented by providers which can read arbitrary paths
+// below their metadata endpoint. Like imds.Client.Get it reports whether the
+// path was found rather than returning an error for a 404.
+type MetadataGetter interface {
+	GetMetadata(ctx context.Context, path string) ([]byte, bool, error)
+}
+
+// NetworkInterface is a network interface attached to the instance. Fields
+// the provider doesn't report are empty.
+type NetworkInterface struct {
+	ID           string
+	MAC          string
+	DeviceNumber string
+	PrivateIP    string
+	SubnetID     string
+	VPCID        string
+}
+
+// NetworkInterfacesProvider is implemented by providers reporting the network
+// interfaces attached to the instance, e.g. to correlate interruptions with
+// network-scoped resources to clean up.
+type NetworkInterfacesProvider interface {
+	GetNetworkInterfaces(ctx context.Context) ([]NetworkInterface, error)
+}
+
+// CacheClearer is implemented by providers caching metadata, see CacheTTLs.
+// ClearCache makes the next requests read the metadata anew.
+type CacheClearer interface {
+	ClearCache()
+}
+
+// Endpoint is a metadata endpoint and the token endpoint next to it.
+type Endpoint struct {
+	MetadataEndpoint string
+	TokenEndpoint    string
+}
+
+// Config holds the settings passed to a Factory. Providers ignore the settings
+// which don't apply to them, and fall back to their default endpoints when the
+// endpoints are empty.
+type Config struct {
+	MetadataEndpoint string
+	TokenEndpoint    string
+	UseIMDSv2        bool
+	// IMDSv1Fallback makes requests fall back to IMDSv1 when no IMDSv2 token
+	// can be obtained.
+	IMDSv1Fallback bool
+	// TokenTTL is the lifetime requested for IMDSv2 tokens, zero for the
+	// default.
+	TokenTTL time.Duration
+	// RequestTimeout and TokenTimeout limit metadata and token requests
+	// respectively, zero for the default.
+	RequestTimeout time.Duration
+	TokenTimeout   time.Duration
+	// FallbackEndpoints are tried in order when MetadataEndpoint can't be
+	// reached.
+	FallbackEndpoints []Endpoint
+	// Transport is used for requests to the metadata service, e.g. to trust
+	// a custom CA or bypass proxies, nil to use http.DefaultTransport.
+	Transport http.RoundTripper
+	// CacheTTLs sets how long each class of metadata is cached.
+	CacheTTLs CacheTTLs
+}
+
+// Factory creates a Provider from a Config.
+type Factory func(cfg Config) (Provider, error)
+
+var providers = map[string]Factory{}
+
+// Register makes a provider available under the given name. It is meant to be
+// called from the init function of the file implementing it.
+func Register(name string, factory Factory) {
+	if _, ok := providers[name]; ok {
+		panic(fmt.Sprintf("provider %q registered twice", name))
+	}
+	providers[name] = factory
+}
+
+// New creates the provider registered under the given name.
+func New(name string, cfg Config) (Provider, error) {
+	factory, ok := providers[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown provider %q, available providers: %v", name, Names())
+	}
+	return factory(cfg)
+}
+
+// Names returns the names of all registered providers in alphabetical order.
+func Names() []string {
+	names := make([]string, 0, len(providers))
+	for name := range providers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Detect probes the metadata services of all registered providers in
+// parallel and returns the name of the first one which responds.
+func Detect(ctx context.Context, cfg Config) (string, error) {
+	names := Names()
+	detected := make([]bool, len(names))
+
+	var wg sync.WaitGroup
+	for i, name := range names {
+		provider, err := providers[name](cfg)
+		if err != nil {
+			continue
+		}
+		detector, ok := provider.(Detector)
+		if !ok {
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			detected[i] = detector.Detect(ctx)
+		}()
+	}
+	wg.Wait()
+
+	for i, name := range names {
+		if detected[i] {
+			return name, nil
+		}
+	}
+	return "", fmt.Errorf("no metadata service detected, tried %v", names)
+}
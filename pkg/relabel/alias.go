@@ -0,0 +1,66 @@
+package relabel
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"google.golang.org/protobuf/proto"
+)
+
+var metricNameRE = regexp.MustCompile(`^[a-zA-Z_:][a-zA-Z0-9_:]*$`)
+
+// ValidateAliases checks that aliases maps valid metric names to valid
+// metric names.
+func ValidateAliases(aliases map[string]string) error {
+	for oldName, newName := range aliases {
+		if !metricNameRE.MatchString(oldName) {
+			return fmt.Errorf("invalid metric name %q", oldName)
+		}
+		if !metricNameRE.MatchString(newName) {
+			return fmt.Errorf("invalid metric name %q", newName)
+		}
+		if oldName == newName {
+			return fmt.Errorf("metric %s is aliased to itself", oldName)
+		}
+	}
+	return nil
+}
+
+// NewAliasGatherer returns a Gatherer exposing the metrics gathered by g
+// under both names of each pair of old and new names in aliases, so alerts
+// and dashboards can move from the old to the new name while both are
+// exported. Whichever of the two is gathered is copied to the other, unless
+// both are.
+func NewAliasGatherer(g prometheus.Gatherer, aliases map[string]string) prometheus.Gatherer {
+	return prometheus.GathererFunc(func() ([]*dto.MetricFamily, error) {
+		families, err := g.Gather()
+		byName := map[string]*dto.MetricFamily{}
+		for _, family := range families {
+			byName[family.GetName()] = family
+		}
+		for oldName, newName := range aliases {
+			oldFamily, newFamily := byName[oldName], byName[newName]
+			switch {
+			case oldFamily != nil && newFamily == nil:
+				families = append(families, alias(oldFamily, newName, fmt.Sprintf("(new name of %s)", oldName)))
+			case newFamily != nil && oldFamily == nil:
+				families = append(families, alias(newFamily, oldName, fmt.Sprintf("(deprecated, use %s)", newName)))
+			}
+		}
+		sort.Slice(families, func(i, j int) bool {
+			return families[i].GetName() < families[j].GetName()
+		})
+		return families, err
+	})
+}
+
+// alias returns a copy of family under name, with note appended to its help.
+func alias(family *dto.MetricFamily, name, note string) *dto.MetricFamily {
+	copied := proto.Clone(family).(*dto.MetricFamily)
+	copied.Name = proto.String(name)
+	copied.Help = proto.String(family.GetHelp() + " " + note)
+	return copied
+}
@@ -0,0 +1,223 @@
+// Package relabel rewrites the labels of gathered metrics before they are
+// exposed, like the metric_relabel_configs of a Prometheus scrape config, so
+// cardinality limits and label normalization can be enforced at the source,
+// and exposes metrics under aliases while they are being renamed.
+package relabel
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/protobuf/proto"
+	"sigs.k8s.io/yaml"
+)
+
+// Relabeling actions.
+const (
+	// Replace sets TargetLabel to Replacement, expanded with the groups
+	// of Regex, if Regex matches the source labels.
+	Replace = "replace"
+	// Keep drops the series whose source labels don't match Regex.
+	Keep = "keep"
+	// Drop drops the series whose source labels match Regex.
+	Drop = "drop"
+	// LabelKeep removes the labels whose names don't match Regex.
+	LabelKeep = "labelkeep"
+	// LabelDrop removes the labels whose names match Regex.
+	LabelDrop = "labeldrop"
+)
+
+// nameLabel holds the metric name in the source labels.
+const nameLabel = "__name__"
+
+var labelNameRE = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+// Config is the file configuring relabeling.
+type Config struct {
+	MetricRelabelConfigs []Rule `json:"metric_relabel_configs"`
+}
+
+// Rule is a relabeling step with the semantics of a Prometheus
+// relabel_config. Rules are applied in order to every series, with the
+// metric name available as the __name__ source label.
+type Rule struct {
+	SourceLabels []string `json:"source_labels"`
+	// Separator joins the values of the source labels, ";" by default.
+	Separator *string `json:"separator"`
+	// Regex is matched against the whole joined value, "(.*)" by default.
+	Regex       *string `json:"regex"`
+	TargetLabel string  `json:"target_label"`
+	// Replacement is "$1" by default.
+	Replacement *string `json:"replacement"`
+	// Action is one of Replace, the default, Keep, Drop, LabelKeep or
+	// LabelDrop.
+	Action string `json:"action"`
+
+	regex *regexp.Regexp
+}
+
+// LoadConfig reads and validates a YAML or JSON file configuring relabeling.
+func LoadConfig(path string) (*Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var cfg Config
+	if err := yaml.UnmarshalStrict(data, &cfg); err != nil {
+		return nil, fmt.Errorf("parse %s: %w", path, err)
+	}
+	for i := range cfg.MetricRelabelConfigs {
+		if err := cfg.MetricRelabelConfigs[i].compile(); err != nil {
+			return nil, fmt.Errorf("rule %d in %s: %w", i, path, err)
+		}
+	}
+	return &cfg, nil
+}
+
+func (r *Rule) compile() error {
+	if r.Separator == nil {
+		r.Separator = proto.String(";")
+	}
+	if r.Regex == nil {
+		r.Regex = proto.String("(.*)")
+	}
+	if r.Replacement == nil {
+		r.Replacement = proto.String("$1")
+	}
+	if r.Action == "" {
+		r.Action = Replace
+	}
+	regex, err := regexp.Compile("^(?:" + *r.Regex + ")$")
+	if err != nil {
+		return fmt.Errorf("invalid regex: %w", err)
+	}
+	r.regex = regex
+
+	switch r.Action {
+	case Replace:
+		if !labelNameRE.MatchString(r.TargetLabel) {
+			return fmt.Errorf("invalid target_label %q", r.TargetLabel)
+		}
+		// renaming metrics would move series between families
+		if r.TargetLabel == nameLabel {
+			return fmt.Errorf("target_label can't be %s", nameLabel)
+		}
+	case Keep, Drop:
+		if len(r.SourceLabels) == 0 {
+			return fmt.Errorf("%s requires source_labels", r.Action)
+		}
+	case LabelKeep, LabelDrop:
+		if len(r.SourceLabels) > 0 || r.TargetLabel != "" {
+			return fmt.Errorf("%s only takes a regex", r.Action)
+		}
+	default:
+		return fmt.Errorf("unknown action %q", r.Action)
+	}
+	return nil
+}
+
+// apply applies the rule to labels, returning false if the series is to be
+// dropped.
+func (r *Rule) apply(labels map[string]string) bool {
+	values := make([]string, len(r.SourceLabels))
+	for i, name := range r.SourceLabels {
+		values[i] = labels[name]
+	}
+	value := strings.Join(values, *r.Separator)
+
+	switch r.Action {
+	case Keep:
+		return r.regex.MatchString(value)
+	case Drop:
+		return !r.regex.MatchString(value)
+	case LabelKeep, LabelDrop:
+		for name := range labels {
+			if name != nameLabel && r.regex.MatchString(name) == (r.Action == LabelDrop) {
+				delete(labels, name)
+			}
+		}
+	case Replace:
+		match := r.regex.FindStringSubmatchIndex(value)
+		if match == nil {
+			return true
+		}
+		replaced := string(r.regex.ExpandString(nil, *r.Replacement, value, match))
+		if replaced == "" {
+			delete(labels, r.TargetLabel)
+		} else {
+			labels[r.TargetLabel] = replaced
+		}
+	}
+	return true
+}
+
+// NewGatherer returns a Gatherer applying rules to the metrics gathered by g.
+// Series which end up with the same labels as an earlier one of the same
+// metric are dropped, as are metrics left without series.
+func NewGatherer(g prometheus.Gatherer, rules []Rule) prometheus.Gatherer {
+	return prometheus.GathererFunc(func() ([]*dto.MetricFamily, error) {
+		families, err := g.Gather()
+		kept := families[:0]
+		for _, family := range families {
+			family.Metric = relabelMetrics(family.GetName(), family.Metric, rules)
+			// families without series can't be exposed
+			if len(family.Metric) > 0 {
+				kept = append(kept, family)
+			}
+		}
+		return kept, err
+	})
+}
+
+func relabelMetrics(name string, metrics []*dto.Metric, rules []Rule) []*dto.Metric {
+	kept := metrics[:0]
+	seen := map[string]bool{}
+	for _, metric := range metrics {
+		labels := map[string]string{nameLabel: name}
+		for _, pair := range metric.Label {
+			labels[pair.GetName()] = pair.GetValue()
+		}
+		dropped := false
+		for i := range rules {
+			if !rules[i].apply(labels) {
+				dropped = true
+				break
+			}
+		}
+		if dropped {
+			continue
+		}
+
+		delete(labels, nameLabel)
+		metric.Label = metric.Label[:0]
+		for labelName, value := range labels {
+			metric.Label = append(metric.Label, &dto.LabelPair{Name: proto.String(labelName), Value: proto.String(value)})
+		}
+		sort.Slice(metric.Label, func(i, j int) bool {
+			return metric.Label[i].GetName() < metric.Label[j].GetName()
+		})
+
+		signature := labelSignature(metric.Label)
+		if seen[signature] {
+			log.Debugf("dropping %s series which duplicates another after relabeling: %s", name, signature)
+			continue
+		}
+		seen[signature] = true
+		kept = append(kept, metric)
+	}
+	return kept
+}
+
+func labelSignature(labels []*dto.LabelPair) string {
+	var b strings.Builder
+	for _, pair := range labels {
+		fmt.Fprintf(&b, "%s=%q,", pair.GetName(), pair.GetValue())
+	}
+	return b.String()
+}
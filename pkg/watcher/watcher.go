@@ -0,0 +1,186 @@
+// Package watcher polls a provider in the background and delivers typed
+// interruption events to subscribers, so Go applications can react to a
+// termination notice in-process.
+package watcher
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/gjtempleton/spot-termination-exporter/pkg/imds"
+	"github.com/gjtempleton/spot-termination-exporter/pkg/provider"
+	log "github.com/sirupsen/logrus"
+)
+
+// subscriberBuffer is the number of events buffered per subscriber. Events
+// are rare, so a subscriber falling this far behind is considered stuck.
+const subscriberBuffer = 16
+
+// EventType distinguishes the kinds of Event.
+type EventType string
+
+const (
+	// Termination is sent when a termination notice is first observed, or
+	// when the action or time of a pending notice changes.
+	Termination EventType = "termination"
+	// Rebalance is sent when a rebalance recommendation is first observed.
+	Rebalance EventType = "rebalance"
+)
+
+// Event is an interruption signal observed by a Watcher.
+type Event struct {
+	Type         EventType
+	InstanceID   string
+	InstanceType string
+	// Action is the action announced by a termination notice, e.g.
+	// "terminate", "stop" or "hibernate".
+	Action string
+	// Time is when the instance will be interrupted for a termination, or
+	// when the recommendation was issued for a rebalance. It is zero when the
+	// provider doesn't report it.
+	Time time.Time
+	// Observed is when the Watcher first saw the event.
+	Observed time.Time
+}
+
+// Watcher polls a provider at a fixed interval, or when it reports a change,
+// and delivers events to its subscribers. It is safe for concurrent use.
+type Watcher struct {
+	provider provider.Provider
+	interval time.Duration
+
+	mu          sync.Mutex
+	subscribers map[chan Event]struct{}
+	termination *Event
+	rebalance   *Event
+}
+
+// New returns a Watcher polling p every interval, which also bounds each
+// poll. Run must be called for it to start polling.
+func New(p provider.Provider, interval time.Duration) *Watcher {
+	return &Watcher{
+		provider:    p,
+		interval:    interval,
+		subscribers: map[chan Event]struct{}{},
+	}
+}
+
+// Subscribe returns a channel receiving every event observed from now on. The
+// events still pending when Subscribe is called are delivered first, so late
+// subscribers don't miss a termination notice. The channel is closed once ctx
+// is cancelled.
+func (w *Watcher) Subscribe(ctx context.Context) <-chan Event {
+	ch := make(chan Event, subscriberBuffer)
+
+	w.mu.Lock()
+	for _, pending := range []*Event{w.termination, w.rebalance} {
+		if pending != nil {
+			ch <- *pending
+		}
+	}
+	w.subscribers[ch] = struct{}{}
+	w.mu.Unlock()
+
+	go func() {
+		<-ctx.Done()
+		w.mu.Lock()
+		delete(w.subscribers, ch)
+		close(ch)
+		w.mu.Unlock()
+	}()
+	return ch
+}
+
+// Run polls the provider until ctx is cancelled. If the provider is a
+// provider.ChangeWatcher, it is instead polled whenever it reports a change.
+func (w *Watcher) Run(ctx context.Context) error {
+	if watcher, ok := w.provider.(provider.ChangeWatcher); ok {
+		w.poll(ctx)
+		watcher.WatchChanges(ctx, func() {
+			w.poll(ctx)
+		})
+		return nil
+	}
+	ticker := time.NewTicker(w.interval)
+	defer ticker.Stop()
+	for {
+		w.poll(ctx)
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+func (w *Watcher) poll(ctx context.Context) {
+	ctx, cancel := context.WithTimeout(ctx, w.interval)
+	defer cancel()
+
+	identity, err := w.provider.GetInstanceIdentity(ctx)
+	if err != nil {
+		imds.WithError(err).Error("couldn't fetch instance identity")
+		return
+	}
+
+	notice, err := w.provider.GetTerminationNotice(ctx)
+	if notice != nil && notice.Stale(identity) {
+		// e.g. a hibernate notice left over after the instance resumed
+		notice = nil
+	}
+	if err != nil {
+		imds.WithError(err).Error("Failed to fetch termination notice")
+	} else {
+		w.mu.Lock()
+		switch {
+		case notice == nil:
+			w.termination = nil
+		case w.termination == nil || w.termination.Action != notice.Action || !w.termination.Time.Equal(notice.Time):
+			w.termination = &Event{
+				Type:         Termination,
+				InstanceID:   identity.InstanceID,
+				InstanceType: identity.InstanceType,
+				Action:       notice.Action,
+				Time:         notice.Time,
+				Observed:     time.Now(),
+			}
+			w.publish(*w.termination)
+		}
+		w.mu.Unlock()
+	}
+
+	rebalance, err := w.provider.GetRebalance(ctx)
+	if err != nil {
+		imds.WithError(err).Error("Failed to fetch rebalance recommendation")
+	} else {
+		w.mu.Lock()
+		switch {
+		case rebalance == nil:
+			w.rebalance = nil
+		case w.rebalance == nil:
+			w.rebalance = &Event{
+				Type:         Rebalance,
+				InstanceID:   identity.InstanceID,
+				InstanceType: identity.InstanceType,
+				Time:         rebalance.NoticeTime,
+				Observed:     time.Now(),
+			}
+			w.publish(*w.rebalance)
+		}
+		w.mu.Unlock()
+	}
+}
+
+// publish delivers an event to all subscribers without blocking the poll
+// loop. The caller must hold w.mu.
+func (w *Watcher) publish(event Event) {
+	for ch := range w.subscribers {
+		select {
+		case ch <- event:
+		default:
+			log.Warnf("dropping %s event for a subscriber which isn't keeping up", event.Type)
+		}
+	}
+}
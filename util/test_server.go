@@ -23,12 +23,74 @@ func main() {
 	http.HandleFunc("/latest/meta-data/instance-type", func(w http.ResponseWriter, r *http.Request) {
 		fmt.Fprint(w, "c5.9xlarge")
 	})
+	http.HandleFunc("/latest/meta-data/local-ipv4", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "10.0.0.5")
+	})
+	http.HandleFunc("/latest/meta-data/placement/region", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "eu-west-1")
+	})
+	http.HandleFunc("/latest/meta-data/placement/availability-zone", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "eu-west-1a")
+	})
+	http.HandleFunc("/latest/dynamic/instance-identity-document", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, "{\"architecture\":\"x86_64\",\"availabilityZone\":\"eu-west-1a\",\"imageId\":\"ami-0123456789abcdef0\",\"instanceId\":\"i-0d2aab13057917887\",\"instanceType\":\"c5.9xlarge\",\"kernelId\":null,\"pendingTime\":\"2026-01-01T00:00:00Z\",\"region\":\"eu-west-1\"}")
+	})
+	http.HandleFunc("/latest/meta-data/network/interfaces/macs/", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/latest/meta-data/network/interfaces/macs/" {
+			http.NotFound(w, r)
+			return
+		}
+		fmt.Fprint(w, "0e:49:61:0f:c3:11/")
+	})
+	http.HandleFunc("/latest/meta-data/network/interfaces/macs/0e:49:61:0f:c3:11/ipv4-associations/", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "192.0.2.10")
+	})
+	http.HandleFunc("/latest/meta-data/network/interfaces/macs/0e:49:61:0f:c3:11/ipv4-associations/192.0.2.10", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "10.0.0.5")
+	})
+	http.HandleFunc("/latest/meta-data/network/interfaces/macs/0e:49:61:0f:c3:11/interface-id", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "eni-0a1b2c3d4e5f60718")
+	})
+	http.HandleFunc("/latest/meta-data/network/interfaces/macs/0e:49:61:0f:c3:11/device-number", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "0")
+	})
+	http.HandleFunc("/latest/meta-data/network/interfaces/macs/0e:49:61:0f:c3:11/local-ipv4s", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "10.0.0.5\n10.0.0.6")
+	})
+	http.HandleFunc("/latest/meta-data/network/interfaces/macs/0e:49:61:0f:c3:11/subnet-id", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "subnet-0123456789abcdef0")
+	})
+	http.HandleFunc("/latest/meta-data/network/interfaces/macs/0e:49:61:0f:c3:11/vpc-id", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "vpc-0123456789abcdef0")
+	})
+	http.HandleFunc("/latest/meta-data/tags/instance/eks:nodegroup-name", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "spot-workers")
+	})
+	http.HandleFunc("/latest/meta-data/autoscaling/target-lifecycle-state", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "InService")
+	})
 	http.HandleFunc("/latest/meta-data/events/recommendations/rebalance", func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Content-Type", "application/json")
 		noticeTime := time.Now()
 		utc, _ := time.LoadLocation("UTC")
 		fmt.Fprintf(w, "{\"noticeTime\":\"%s\"}", noticeTime.In(utc).Format(time.RFC3339))
 	})
+	http.HandleFunc("/latest/meta-data/events/maintenance/scheduled", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		notBefore := time.Now().Add(72 * time.Hour)
+		utc, _ := time.LoadLocation("UTC")
+		fmt.Fprintf(w, "[{\"NotBefore\":\"%s\",\"Code\":\"system-reboot\",\"Description\":\"scheduled reboot\",\"EventId\":\"instance-event-0d59937288b749b32\",\"NotAfter\":\"%s\",\"State\":\"active\"}]",
+			notBefore.In(utc).Format("2 Jan 2006 15:04:05 GMT"), notBefore.Add(2*time.Hour).In(utc).Format("2 Jan 2006 15:04:05 GMT"))
+	})
+
+	http.HandleFunc("/latest/meta-data/events/maintenance/history", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		notBefore := time.Now().Add(-72 * time.Hour)
+		utc, _ := time.LoadLocation("UTC")
+		fmt.Fprintf(w, "[{\"NotBefore\":\"%s\",\"Code\":\"system-reboot\",\"Description\":\"[Completed] scheduled reboot\",\"EventId\":\"instance-event-0b8a7c6d5e4f3a2b1\",\"NotAfter\":\"%s\",\"State\":\"completed\"}]",
+			notBefore.In(utc).Format("2 Jan 2006 15:04:05 GMT"), notBefore.Add(2*time.Hour).In(utc).Format("2 Jan 2006 15:04:05 GMT"))
+	})
 
 	log.Fatal(http.ListenAndServe(":9092", nil))
 